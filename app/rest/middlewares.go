@@ -1 +1,194 @@
 package rest
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"vidcall/internal/common"
+	"vidcall/internal/module/auth"
+	"vidcall/internal/module/metrics"
+	"vidcall/pkg/log"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+var tracer = otel.Tracer("vidcall/app/rest")
+
+// webSocketTokenPrefix marks the Sec-WebSocket-Protocol entry carrying the
+// access token, since browsers cannot set headers on a WebSocket handshake:
+//
+//	new WebSocket(url, ["vidcall.v1", "bearer." + token])
+const webSocketTokenPrefix = "bearer."
+
+// Trace records a span for every request, continuing the trace of the
+// caller's traceparent header, and puts the trace ID in the log context.
+// WebSocket sessions are left out, rtc.Handler.JoinRoom traces them.
+func Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.URLPath(r.URL.Path)),
+		)
+		defer span.End()
+
+		if spanContext := span.SpanContext(); spanContext.IsValid() {
+			ctx = log.WithFields(ctx, log.TraceID(spanContext.TraceID().String()))
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if route := chi.RouteContext(r.Context()).RoutePattern(); route != "" {
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// AccessLog logs every request once it has been served, with the request ID
+// set by middleware.RequestID, which it also puts in the context for the log
+// lines of the handlers and services.
+func AccessLog(logger *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := log.WithFields(r.Context(), log.RequestID(middleware.GetReqID(r.Context())))
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			startedAt := time.Now()
+
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			status := ww.Status()
+			if status == 0 {
+				// hijacked connections and handlers that never wrote
+				status = http.StatusOK
+			}
+
+			fields := []zap.Field{
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.String("route", chi.RouteContext(r.Context()).RoutePattern()),
+				zap.Int("status", status),
+				zap.Int("bytes", ww.BytesWritten()),
+				zap.Duration("duration", time.Since(startedAt)),
+				zap.String("remoteAddr", r.RemoteAddr),
+				zap.String("userAgent", r.UserAgent()),
+			}
+
+			logger := log.Ctx(ctx, logger)
+			switch {
+			case status >= http.StatusInternalServerError:
+				logger.Error("Served request", fields...)
+			case status >= http.StatusBadRequest:
+				logger.Warn("Served request", fields...)
+			default:
+				logger.Info("Served request", fields...)
+			}
+		})
+	}
+}
+
+// unmatchedRoute labels the requests no route matched, so that scanners
+// cannot grow the label set.
+const unmatchedRoute = "unmatched"
+
+// Metrics records the duration of every request under its chi route pattern.
+// WebSocket sessions are left out, the connection gauge covers them.
+func Metrics(recorder metrics.Recorder) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			startedAt := time.Now()
+
+			next.ServeHTTP(ww, r)
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			route := chi.RouteContext(r.Context()).RoutePattern()
+			if route == "" {
+				route = unmatchedRoute
+			}
+			recorder.ObserveRequest(r.Method, route, status, time.Since(startedAt))
+		})
+	}
+}
+
+// Authenticate verifies the caller's access token and stores the user ID in
+// the request context for common.GetUserID.
+func Authenticate(authService *auth.Service, logger *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := extractToken(r)
+			if token == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Missing access token", http.StatusUnauthorized)
+				return
+			}
+
+			userID, err := authService.VerifyToken(token)
+			if err != nil {
+				log.Ctx(r.Context(), logger).Debug("Rejected access token", zap.String("path", r.URL.Path), zap.Error(err))
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "Invalid access token", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := log.WithFields(common.WithUserID(r.Context(), userID), log.UserID(userID))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// extractToken looks for the token in the Authorization header, then in the
+// WebSocket subprotocols and finally in the access_token query parameter.
+func extractToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if token, ok := strings.CutPrefix(strings.TrimSpace(protocol), webSocketTokenPrefix); ok {
+				return token
+			}
+		}
+	}
+
+	return r.URL.Query().Get("access_token")
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
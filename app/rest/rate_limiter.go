@@ -0,0 +1,103 @@
+package rest
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"vidcall/config"
+
+	"golang.org/x/time/rate"
+)
+
+// visitorIdleTimeout is how long a client IP is remembered after its last
+// request.
+const visitorIdleTimeout = 5 * time.Minute
+
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter throttles requests with a token bucket per client IP. It relies
+// on TrustedProxies.RealIP having set RemoteAddr.
+type RateLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	visitors  map[string]*visitor
+	lastSweep time.Time
+}
+
+func NewRateLimiter(cfg config.RateLimit) *RateLimiter {
+	return &RateLimiter{
+		limit:     rate.Limit(cfg.RequestsPerSecond),
+		burst:     cfg.Burst,
+		visitors:  make(map[string]*visitor),
+		lastSweep: time.Now(),
+	}
+}
+
+// SetLimit changes the rate and burst of every client, including the ones
+// already seen. A zero rate disables the limiter.
+func (limiter *RateLimiter) SetLimit(cfg config.RateLimit) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.limit = rate.Limit(cfg.RequestsPerSecond)
+	limiter.burst = cfg.Burst
+	for _, v := range limiter.visitors {
+		v.limiter.SetLimit(limiter.limit)
+		v.limiter.SetBurst(limiter.burst)
+	}
+}
+
+// Middleware answers 429 to clients over their rate.
+func (limiter *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.Allow(clientIP(r)) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Allow reports whether the client may make a request now.
+func (limiter *RateLimiter) Allow(ip string) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if limiter.limit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(limiter.lastSweep) > visitorIdleTimeout {
+		for key, v := range limiter.visitors {
+			if now.Sub(v.lastSeen) > visitorIdleTimeout {
+				delete(limiter.visitors, key)
+			}
+		}
+		limiter.lastSweep = now
+	}
+
+	v, ok := limiter.visitors[ip]
+	if !ok {
+		v = &visitor{limiter: rate.NewLimiter(limiter.limit, limiter.burst)}
+		limiter.visitors[ip] = v
+	}
+	v.lastSeen = now
+
+	return v.limiter.AllowN(now, 1)
+}
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,99 @@
+package rest
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// TrustedProxies are the reverse proxies whose forwarding headers are
+// believed. The list is swapped on reload.
+type TrustedProxies struct {
+	prefixes atomic.Pointer[[]netip.Prefix]
+}
+
+func NewTrustedProxies(list []string) *TrustedProxies {
+	proxies := &TrustedProxies{}
+	proxies.Set(list)
+	return proxies
+}
+
+// Set replaces the proxies with list, IPs and CIDRs the configuration has
+// validated.
+func (proxies *TrustedProxies) Set(list []string) {
+	var prefixes []netip.Prefix
+	for _, entry := range list {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	proxies.prefixes.Store(&prefixes)
+}
+
+// RealIP sets RemoteAddr to the client a trusted proxy forwarded the request
+// for. Requests from anyone else keep the address they came from, whatever
+// their headers say.
+func (proxies *TrustedProxies) RealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip, ok := proxies.clientIP(r); ok {
+			r.RemoteAddr = ip
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP is the nearest untrusted hop of X-Forwarded-For, else X-Real-IP, of
+// a request from a trusted proxy.
+func (proxies *TrustedProxies) clientIP(r *http.Request) (string, bool) {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !proxies.trusts(peer) {
+		return "", false
+	}
+
+	// Proxies append to X-Forwarded-For, so only the hops from the right up to
+	// the first untrusted one were not written by the client
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		client, ok := "", false
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, err := netip.ParseAddr(hop); err != nil {
+				break
+			}
+			client, ok = hop, true
+			if !proxies.trusts(hop) {
+				break
+			}
+		}
+		return client, ok
+	}
+
+	realIP := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+	if _, err := netip.ParseAddr(realIP); err != nil {
+		return "", false
+	}
+	return realIP, true
+}
+
+func (proxies *TrustedProxies) trusts(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range *proxies.prefixes.Load() {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxiesRealIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		peer    string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			name:    "headers of an untrusted peer ignored",
+			peer:    "203.0.113.7:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-IP": {"198.51.100.2"}},
+			want:    "203.0.113.7:5000",
+		},
+		{
+			name:    "nearest untrusted hop of a trusted proxy",
+			trusted: []string{"10.0.0.0/8"},
+			peer:    "10.0.0.2:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7", "10.0.0.3"}},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "only trusted hops",
+			trusted: []string{"10.0.0.2", "10.0.0.3"},
+			peer:    "10.0.0.2:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"10.0.0.3"}},
+			want:    "10.0.0.3",
+		},
+		{
+			name:    "malformed hop",
+			trusted: []string{"10.0.0.0/8"},
+			peer:    "10.0.0.2:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7, bogus"}, "X-Real-IP": {"198.51.100.2"}},
+			want:    "10.0.0.2:5000",
+		},
+		{
+			name:    "X-Real-IP of a trusted proxy",
+			trusted: []string{"10.0.0.0/8"},
+			peer:    "10.0.0.2:5000",
+			headers: map[string][]string{"X-Real-IP": {"203.0.113.7"}},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "IPv6 peer",
+			trusted: []string{"10.0.0.0/8"},
+			peer:    "[2001:db8::1]:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:    "[2001:db8::1]:5000",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got string
+			handler := NewTrustedProxies(test.trusted).RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.peer
+			for name, values := range test.headers {
+				r.Header[http.CanonicalHeaderKey(name)] = values
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
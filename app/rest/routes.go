@@ -4,6 +4,13 @@ import (
 	"net/http"
 	"time"
 
+	"vidcall/config"
+	"vidcall/internal/module/auth"
+	"vidcall/internal/module/call"
+	"vidcall/internal/module/cron"
+	"vidcall/internal/module/history"
+	"vidcall/internal/module/metrics"
+	"vidcall/internal/module/recording"
 	"vidcall/internal/module/room"
 	"vidcall/internal/module/rtc"
 	"vidcall/internal/module/user"
@@ -12,6 +19,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"go.uber.org/fx"
+	"go.uber.org/zap"
 )
 
 var Module = fx.Module("rest",
@@ -26,37 +34,94 @@ var Module = fx.Module("rest",
 type RouterParams struct {
 	fx.In
 
-	RoomHandler *room.Handler
-	ViewHandler *view.Handler
-	UserHandler *user.Handler
-	RTCHandler  *rtc.Handler
+	Logger           *zap.Logger
+	Config           config.Config
+	Watcher          *config.Watcher
+	Metrics          metrics.Recorder
+	AuthService      *auth.Service
+	AuthHandler      *auth.Handler
+	CallHandler      *call.Handler
+	CronHandler      *cron.Handler
+	HistoryHandler   *history.Handler
+	MetricsHandler   *metrics.Handler
+	RecordingHandler *recording.Handler
+	RoomHandler      *room.Handler
+	ViewHandler      *view.Handler
+	UserHandler      *user.Handler
+	RTCHandler       *rtc.Handler
+	ICEHandler       *rtc.ICEHandler
 }
 
 func NewRouter(params RouterParams) *chi.Mux {
 	router := chi.NewRouter()
 
+	trustedProxies := NewTrustedProxies(params.Config.RateLimit.TrustedProxies)
+	config.Subscribe(params.Watcher, func(c config.Config) []string { return c.RateLimit.TrustedProxies }, trustedProxies.Set)
+
 	router.Use(middleware.RequestID)
-	router.Use(middleware.RealIP)
-	router.Use(middleware.Logger)
+	router.Use(trustedProxies.RealIP)
+	router.Use(Trace)
+	router.Use(AccessLog(params.Logger))
+	router.Use(Metrics(params.Metrics))
 	router.Use(middleware.Recoverer)
 
-	router.Use(middleware.Timeout(30 * time.Second))
+	rateLimiter := NewRateLimiter(params.Config.RateLimit)
+	config.Subscribe(params.Watcher, func(c config.Config) config.RateLimit { return c.RateLimit }, rateLimiter.SetLimit)
+	router.Use(rateLimiter.Middleware)
+
+	authenticate := Authenticate(params.AuthService, params.Logger)
+
+	// WebSocket sessions are long-lived, so they are kept out of the request timeout
+	router.With(authenticate).Get("/ws/{roomID}", params.RTCHandler.JoinRoom)
+	// and so are downloads of recordings, which can be large
+	router.With(authenticate).Get("/rooms/{roomID}/recordings/{recordingID}/files/{name}", params.RecordingHandler.DownloadRecording)
+	// and presence streams
+	router.With(authenticate).Get("/presence/stream", params.UserHandler.WatchPresence)
+
+	router.Group(func(router chi.Router) {
+		router.Use(middleware.Timeout(30 * time.Second))
+
+		router.Get("/health", healthCheck)
+		router.Get("/metrics", params.MetricsHandler.GetMetrics)
+
+		router.Get("/", params.ViewHandler.RenderHomepage)
+		router.Get("/call/{roomID}", params.ViewHandler.RenderCallPage)
+
+		router.Post("/auth/register", params.AuthHandler.Register)
+		router.Post("/auth/login", params.AuthHandler.Login)
+
+		router.Group(func(router chi.Router) {
+			router.Use(authenticate)
+
+			router.Get("/rooms", params.RoomHandler.ListRooms)
+			router.Post("/rooms", params.RoomHandler.CreateRoom)
+			router.Get("/rooms/{roomID}", params.RoomHandler.GetRoom)
+			router.Patch("/rooms/{roomID}", params.RoomHandler.UpdateRoom)
+			router.Delete("/rooms/{roomID}", params.RoomHandler.DeleteRoom)
+			router.Get("/rooms/{roomID}/history", params.HistoryHandler.ListRoomHistory)
 
-	router.Get("/health", healthCheck)
+			router.Get("/rooms/{roomID}/recordings", params.RecordingHandler.ListRecordings)
+			router.Post("/rooms/{roomID}/recordings", params.RecordingHandler.StartRecording)
+			router.Get("/rooms/{roomID}/recordings/{recordingID}", params.RecordingHandler.GetRecording)
+			router.Post("/rooms/{roomID}/recordings/{recordingID}/stop", params.RecordingHandler.StopRecording)
 
-	router.Get("/", params.ViewHandler.RenderHomepage)
-	router.Get("/call/{roomID}", params.ViewHandler.RenderCallPage)
+			router.Get("/users", params.UserHandler.ListUsers)
+			router.Get("/users/{userID}", params.UserHandler.GetUser)
+			router.Get("/users/{userID}/calls", params.HistoryHandler.ListUserCalls)
+			router.Put("/presence", params.UserHandler.UpdatePresence)
 
-	router.Get("/rooms", params.RoomHandler.ListRooms)
-	router.Post("/rooms", params.RoomHandler.CreateRoom)
-	router.Get("/rooms/{roomID}", params.RoomHandler.GetRoom)
-	router.Delete("/rooms/{roomID}", params.RoomHandler.DeleteRoom)
+			router.Get("/calls", params.CallHandler.ListCalls)
+			router.Post("/calls", params.CallHandler.CreateCall)
+			router.Get("/calls/{callID}", params.CallHandler.GetCall)
+			router.Post("/calls/{callID}/accept", params.CallHandler.AcceptCall)
+			router.Post("/calls/{callID}/decline", params.CallHandler.DeclineCall)
+			router.Post("/calls/{callID}/cancel", params.CallHandler.CancelCall)
 
-	router.Get("/users", params.UserHandler.ListUsers)
-	router.Post("/users", params.UserHandler.CreateUser)
-	router.Get("/users/{userID}", params.UserHandler.GetUser)
+			router.Get("/rtc/ice-servers", params.ICEHandler.GetICEServers)
 
-	router.Get("/ws/{roomID}", params.RTCHandler.JoinRoom)
+			router.Get("/cron/stats", params.CronHandler.GetStats)
+		})
+	})
 
 	return router
 }
@@ -4,9 +4,13 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"time"
 
 	"vidcall/app/rest"
 	"vidcall/config"
+	"vidcall/internal/module/room"
+	"vidcall/internal/module/rtc"
+	"vidcall/internal/module/user"
 
 	"go.uber.org/fx"
 	"go.uber.org/zap"
@@ -20,15 +24,24 @@ var Module = fx.Module(
 
 type Server struct {
 	server *http.Server
+	tls    config.TLS
 	logger *zap.Logger
+
+	roomService    *room.Service
+	rtcHandler     *rtc.Handler
+	drainTimeout   time.Duration
+	reconnectDelay time.Duration
 }
 
 type ServerParams struct {
 	fx.In
 
-	Logger  *zap.Logger
-	Config  config.Config
-	Handler http.Handler
+	Logger      *zap.Logger
+	Config      config.Config
+	Handler     http.Handler
+	RoomService *room.Service
+	RTCHandler  *rtc.Handler
+	UserService *user.Service
 }
 
 type ServerResult struct {
@@ -43,9 +56,18 @@ func newServer(params ServerParams) ServerResult {
 			Addr:    params.Config.HttpServer.ToAddr(),
 			Handler: params.Handler,
 		},
+		tls:    params.Config.HttpServer.TLS,
 		logger: params.Logger,
+
+		roomService:    params.RoomService,
+		rtcHandler:     params.RTCHandler,
+		drainTimeout:   params.Config.HttpServer.DrainTimeout,
+		reconnectDelay: params.Config.HttpServer.ReconnectDelay,
 	}
 
+	// Presence streams never end on their own
+	srv.server.RegisterOnShutdown(params.UserService.CloseWatchers)
+
 	return ServerResult{
 		Server: srv,
 	}
@@ -73,15 +95,39 @@ func Invoke() func(server *Server) {
 func (s *Server) Start(ctx context.Context) {
 	s.logger.Info("Starting server",
 		zap.String("addr", s.server.Addr),
+		zap.Bool("tls", s.tls.Enabled()),
 	)
-	if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+
+	var err error
+	if s.tls.Enabled() {
+		err = s.server.ListenAndServeTLS(s.tls.CertFile, s.tls.KeyFile)
+	} else {
+		err = s.server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		s.logger.Fatal("Server failed", zap.Error(err))
 	}
 }
 
+// Shutdown stops room creation and new calls, gives the calls in progress
+// until the drain timeout to end, then waits for the remaining requests until
+// ctx is done before closing every connection.
 func (s *Server) Shutdown(ctx context.Context) {
+	s.logger.Info("Draining calls", zap.Duration("timeout", s.drainTimeout))
+
+	drainCtx, cancel := context.WithTimeout(ctx, s.drainTimeout)
+	defer cancel()
+
+	s.roomService.Drain(drainCtx)
+	if err := s.rtcHandler.Drain(drainCtx, s.reconnectDelay); err != nil {
+		s.logger.Warn("Calls did not end in time and were closed", zap.Error(err))
+	}
+
 	s.logger.Info("Shutting down server")
-	if err := s.server.Close(); err != nil {
-		s.logger.Error("Failed to shut down server", zap.Error(err))
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.logger.Error("Failed to shut down server gracefully, closing it", zap.Error(err))
+		if err := s.server.Close(); err != nil {
+			s.logger.Error("Failed to close server", zap.Error(err))
+		}
 	}
 }
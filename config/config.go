@@ -1,26 +1,165 @@
 package config
 
 import (
+	"context"
+	"crypto/rand"
+	"os"
+	"time"
+
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 )
 
 var Module = fx.Module("config",
 	fx.Provide(NewConfig),
+	fx.Provide(NewWatcher),
+	fx.Invoke(logConfig),
+	fx.Invoke(func(lc fx.Lifecycle, watcher *Watcher, logger *zap.Logger) {
+		lc.Append(fx.Hook{
+			OnStart: func(context.Context) error {
+				return watcher.Start(logger)
+			},
+			OnStop: func(context.Context) error {
+				watcher.Stop()
+				return nil
+			},
+		})
+	}),
 )
 
-func NewConfig(params ConfigParams) ConfigResult {
-	params.Logger.Info("Loading configuration...")
+func NewConfig() (ConfigResult, error) {
+	config, err := Load(os.Args[1:], os.LookupEnv)
+	if err != nil {
+		return ConfigResult{}, err
+	}
+
+	return ConfigResult{
+		Config: config,
+	}, nil
+}
 
-	config := Config{
+// Default is the configuration used for every setting that is not set
+// anywhere else.
+func Default() Config {
+	return Config{
 		HttpServer: HttpServer{
-			Port: "8080",
+			Port:           "8080",
+			DrainTimeout:   30 * time.Second,
+			ReconnectDelay: 5 * time.Second,
+		},
+		Auth: Auth{
+			TokenTTL: 24 * time.Hour,
+		},
+		Storage: Storage{
+			Driver: "memory",
+			Path:   "data/vidcall.db",
+		},
+		Log: Log{
+			Level:    "info",
+			Encoding: "json",
+			Sampling: LogSampling{
+				Initial:    100,
+				Thereafter: 100,
+			},
+			File: LogFile{
+				MaxSizeMB:  100,
+				MaxBackups: 10,
+				MaxAgeDays: 30,
+			},
+		},
+		RateLimit: RateLimit{
+			RequestsPerSecond: 20,
+			Burst:             40,
+		},
+		RTC: RTC{
+			CredentialTTL: 12 * time.Hour,
+			ResumeGrace:   30 * time.Second,
+			PingInterval:  10 * time.Second,
+			PingMisses:    3,
+		},
+		Cron: Cron{
+			RoomSweepInterval:       time.Minute,
+			UserSweepInterval:       time.Minute,
+			SubscriberSweepInterval: 5 * time.Minute,
+			RoomScheduleInterval:    30 * time.Second,
+			UserIdleTimeout:         5 * time.Minute,
+		},
+		Room: Room{
+			DefaultCapacity:  2,
+			MaxCapacity:      16,
+			EmptyGracePeriod: 5 * time.Minute,
+			ExpiryWarning:    5 * time.Minute,
+			RingTimeout:      30 * time.Second,
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			Endpoint:    "localhost:4317",
+			Protocol:    "grpc",
+			Insecure:    true,
+			SampleRatio: 1,
+		},
+		STUN: STUN{
+			Listen: ":3478",
+		},
+		Recording: Recording{
+			Dir: "data/recordings",
 		},
 	}
+}
 
-	params.Logger.Info("Loaded configuration", zap.Any("config", config))
+// Load builds the configuration from, in increasing precedence, the defaults,
+// the config file, VIDCALL_* environment variables and command-line flags,
+// then validates it.
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	config := Default()
 
-	return ConfigResult{
-		Config: config,
+	flags := parseFlags(args)
+
+	path := flags.configPath
+	if path == "" {
+		path, _ = lookupEnv(configPathEnv)
+	}
+	if path != "" {
+		if err := decodeFile(path, &config); err != nil {
+			return Config{}, err
+		}
+		config.file = path
+	}
+
+	if err := applyEnv(&config, lookupEnv); err != nil {
+		return Config{}, err
+	}
+	if err := flags.apply(&config); err != nil {
+		return Config{}, err
 	}
+
+	if config.Auth.Secret == "" {
+		config.Auth.Secret = randomSecret()
+		config.Auth.generated = true
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+type logConfigParams struct {
+	fx.In
+
+	Config Config
+	Logger *zap.Logger
+}
+
+func logConfig(params logConfigParams) {
+	if params.Config.Auth.generated {
+		params.Logger.Warn("auth.secret is not set, using a random secret; issued tokens will not survive a restart")
+	}
+
+	params.Logger.Info("Loaded configuration", zap.Object("config", params.Config))
+}
+
+func randomSecret() Secret {
+	return Secret(rand.Text() + rand.Text())
 }
@@ -1,18 +1,28 @@
 package config
 
 import (
+	"errors"
+	"time"
+
 	"go.uber.org/fx"
-	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 type Config struct {
-	HttpServer HttpServer
-}
-
-type ConfigParams struct {
-	fx.In
+	HttpServer HttpServer `yaml:"server" toml:"server"`
+	Auth       Auth       `yaml:"auth" toml:"auth"`
+	Storage    Storage    `yaml:"storage" toml:"storage"`
+	Log        Log        `yaml:"log" toml:"log"`
+	RateLimit  RateLimit  `yaml:"rate_limit" toml:"rate_limit"`
+	RTC        RTC        `yaml:"rtc" toml:"rtc"`
+	Cron       Cron       `yaml:"cron" toml:"cron"`
+	Room       Room       `yaml:"room" toml:"room"`
+	Tracing    Tracing    `yaml:"tracing" toml:"tracing"`
+	STUN       STUN       `yaml:"stun" toml:"stun"`
+	SFU        SFU        `yaml:"sfu" toml:"sfu"`
+	Recording  Recording  `yaml:"recording" toml:"recording"`
 
-	Logger *zap.Logger
+	file string // config file the settings were read from, if any
 }
 
 type ConfigResult struct {
@@ -21,11 +31,302 @@ type ConfigResult struct {
 	Config Config
 }
 
+// MarshalLogObject logs every section of the configuration, with secrets
+// redacted.
+func (c Config) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	return errors.Join(
+		enc.AddObject("server", c.HttpServer),
+		enc.AddObject("auth", c.Auth),
+		enc.AddObject("storage", c.Storage),
+		enc.AddObject("log", c.Log),
+		enc.AddObject("rate_limit", c.RateLimit),
+		enc.AddObject("rtc", c.RTC),
+		enc.AddObject("cron", c.Cron),
+		enc.AddObject("room", c.Room),
+		enc.AddObject("tracing", c.Tracing),
+		enc.AddObject("stun", c.STUN),
+		enc.AddObject("sfu", c.SFU),
+		enc.AddObject("recording", c.Recording),
+	)
+}
+
+// Secret is a configuration value that must never be logged.
+type Secret string
+
+const redacted = "[REDACTED]"
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// MaxDrainTimeout bounds HttpServer.DrainTimeout, so that the process always
+// gets to stop.
+const MaxDrainTimeout = 10 * time.Minute
+
 type HttpServer struct {
-	Host string
-	Port string
+	Host           string        `yaml:"host" toml:"host"`
+	Port           string        `yaml:"port" toml:"port"`
+	TLS            TLS           `yaml:"tls" toml:"tls"`
+	DrainTimeout   time.Duration `yaml:"drain_timeout" toml:"drain_timeout"`     // how long calls get to end on shutdown
+	ReconnectDelay time.Duration `yaml:"reconnect_delay" toml:"reconnect_delay"` // how long clients wait before reconnecting after a shutdown
+}
+
+func (h HttpServer) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("host", h.Host)
+	enc.AddString("port", h.Port)
+	enc.AddBool("tls", h.TLS.Enabled())
+	enc.AddDuration("drain_timeout", h.DrainTimeout)
+	enc.AddDuration("reconnect_delay", h.ReconnectDelay)
+	return nil
 }
 
 func (h HttpServer) ToAddr() string {
 	return h.Host + ":" + h.Port
 }
+
+// TLS is served when both files are set.
+type TLS struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+}
+
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+type Auth struct {
+	Secret   Secret        `yaml:"secret" toml:"secret"` // HMAC key used to sign access tokens
+	TokenTTL time.Duration `yaml:"token_ttl" toml:"token_ttl"`
+
+	generated bool // Secret was not configured and is random
+}
+
+func (a Auth) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("secret", a.Secret.String())
+	enc.AddDuration("token_ttl", a.TokenTTL)
+	return nil
+}
+
+type Storage struct {
+	Driver string `yaml:"driver" toml:"driver"` // "memory" or "bolt"
+	Path   string `yaml:"path" toml:"path"`     // database file of the bolt driver
+}
+
+func (s Storage) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("driver", s.Driver)
+	enc.AddString("path", s.Path)
+	return nil
+}
+
+type Log struct {
+	Level    string      `yaml:"level" toml:"level"`       // debug, info, warn or error
+	Encoding string      `yaml:"encoding" toml:"encoding"` // json or console
+	Sampling LogSampling `yaml:"sampling" toml:"sampling"`
+	File     LogFile     `yaml:"file" toml:"file"`
+}
+
+func (l Log) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("level", l.Level)
+	enc.AddString("encoding", l.Encoding)
+	enc.AddInt("sampling_initial", l.Sampling.Initial)
+	enc.AddInt("sampling_thereafter", l.Sampling.Thereafter)
+	enc.AddString("file", l.File.Path)
+	return nil
+}
+
+// LogSampling logs, every second, the first Initial entries with the same
+// level and message, then every Thereafter-th. A zero Initial disables it.
+type LogSampling struct {
+	Initial    int `yaml:"initial" toml:"initial"`
+	Thereafter int `yaml:"thereafter" toml:"thereafter"`
+}
+
+// LogFile writes logs to a rotated file instead of stdout when Path is set.
+type LogFile struct {
+	Path       string `yaml:"path" toml:"path"`
+	MaxSizeMB  int    `yaml:"max_size_mb" toml:"max_size_mb"`   // size at which the file is rotated
+	MaxBackups int    `yaml:"max_backups" toml:"max_backups"`   // rotated files kept, 0 keeps all
+	MaxAgeDays int    `yaml:"max_age_days" toml:"max_age_days"` // age after which rotated files are removed, 0 keeps them
+	Compress   bool   `yaml:"compress" toml:"compress"`         // gzip rotated files
+}
+
+// RateLimit throttles HTTP requests per client IP. A zero rate disables it.
+type RateLimit struct {
+	RequestsPerSecond float64  `yaml:"requests_per_second" toml:"requests_per_second"`
+	Burst             int      `yaml:"burst" toml:"burst"`
+	TrustedProxies    []string `yaml:"trusted_proxies" toml:"trusted_proxies"` // IPs or CIDRs whose X-Forwarded-For is believed
+}
+
+func (r RateLimit) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddFloat64("requests_per_second", r.RequestsPerSecond)
+	enc.AddInt("burst", r.Burst)
+	return enc.AddArray("trusted_proxies", zapcore.ArrayMarshalerFunc(func(arr zapcore.ArrayEncoder) error {
+		for _, proxy := range r.TrustedProxies {
+			arr.AppendString(proxy)
+		}
+		return nil
+	}))
+}
+
+func (r RateLimit) Enabled() bool {
+	return r.RequestsPerSecond > 0
+}
+
+// RTC is what clients are told to connect their peers through.
+type RTC struct {
+	ICEServers    []ICEServer   `yaml:"ice_servers" toml:"ice_servers"`
+	CredentialTTL time.Duration `yaml:"credential_ttl" toml:"credential_ttl"` // lifetime of the TURN credentials issued from a shared secret
+	ResumeGrace   time.Duration `yaml:"resume_grace" toml:"resume_grace"`     // how long a dropped session may be resumed, 0 disables resumption
+	PingInterval  time.Duration `yaml:"ping_interval" toml:"ping_interval"`   // how often connections are pinged
+	PingMisses    int           `yaml:"ping_misses" toml:"ping_misses"`       // pings a connection may leave unanswered before its peer is evicted
+}
+
+func (r RTC) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddDuration("credential_ttl", r.CredentialTTL)
+	enc.AddDuration("resume_grace", r.ResumeGrace)
+	enc.AddDuration("ping_interval", r.PingInterval)
+	enc.AddInt("ping_misses", r.PingMisses)
+	return enc.AddArray("ice_servers", zapcore.ArrayMarshalerFunc(func(arr zapcore.ArrayEncoder) error {
+		for _, server := range r.ICEServers {
+			if err := arr.AppendObject(server); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// ICEServer mirrors the RTCIceServer dictionary handed to browsers. A TURN
+// server either has a static Username and Credential or shares SharedSecret
+// with the server, which then issues time-limited credentials following the
+// coturn REST API (use-auth-secret).
+type ICEServer struct {
+	URLs         []string `yaml:"urls" toml:"urls" json:"urls"`
+	Username     string   `yaml:"username" toml:"username" json:"username,omitempty"`
+	Credential   Secret   `yaml:"credential" toml:"credential" json:"credential,omitempty"`
+	SharedSecret Secret   `yaml:"shared_secret" toml:"shared_secret" json:"-"`
+}
+
+func (i ICEServer) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	if err := enc.AddArray("urls", zapcore.ArrayMarshalerFunc(func(arr zapcore.ArrayEncoder) error {
+		for _, url := range i.URLs {
+			arr.AppendString(url)
+		}
+		return nil
+	})); err != nil {
+		return err
+	}
+	enc.AddString("username", i.Username)
+	enc.AddString("credential", i.Credential.String())
+	enc.AddString("shared_secret", i.SharedSecret.String())
+	return nil
+}
+
+type Cron struct {
+	RoomSweepInterval       time.Duration `yaml:"room_sweep_interval" toml:"room_sweep_interval"`             // how often expired rooms are deleted
+	UserSweepInterval       time.Duration `yaml:"user_sweep_interval" toml:"user_sweep_interval"`             // how often idle users are taken offline
+	SubscriberSweepInterval time.Duration `yaml:"subscriber_sweep_interval" toml:"subscriber_sweep_interval"` // how often orphaned room subscribers are closed
+	RoomScheduleInterval    time.Duration `yaml:"room_schedule_interval" toml:"room_schedule_interval"`       // how often scheduled room ends are checked
+	UserIdleTimeout         time.Duration `yaml:"user_idle_timeout" toml:"user_idle_timeout"`                 // inactivity after which a user is taken offline
+}
+
+func (c Cron) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddDuration("room_sweep_interval", c.RoomSweepInterval)
+	enc.AddDuration("user_sweep_interval", c.UserSweepInterval)
+	enc.AddDuration("subscriber_sweep_interval", c.SubscriberSweepInterval)
+	enc.AddDuration("room_schedule_interval", c.RoomScheduleInterval)
+	enc.AddDuration("user_idle_timeout", c.UserIdleTimeout)
+	return nil
+}
+
+// MinRoomCapacity is the smallest room that still makes a call. The default
+// and largest capacities are configured.
+const MinRoomCapacity = 2
+
+type Room struct {
+	DefaultCapacity  int           `yaml:"default_capacity" toml:"default_capacity"`     // capacity of rooms created without one
+	MaxCapacity      int           `yaml:"max_capacity" toml:"max_capacity"`             // largest capacity a room may have
+	EmptyGracePeriod time.Duration `yaml:"empty_grace_period" toml:"empty_grace_period"` // how long an empty room lives before it expires
+	ExpiryWarning    time.Duration `yaml:"expiry_warning" toml:"expiry_warning"`         // how long before a scheduled end room_expiring is sent
+	RingTimeout      time.Duration `yaml:"ring_timeout" toml:"ring_timeout"`             // how long a direct call rings before it is missed
+}
+
+func (r Room) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddInt("default_capacity", r.DefaultCapacity)
+	enc.AddInt("max_capacity", r.MaxCapacity)
+	enc.AddDuration("empty_grace_period", r.EmptyGracePeriod)
+	enc.AddDuration("expiry_warning", r.ExpiryWarning)
+	enc.AddDuration("ring_timeout", r.RingTimeout)
+	return nil
+}
+
+// Tracing exports OpenTelemetry spans. The none exporter turns tracing off.
+type Tracing struct {
+	Exporter    string  `yaml:"exporter" toml:"exporter"`         // none, stdout or otlp
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint"`         // host:port of the OTLP collector
+	Protocol    string  `yaml:"protocol" toml:"protocol"`         // grpc or http, for otlp
+	Insecure    bool    `yaml:"insecure" toml:"insecure"`         // talk to the collector without TLS
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"` // share of new traces recorded, from 0 to 1
+}
+
+func (t Tracing) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("exporter", t.Exporter)
+	enc.AddString("endpoint", t.Endpoint)
+	enc.AddString("protocol", t.Protocol)
+	enc.AddBool("insecure", t.Insecure)
+	enc.AddFloat64("sample_ratio", t.SampleRatio)
+	return nil
+}
+
+func (t Tracing) Enabled() bool {
+	return t.Exporter != "none"
+}
+
+// STUN runs a STUN binding server in the process, for networks that cannot
+// reach a public one. It is handed to clients with the ICE servers.
+type STUN struct {
+	Enabled   bool   `yaml:"enabled" toml:"enabled"`
+	Listen    string `yaml:"listen" toml:"listen"`       // UDP address to listen on
+	Advertise string `yaml:"advertise" toml:"advertise"` // host:port clients reach it on, the host they reach the server on when empty
+}
+
+func (s STUN) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddBool("enabled", s.Enabled)
+	enc.AddString("listen", s.Listen)
+	enc.AddString("advertise", s.Advertise)
+	return nil
+}
+
+// SFU lets rooms be created in sfu mode, where the server terminates the peer
+// connection of every participant and forwards their tracks to the others.
+type SFU struct {
+	Enabled   bool     `yaml:"enabled" toml:"enabled"`
+	PortMin   int      `yaml:"port_min" toml:"port_min"`     // lowest UDP port of the media connections, 0 for any
+	PortMax   int      `yaml:"port_max" toml:"port_max"`     // highest UDP port of the media connections, 0 for any
+	PublicIPs []string `yaml:"public_ips" toml:"public_ips"` // advertised instead of the host addresses, behind a 1:1 NAT
+}
+
+func (s SFU) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddBool("enabled", s.Enabled)
+	enc.AddInt("port_min", s.PortMin)
+	enc.AddInt("port_max", s.PortMax)
+	return enc.AddArray("public_ips", zapcore.ArrayMarshalerFunc(func(arr zapcore.ArrayEncoder) error {
+		for _, ip := range s.PublicIPs {
+			arr.AppendString(ip)
+		}
+		return nil
+	}))
+}
+
+// Recording is where the calls of sfu rooms are recorded to.
+type Recording struct {
+	Dir string `yaml:"dir" toml:"dir"` // one directory per recording is created in it
+}
+
+func (r Recording) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("dir", r.Dir)
+	return nil
+}
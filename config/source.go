@@ -0,0 +1,182 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	envPrefix     = "VIDCALL_"
+	configPathEnv = envPrefix + "CONFIG"
+)
+
+// binding is a setting that can be overridden by an environment variable and
+// a flag. The flag is named after it and the variable is VIDCALL_ followed by
+// the name in upper case with dots and dashes turned into underscores, so
+// "storage.path" is -storage.path and VIDCALL_STORAGE_PATH.
+type binding struct {
+	name  string
+	usage string
+	set   func(config *Config, value string) error
+}
+
+func bind[T any](name, usage string, parse func(string) (T, error), field func(*Config) *T) binding {
+	return binding{
+		name:  name,
+		usage: usage,
+		set: func(config *Config, value string) error {
+			parsed, err := parse(value)
+			if err != nil {
+				return fmt.Errorf("config: invalid %s %q: %w", name, value, err)
+			}
+			*field(config) = parsed
+			return nil
+		},
+	}
+}
+
+func parseString(s string) (string, error) { return s, nil }
+func parseSecret(s string) (Secret, error) { return Secret(s), nil }
+func parseFloat(s string) (float64, error) { return strconv.ParseFloat(s, 64) }
+func parseList(s string) ([]string, error) { return strings.Split(s, ","), nil }
+
+var bindings = []binding{
+	bind("server.host", "interface to listen on", parseString, func(c *Config) *string { return &c.HttpServer.Host }),
+	bind("server.port", "port to listen on", parseString, func(c *Config) *string { return &c.HttpServer.Port }),
+	bind("server.tls.cert-file", "TLS certificate file", parseString, func(c *Config) *string { return &c.HttpServer.TLS.CertFile }),
+	bind("server.tls.key-file", "TLS private key file", parseString, func(c *Config) *string { return &c.HttpServer.TLS.KeyFile }),
+	bind("server.drain-timeout", "how long calls get to end on shutdown", time.ParseDuration, func(c *Config) *time.Duration { return &c.HttpServer.DrainTimeout }),
+	bind("server.reconnect-delay", "how long clients wait before reconnecting after a shutdown", time.ParseDuration, func(c *Config) *time.Duration { return &c.HttpServer.ReconnectDelay }),
+	bind("auth.secret", "HMAC key used to sign access tokens", parseSecret, func(c *Config) *Secret { return &c.Auth.Secret }),
+	bind("auth.token-ttl", "lifetime of access tokens", time.ParseDuration, func(c *Config) *time.Duration { return &c.Auth.TokenTTL }),
+	bind("storage.driver", "storage backend, memory or bolt", parseString, func(c *Config) *string { return &c.Storage.Driver }),
+	bind("storage.path", "database file of the bolt driver", parseString, func(c *Config) *string { return &c.Storage.Path }),
+	bind("log.level", "log level, debug, info, warn or error", parseString, func(c *Config) *string { return &c.Log.Level }),
+	bind("log.encoding", "log encoding, json or console", parseString, func(c *Config) *string { return &c.Log.Encoding }),
+	bind("log.sampling.initial", "entries logged per second with the same message before sampling, 0 disables", strconv.Atoi, func(c *Config) *int { return &c.Log.Sampling.Initial }),
+	bind("log.sampling.thereafter", "sampling keeps every n-th entry after the initial ones", strconv.Atoi, func(c *Config) *int { return &c.Log.Sampling.Thereafter }),
+	bind("log.file.path", "log file, stdout when empty", parseString, func(c *Config) *string { return &c.Log.File.Path }),
+	bind("log.file.max-size-mb", "size at which the log file is rotated", strconv.Atoi, func(c *Config) *int { return &c.Log.File.MaxSizeMB }),
+	bind("log.file.max-backups", "rotated log files kept, 0 keeps all", strconv.Atoi, func(c *Config) *int { return &c.Log.File.MaxBackups }),
+	bind("log.file.max-age-days", "age after which rotated log files are removed, 0 keeps them", strconv.Atoi, func(c *Config) *int { return &c.Log.File.MaxAgeDays }),
+	bind("log.file.compress", "gzip rotated log files", strconv.ParseBool, func(c *Config) *bool { return &c.Log.File.Compress }),
+	bind("rate-limit.requests-per-second", "requests per second allowed per client IP, 0 disables", parseFloat, func(c *Config) *float64 { return &c.RateLimit.RequestsPerSecond }),
+	bind("rate-limit.burst", "requests a client IP may burst above the rate", strconv.Atoi, func(c *Config) *int { return &c.RateLimit.Burst }),
+	bind("rate-limit.trusted-proxies", "comma separated IPs or CIDRs of the reverse proxies whose X-Forwarded-For is believed", parseList, func(c *Config) *[]string { return &c.RateLimit.TrustedProxies }),
+	bind("rtc.credential-ttl", "lifetime of the TURN credentials issued from a shared secret", time.ParseDuration, func(c *Config) *time.Duration { return &c.RTC.CredentialTTL }),
+	bind("rtc.resume-grace", "how long a dropped WebSocket session may be resumed, 0 disables resumption", time.ParseDuration, func(c *Config) *time.Duration { return &c.RTC.ResumeGrace }),
+	bind("rtc.ping-interval", "how often WebSocket connections are pinged", time.ParseDuration, func(c *Config) *time.Duration { return &c.RTC.PingInterval }),
+	bind("rtc.ping-misses", "pings a connection may leave unanswered before its peer is evicted", strconv.Atoi, func(c *Config) *int { return &c.RTC.PingMisses }),
+	bind("cron.room-sweep-interval", "how often expired rooms are deleted", time.ParseDuration, func(c *Config) *time.Duration { return &c.Cron.RoomSweepInterval }),
+	bind("cron.user-sweep-interval", "how often idle users are taken offline", time.ParseDuration, func(c *Config) *time.Duration { return &c.Cron.UserSweepInterval }),
+	bind("cron.subscriber-sweep-interval", "how often orphaned room subscribers are closed", time.ParseDuration, func(c *Config) *time.Duration { return &c.Cron.SubscriberSweepInterval }),
+	bind("cron.room-schedule-interval", "how often scheduled room ends are checked", time.ParseDuration, func(c *Config) *time.Duration { return &c.Cron.RoomScheduleInterval }),
+	bind("cron.user-idle-timeout", "inactivity after which a user is taken offline", time.ParseDuration, func(c *Config) *time.Duration { return &c.Cron.UserIdleTimeout }),
+	bind("room.default-capacity", "capacity of rooms created without one", strconv.Atoi, func(c *Config) *int { return &c.Room.DefaultCapacity }),
+	bind("room.max-capacity", "largest capacity a room may have", strconv.Atoi, func(c *Config) *int { return &c.Room.MaxCapacity }),
+	bind("room.empty-grace-period", "how long an empty room lives before it expires", time.ParseDuration, func(c *Config) *time.Duration { return &c.Room.EmptyGracePeriod }),
+	bind("room.expiry-warning", "how long before a scheduled end room_expiring is sent", time.ParseDuration, func(c *Config) *time.Duration { return &c.Room.ExpiryWarning }),
+	bind("room.ring-timeout", "how long a direct call rings before it is missed", time.ParseDuration, func(c *Config) *time.Duration { return &c.Room.RingTimeout }),
+	bind("tracing.exporter", "span exporter, none, stdout or otlp", parseString, func(c *Config) *string { return &c.Tracing.Exporter }),
+	bind("tracing.endpoint", "host:port of the OTLP collector", parseString, func(c *Config) *string { return &c.Tracing.Endpoint }),
+	bind("tracing.protocol", "OTLP protocol, grpc or http", parseString, func(c *Config) *string { return &c.Tracing.Protocol }),
+	bind("tracing.insecure", "talk to the OTLP collector without TLS", strconv.ParseBool, func(c *Config) *bool { return &c.Tracing.Insecure }),
+	bind("tracing.sample-ratio", "share of new traces recorded, from 0 to 1", parseFloat, func(c *Config) *float64 { return &c.Tracing.SampleRatio }),
+	bind("stun.enabled", "run the embedded STUN server", strconv.ParseBool, func(c *Config) *bool { return &c.STUN.Enabled }),
+	bind("stun.listen", "UDP address of the embedded STUN server", parseString, func(c *Config) *string { return &c.STUN.Listen }),
+	bind("stun.advertise", "host:port clients reach the embedded STUN server on", parseString, func(c *Config) *string { return &c.STUN.Advertise }),
+	bind("sfu.enabled", "allow rooms in sfu mode", strconv.ParseBool, func(c *Config) *bool { return &c.SFU.Enabled }),
+	bind("sfu.port-min", "lowest UDP port of SFU media connections", strconv.Atoi, func(c *Config) *int { return &c.SFU.PortMin }),
+	bind("sfu.port-max", "highest UDP port of SFU media connections", strconv.Atoi, func(c *Config) *int { return &c.SFU.PortMax }),
+	bind("sfu.public-ips", "comma separated IPs advertised for SFU media behind a 1:1 NAT", parseList, func(c *Config) *[]string { return &c.SFU.PublicIPs }),
+	bind("recording.dir", "directory recordings are written to", parseString, func(c *Config) *string { return &c.Recording.Dir }),
+}
+
+func (b binding) envKey() string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(b.name))
+}
+
+// decodeFile reads a YAML or TOML file, picked by its extension, over config.
+// Unknown keys are an error so that typos do not go unnoticed.
+func decodeFile(path string, config *Config) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(raw))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil {
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(raw), config)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config: %s: unknown keys %v", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("config: %s: unsupported format %q, use .yaml, .yml or .toml", path, ext)
+	}
+
+	return nil
+}
+
+func applyEnv(config *Config, lookupEnv func(string) (string, bool)) error {
+	for _, b := range bindings {
+		if value, ok := lookupEnv(b.envKey()); ok && value != "" {
+			if err := b.set(config, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flagValues are the command-line flags, kept aside until the file and the
+// environment have been applied.
+type flagValues struct {
+	configPath string
+	set        []func(config *Config) error
+}
+
+// parseFlags exits the process on -h or an unknown flag, like any CLI does.
+func parseFlags(args []string) *flagValues {
+	values := &flagValues{}
+
+	flags := flag.NewFlagSet("vidcall", flag.ExitOnError)
+	flags.StringVar(&values.configPath, "config", "", "YAML or TOML config file, also "+configPathEnv)
+	for _, b := range bindings {
+		flags.Func(b.name, b.usage+", also "+b.envKey(), func(value string) error {
+			values.set = append(values.set, func(config *Config) error {
+				return b.set(config, value)
+			})
+			return nil
+		})
+	}
+	_ = flags.Parse(args)
+
+	return values
+}
+
+func (values *flagValues) apply(config *Config) error {
+	for _, set := range values.set {
+		if err := set(config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Validate reports every invalid setting at once.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.HttpServer.Port)
+	check(err == nil && port > 0 && port <= 65535, "server.port %q is not a valid port", c.HttpServer.Port)
+
+	tls := c.HttpServer.TLS
+	check((tls.CertFile == "") == (tls.KeyFile == ""), "server.tls needs both cert_file and key_file")
+	for _, file := range []string{tls.CertFile, tls.KeyFile} {
+		if file != "" {
+			_, err := os.Stat(file)
+			check(err == nil, "server.tls: %v", err)
+		}
+	}
+
+	check(c.HttpServer.DrainTimeout >= 0 && c.HttpServer.DrainTimeout <= MaxDrainTimeout, "server.drain_timeout must be between 0 and %s", MaxDrainTimeout)
+	check(c.HttpServer.ReconnectDelay >= 0, "server.reconnect_delay must not be negative")
+
+	check(c.Auth.TokenTTL > 0, "auth.token_ttl must be positive")
+
+	switch c.Storage.Driver {
+	case "memory":
+	case "bolt":
+		check(c.Storage.Path != "", "storage.path is required by the bolt driver")
+	default:
+		check(false, "storage.driver %q must be memory or bolt", c.Storage.Driver)
+	}
+
+	_, err = zapcore.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level %q must be debug, info, warn or error", c.Log.Level)
+	check(c.Log.Encoding == "json" || c.Log.Encoding == "console", "log.encoding %q must be json or console", c.Log.Encoding)
+	check(c.Log.Sampling.Initial >= 0 && c.Log.Sampling.Thereafter >= 0, "log.sampling values must not be negative")
+	check(c.Log.File.MaxSizeMB >= 0 && c.Log.File.MaxBackups >= 0 && c.Log.File.MaxAgeDays >= 0, "log.file limits must not be negative")
+
+	check(c.RateLimit.RequestsPerSecond >= 0, "rate_limit.requests_per_second must not be negative")
+	check(!c.RateLimit.Enabled() || c.RateLimit.Burst > 0, "rate_limit.burst must be positive")
+	for _, proxy := range c.RateLimit.TrustedProxies {
+		_, errCIDR := netip.ParsePrefix(proxy)
+		_, errIP := netip.ParseAddr(proxy)
+		check(errCIDR == nil || errIP == nil, "rate_limit.trusted_proxies: %q is not an IP address or CIDR", proxy)
+	}
+
+	for i, server := range c.RTC.ICEServers {
+		check(len(server.URLs) > 0, "rtc.ice_servers[%d] has no urls", i)
+		for _, url := range server.URLs {
+			scheme, _, _ := strings.Cut(url, ":")
+			switch scheme {
+			case "stun", "stuns":
+			case "turn", "turns":
+				check(server.SharedSecret != "" || (server.Username != "" && server.Credential != ""),
+					"rtc.ice_servers[%d] needs a shared_secret, or a username and credential, for %s", i, url)
+			default:
+				check(false, "rtc.ice_servers[%d] url %q must be a stun, stuns, turn or turns URL", i, url)
+			}
+		}
+	}
+
+	check(c.RTC.CredentialTTL > 0, "rtc.credential_ttl must be positive")
+	check(c.RTC.ResumeGrace >= 0, "rtc.resume_grace must not be negative")
+	check(c.RTC.PingInterval > 0, "rtc.ping_interval must be positive")
+	check(c.RTC.PingMisses > 0, "rtc.ping_misses must be positive")
+
+	cron := c.Cron
+	check(cron.RoomSweepInterval >= 0 && cron.UserSweepInterval >= 0 && cron.SubscriberSweepInterval >= 0 && cron.RoomScheduleInterval >= 0,
+		"cron intervals must not be negative, use 0 to disable a job")
+	check(cron.UserIdleTimeout > 0, "cron.user_idle_timeout must be positive")
+
+	room := c.Room
+	check(room.MaxCapacity >= MinRoomCapacity, "room.max_capacity must be at least %d", MinRoomCapacity)
+	check(room.DefaultCapacity >= MinRoomCapacity && room.DefaultCapacity <= room.MaxCapacity,
+		"room.default_capacity must be between %d and room.max_capacity", MinRoomCapacity)
+	check(room.EmptyGracePeriod >= 0, "room.empty_grace_period must not be negative")
+	check(room.ExpiryWarning >= 0, "room.expiry_warning must not be negative")
+	check(room.RingTimeout > 0, "room.ring_timeout must be positive")
+
+	tracing := c.Tracing
+	switch tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		check(tracing.Endpoint != "", "tracing.endpoint is required by the otlp exporter")
+		check(tracing.Protocol == "grpc" || tracing.Protocol == "http", "tracing.protocol %q must be grpc or http", tracing.Protocol)
+	default:
+		check(false, "tracing.exporter %q must be none, stdout or otlp", tracing.Exporter)
+	}
+	check(tracing.SampleRatio >= 0 && tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+	if c.STUN.Enabled {
+		_, port, err := net.SplitHostPort(c.STUN.Listen)
+		check(err == nil && port != "" && port != "0", "stun.listen %q must be a host:port with a fixed port", c.STUN.Listen)
+		if c.STUN.Advertise != "" {
+			_, _, err := net.SplitHostPort(c.STUN.Advertise)
+			check(err == nil, "stun.advertise %q must be a host:port", c.STUN.Advertise)
+		}
+	}
+
+	if c.SFU.Enabled {
+		sfu := c.SFU
+		check((sfu.PortMin == 0) == (sfu.PortMax == 0), "sfu.port_min and sfu.port_max must be set together")
+		check(sfu.PortMin >= 0 && sfu.PortMin <= sfu.PortMax && sfu.PortMax <= 65535, "sfu.port_min must not be above sfu.port_max, nor either outside 0-65535")
+		for _, ip := range sfu.PublicIPs {
+			check(net.ParseIP(ip) != nil, "sfu.public_ips: %q is not an IP address", ip)
+		}
+	}
+
+	check(c.Recording.Dir != "", "recording.dir is required")
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("config: invalid configuration:\n%w", err)
+	}
+	return nil
+}
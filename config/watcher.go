@@ -0,0 +1,239 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// reloadDebounce collapses the burst of events an editor produces when it
+// saves a file into one reload.
+const reloadDebounce = 500 * time.Millisecond
+
+// Watcher reloads the configuration on SIGHUP and when the config file
+// changes, and notifies the subscribers of the sections that changed. Settings
+// that are only read at startup keep their value until the next restart.
+type Watcher struct {
+	mu          sync.Mutex
+	current     Config
+	subscribers []func(previous, next Config)
+
+	args   []string
+	logger *zap.Logger
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type WatcherParams struct {
+	fx.In
+
+	Config Config
+}
+
+func NewWatcher(params WatcherParams) *Watcher {
+	return &Watcher{
+		current: params.Config,
+		args:    os.Args[1:],
+		logger:  zap.NewNop(),
+	}
+}
+
+// Subscribe calls apply with the new value of the section picked by section
+// every time a reload changes it. apply runs on the reloading goroutine.
+func Subscribe[T any](watcher *Watcher, section func(Config) T, apply func(T)) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	watcher.subscribers = append(watcher.subscribers, func(previous, next Config) {
+		if value := section(next); !reflect.DeepEqual(section(previous), value) {
+			apply(value)
+		}
+	})
+}
+
+// Current returns the configuration as of the last successful reload.
+func (watcher *Watcher) Current() Config {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	return watcher.current
+}
+
+// Reload loads and validates the configuration again. An invalid one is
+// logged and ignored.
+func (watcher *Watcher) Reload() {
+	next, err := Load(watcher.args, os.LookupEnv)
+	if err != nil {
+		watcher.logger.Error("Failed to reload configuration, keeping the current one", zap.Error(err))
+		return
+	}
+
+	watcher.mu.Lock()
+	previous := watcher.current
+	for _, name := range keepImmutable(&next, previous) {
+		watcher.logger.Warn("Setting cannot change at runtime, restart to apply it", zap.String("setting", name))
+	}
+	watcher.current = next
+	subscribers := watcher.subscribers
+	watcher.mu.Unlock()
+
+	for _, notify := range subscribers {
+		notify(previous, next)
+	}
+
+	watcher.logger.Info("Reloaded configuration", zap.Object("config", next))
+}
+
+// keepImmutable puts back the settings that are only read at startup and
+// returns the names of those the reload tried to change.
+func keepImmutable(next *Config, previous Config) []string {
+	var rejected []string
+
+	if next.Auth.generated && previous.Auth.generated {
+		next.Auth.Secret = previous.Auth.Secret
+	}
+
+	if next.HttpServer != previous.HttpServer {
+		rejected = append(rejected, "server")
+		next.HttpServer = previous.HttpServer
+	}
+	if next.Auth != previous.Auth {
+		rejected = append(rejected, "auth")
+		next.Auth = previous.Auth
+	}
+	if next.Storage != previous.Storage {
+		rejected = append(rejected, "storage")
+		next.Storage = previous.Storage
+	}
+	// Only the level of the logger can change
+	if level := next.Log.Level; withLevel(next.Log, previous.Log.Level) != previous.Log {
+		rejected = append(rejected, "log")
+		next.Log = withLevel(previous.Log, level)
+	}
+	if next.Cron != previous.Cron {
+		rejected = append(rejected, "cron")
+		next.Cron = previous.Cron
+	}
+	if next.Tracing != previous.Tracing {
+		rejected = append(rejected, "tracing")
+		next.Tracing = previous.Tracing
+	}
+	if next.STUN != previous.STUN {
+		rejected = append(rejected, "stun")
+		next.STUN = previous.STUN
+	}
+	if !reflect.DeepEqual(next.SFU, previous.SFU) {
+		rejected = append(rejected, "sfu")
+		next.SFU = previous.SFU
+	}
+	if next.Recording != previous.Recording {
+		rejected = append(rejected, "recording")
+		next.Recording = previous.Recording
+	}
+
+	return rejected
+}
+
+// Start reloads on SIGHUP and, when there is a config file, on changes to it.
+func (watcher *Watcher) Start(logger *zap.Logger) error {
+	watcher.logger = logger
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher.cancel = cancel
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	var changes <-chan fsnotify.Event
+	var errs <-chan error
+	if path := watcher.current.file; path != "" {
+		fileWatcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			cancel()
+			return err
+		}
+		// Editors often replace the file, so the directory is watched rather
+		// than the file itself.
+		if err := fileWatcher.Add(filepath.Dir(path)); err != nil {
+			cancel()
+			_ = fileWatcher.Close()
+			return err
+		}
+		changes, errs = fileWatcher.Events, fileWatcher.Errors
+
+		watcher.wg.Add(1)
+		go func() {
+			defer watcher.wg.Done()
+			<-ctx.Done()
+			_ = fileWatcher.Close()
+		}()
+	}
+
+	watcher.wg.Add(1)
+	go func() {
+		defer watcher.wg.Done()
+		defer signal.Stop(hangup)
+		watcher.loop(ctx, hangup, changes, errs)
+	}()
+
+	return nil
+}
+
+func (watcher *Watcher) loop(ctx context.Context, hangup <-chan os.Signal, changes <-chan fsnotify.Event, errs <-chan error) {
+	path := filepath.Clean(watcher.current.file)
+
+	debounce := time.NewTimer(0)
+	<-debounce.C
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			watcher.logger.Info("Received SIGHUP, reloading configuration")
+			watcher.Reload()
+		case event, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			if filepath.Clean(event.Name) == path && event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+				debounce.Reset(reloadDebounce)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			watcher.logger.Error("Config file watcher failed", zap.Error(err))
+		case <-debounce.C:
+			watcher.logger.Info("Config file changed, reloading configuration", zap.String("file", path))
+			watcher.Reload()
+		}
+	}
+}
+
+// Stop stops watching and waits for a running reload to finish.
+func (watcher *Watcher) Stop() {
+	if watcher.cancel == nil {
+		return
+	}
+	watcher.cancel()
+	watcher.wg.Wait()
+}
+
+func withLevel(log Log, level string) Log {
+	log.Level = level
+	return log
+}
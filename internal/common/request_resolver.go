@@ -1,11 +1,14 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"reflect"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -18,7 +21,9 @@ func BindRequest[T any](r *http.Request, t T) error {
 			field := v.Type().Field(i)
 			if tag, ok := field.Tag.Lookup("query"); ok {
 				if values, exists := q[tag]; exists && len(values) > 0 {
-					v.Field(i).Set(reflect.ValueOf(values[0]).Convert(field.Type))
+					if err := setQueryField(v.Field(i), values[0]); err != nil {
+						return fmt.Errorf("query %s: %w", tag, err)
+					}
 				}
 			}
 		}
@@ -35,13 +40,43 @@ func BindRequest[T any](r *http.Request, t T) error {
 	return nil
 }
 
+func setQueryField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		field.Set(reflect.ValueOf(value).Convert(field.Type()))
+	}
+
+	return nil
+}
+
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+type userIDKey struct{}
+
+// WithUserID stores the verified identity of the caller in ctx.
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
+
+// GetUserID returns the caller verified by the authentication middleware.
 func GetUserID(r *http.Request) (string, error) {
-	// temporary consider user id as client ip
-	if userId := r.Header.Get("X-User-ID"); userId != "" {
-		return userId, nil
+	if userID, ok := r.Context().Value(userIDKey{}).(string); ok && userID != "" {
+		return userID, nil
 	}
 
-	return r.RemoteAddr, nil
+	return "", ErrUnauthenticated
 }
 
 func GetParam(r *http.Request, key string) string {
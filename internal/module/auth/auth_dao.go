@@ -0,0 +1,13 @@
+package auth
+
+// Credential is the secret a user proves its identity with. It is kept apart
+// from user.User so that it never leaves this module.
+type Credential struct {
+	UserID       string `json:"user_id"`
+	PasswordHash string `json:"password_hash"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+func (credential Credential) Id() string {
+	return credential.UserID
+}
@@ -0,0 +1,18 @@
+package auth
+
+import "github.com/golang-jwt/jwt/v5"
+
+type LoginRequest struct {
+	UserID   string `json:"user_id"`
+	Password string `json:"password"`
+}
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresAt   int64  `json:"expires_at"`
+}
+
+type Claims struct {
+	jwt.RegisteredClaims
+}
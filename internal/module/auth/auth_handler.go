@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+
+	"vidcall/internal/common"
+	"vidcall/pkg/log"
+	"vidcall/pkg/repository"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+var Module = fx.Module("auth",
+	fx.Provide(
+		fx.Private,
+		func(store *repository.Store) (repository.Repository[string, Credential], error) {
+			return repository.New[string, Credential](store, "credentials")
+		},
+	),
+	fx.Provide(NewService),
+	fx.Provide(NewHandler),
+)
+
+type Handler struct {
+	service *Service
+	logger  *zap.Logger
+}
+
+type HandlerParams struct {
+	fx.In
+
+	Logger  *zap.Logger
+	Service *Service
+}
+
+func NewHandler(params HandlerParams) *Handler {
+	return &Handler{
+		service: params.Service,
+		logger:  params.Logger,
+	}
+}
+
+func (handler *Handler) Register(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := common.BindRequest(r, &req); err != nil || req.UserID == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	usr, err := handler.service.Register(r.Context(), req.UserID, req.Password)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrWeakPassword):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrUserExists):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			log.Ctx(r.Context(), handler.logger).Error("Register failed", zap.String("userID", req.UserID), zap.Error(err))
+			http.Error(w, "Failed to register", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := common.WriteResponse(w, http.StatusCreated, usr); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (handler *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := common.BindRequest(r, &req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	token, err := handler.service.Login(r.Context(), req.UserID, req.Password)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		log.Ctx(r.Context(), handler.logger).Error("Login failed", zap.String("userID", req.UserID), zap.Error(err))
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	if err := common.WriteResponse(w, http.StatusOK, token); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		return
+	}
+}
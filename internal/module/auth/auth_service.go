@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"vidcall/config"
+	"vidcall/internal/module/user"
+	"vidcall/pkg/password"
+	"vidcall/pkg/repository"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/fx"
+)
+
+const (
+	tokenIssuer       = "vidcall"
+	minPasswordLength = 8
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid user ID or password")
+	ErrUserExists         = errors.New("user already registered")
+	ErrWeakPassword       = fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	ErrInvalidToken       = errors.New("invalid access token")
+)
+
+type Service struct {
+	// mu makes checking that a user ID is free and taking it one step
+	mu          sync.Mutex
+	repo        repository.Repository[string, Credential]
+	userService *user.Service
+	secret      []byte
+	tokenTTL    time.Duration
+}
+
+type ServiceParams struct {
+	fx.In
+
+	Config      config.Config
+	Repository  repository.Repository[string, Credential]
+	UserService *user.Service
+}
+
+func NewService(params ServiceParams) *Service {
+	return &Service{
+		repo:        params.Repository,
+		userService: params.UserService,
+		secret:      []byte(params.Config.Auth.Secret),
+		tokenTTL:    params.Config.Auth.TokenTTL,
+	}
+}
+
+// Register creates the credential and the user it belongs to.
+func (service *Service) Register(ctx context.Context, userID, pass string) (user.User, error) {
+	if len(pass) < minPasswordLength {
+		return user.User{}, ErrWeakPassword
+	}
+
+	hash, err := password.Hash(pass)
+	if err != nil {
+		return user.User{}, fmt.Errorf("hash password: %w", err)
+	}
+
+	if err := service.insertCredential(ctx, Credential{
+		UserID:       userID,
+		PasswordHash: hash,
+		CreatedAt:    time.Now().Unix(),
+	}); err != nil {
+		return user.User{}, err
+	}
+
+	created, err := service.userService.CreateUser(ctx, user.User{ID: userID})
+	if err != nil {
+		// Without its user the credential would block the user ID for good
+		if deleteErr := service.repo.Delete(ctx, userID); deleteErr != nil {
+			return user.User{}, errors.Join(err, fmt.Errorf("delete credential: %w", deleteErr))
+		}
+		return user.User{}, err
+	}
+
+	return created, nil
+}
+
+// insertCredential inserts credential unless its user ID is taken, since
+// Insert would overwrite the password of the registered user.
+func (service *Service) insertCredential(ctx context.Context, credential Credential) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if _, err := service.repo.Find(ctx, credential.UserID); err == nil {
+		return ErrUserExists
+	} else if !errors.Is(err, repository.ErrNotFound) {
+		return err
+	}
+
+	_, err := service.repo.Insert(ctx, credential)
+	return err
+}
+
+// Login checks the password and issues an access token.
+func (service *Service) Login(ctx context.Context, userID, pass string) (TokenResponse, error) {
+	credential, err := service.repo.Find(ctx, userID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return TokenResponse{}, ErrInvalidCredentials
+		}
+		return TokenResponse{}, err
+	}
+
+	if !password.Verify(credential.PasswordHash, pass) {
+		return TokenResponse{}, ErrInvalidCredentials
+	}
+
+	return service.IssueToken(userID)
+}
+
+// IssueToken signs an HS256 JWT for the user.
+func (service *Service) IssueToken(userID string) (TokenResponse, error) {
+	now := time.Now()
+	expiresAt := now.Add(service.tokenTTL)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+
+	signed, err := token.SignedString(service.secret)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	return TokenResponse{
+		AccessToken: signed,
+		TokenType:   "Bearer",
+		ExpiresAt:   expiresAt.Unix(),
+	}, nil
+}
+
+// VerifyToken checks signature and expiry offline and returns the user ID.
+func (service *Service) VerifyToken(raw string) (string, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(*jwt.Token) (any, error) {
+		return service.secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if claims.Subject == "" {
+		return "", fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+
+	return claims.Subject, nil
+}
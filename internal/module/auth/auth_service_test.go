@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"vidcall/config"
+	"vidcall/internal/module/metrics"
+	"vidcall/internal/module/user"
+	"vidcall/pkg/repository"
+)
+
+// failingUsers is a user repository whose inserts fail.
+type failingUsers struct {
+	repository.Repository[string, user.User]
+}
+
+func (failingUsers) Insert(context.Context, user.User) (user.User, error) {
+	return user.User{}, errors.New("store down")
+}
+
+func newTestService(users repository.Repository[string, user.User]) *Service {
+	cfg := config.Default()
+	cfg.Auth.Secret = "secret"
+	return NewService(ServiceParams{
+		Config:      cfg,
+		Repository:  repository.NewSyncRepository[string, Credential](),
+		UserService: user.NewService(user.ServiceParams{Metrics: metrics.Nop{}, Repository: users}),
+	})
+}
+
+func TestRegisterConcurrently(t *testing.T) {
+	ctx := context.Background()
+	service := newTestService(repository.NewSyncRepository[string, user.User]())
+
+	passwords := []string{"password-1", "password-2", "password-3", "password-4"}
+	errs := make([]error, len(passwords))
+	var wg sync.WaitGroup
+	for i, pass := range passwords {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = service.Register(ctx, "alice", pass)
+		}()
+	}
+	wg.Wait()
+
+	registered := -1
+	for i, err := range errs {
+		switch {
+		case err == nil && registered < 0:
+			registered = i
+		case err == nil:
+			t.Fatalf("alice registered twice")
+		case !errors.Is(err, ErrUserExists):
+			t.Fatalf("register: %v", err)
+		}
+	}
+	if registered < 0 {
+		t.Fatal("alice not registered")
+	}
+
+	for i, pass := range passwords {
+		_, err := service.Login(ctx, "alice", pass)
+		if (err == nil) != (i == registered) {
+			t.Errorf("login with password %d of %d: %v", i, registered, err)
+		}
+	}
+}
+
+func TestRegisterUserFailure(t *testing.T) {
+	ctx := context.Background()
+	service := newTestService(failingUsers{})
+
+	if _, err := service.Register(ctx, "alice", "password"); err == nil {
+		t.Fatal("registered without a user")
+	}
+	if _, err := service.repo.Find(ctx, "alice"); !errors.Is(err, repository.ErrNotFound) {
+		t.Fatalf("credential left behind: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package call
+
+// State is the lifecycle of a direct call:
+//
+//	ringing --accept--> accepted
+//	ringing --decline--> declined
+//	ringing --cancel by the caller--> canceled
+//	ringing --ring timeout, callee unreachable or server restarted--> missed
+type State string
+
+const (
+	StateRinging  State = "ringing"
+	StateAccepted State = "accepted"
+	StateDeclined State = "declined"
+	StateCanceled State = "canceled"
+	StateMissed   State = "missed"
+)
+
+// Call is a direct call from one user to another, held in a two-person room
+// of its own.
+type Call struct {
+	ID         string `json:"id"`
+	RoomID     string `json:"room_id"`
+	CallerID   string `json:"caller_id"`
+	CalleeID   string `json:"callee_id"`
+	State      State  `json:"state"`
+	CreatedAt  int64  `json:"created_at"`  // unix seconds
+	AnsweredAt *int64 `json:"answered_at"` // unix seconds, once it stopped ringing
+}
+
+func (call Call) Id() string {
+	return call.ID
+}
+
+// HasUser reports whether the user is the caller or the callee.
+func (call Call) HasUser(userID string) bool {
+	return call.CallerID == userID || call.CalleeID == userID
+}
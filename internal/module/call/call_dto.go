@@ -0,0 +1,21 @@
+package call
+
+// Events pushed to the presence streams of the caller and the callee, with
+// the Call as data.
+const (
+	EventIncomingCall = "incoming_call" // to the callee
+	EventCallAccepted = "call_accepted" // to the caller, who joins the room of the call
+	EventCallDeclined = "call_declined" // to the caller
+	EventCallCanceled = "call_canceled" // to the callee
+	EventMissedCall   = "missed_call"   // to both
+)
+
+type CreateCallRequest struct {
+	CalleeID string `json:"callee_id"`
+}
+
+type ListCallRequest struct {
+	State  State  `query:"state"` // e.g. missed, every state when empty
+	Limit  int    `query:"limit"`
+	Cursor string `query:"cursor"`
+}
@@ -0,0 +1,177 @@
+package call
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"vidcall/internal/common"
+	"vidcall/internal/module/room"
+	"vidcall/pkg/log"
+	"vidcall/pkg/repository"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+var Module = fx.Module("call",
+	fx.Provide(
+		fx.Private,
+		func(store *repository.Store) (repository.Repository[string, Call], error) {
+			return repository.New[string, Call](store, "calls")
+		},
+	),
+	fx.Provide(NewService),
+	fx.Provide(NewHandler),
+	fx.Invoke(func(lc fx.Lifecycle, service *Service) {
+		lc.Append(fx.Hook{OnStart: service.ResetCalls, OnStop: service.StopRinging})
+	}),
+)
+
+type Handler struct {
+	service *Service
+	logger  *zap.Logger
+}
+
+type HandlerParams struct {
+	fx.In
+
+	Logger  *zap.Logger
+	Service *Service
+}
+
+func NewHandler(params HandlerParams) *Handler {
+	return &Handler{
+		service: params.Service,
+		logger:  params.Logger,
+	}
+}
+
+// CreateCall rings the callee. The caller joins the room of the call right
+// away and waits there for it to be accepted.
+func (handler *Handler) CreateCall(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateCallRequest
+	if err := common.BindRequest(r, &req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	call, err := handler.service.StartCall(r.Context(), userID, req.CalleeID)
+	if err != nil {
+		if !handler.writeError(w, err) {
+			log.Ctx(r.Context(), handler.logger).Error("Start call failed", zap.Error(err))
+			http.Error(w, "Failed to start call", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := common.WriteResponse(w, http.StatusCreated, call); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (handler *Handler) GetCall(w http.ResponseWriter, r *http.Request) {
+	handler.callAction(w, r, "get", handler.service.GetCall)
+}
+
+func (handler *Handler) AcceptCall(w http.ResponseWriter, r *http.Request) {
+	handler.callAction(w, r, "accept", handler.service.AcceptCall)
+}
+
+func (handler *Handler) DeclineCall(w http.ResponseWriter, r *http.Request) {
+	handler.callAction(w, r, "decline", handler.service.DeclineCall)
+}
+
+func (handler *Handler) CancelCall(w http.ResponseWriter, r *http.Request) {
+	handler.callAction(w, r, "cancel", handler.service.CancelCall)
+}
+
+// ListCalls lists the calls of the caller, e.g. the missed ones with
+// ?state=missed.
+func (handler *Handler) ListCalls(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req ListCallRequest
+	if err := common.BindRequest(r, &req); err != nil {
+		http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	calls, err := handler.service.ListCalls(r.Context(), userID, req)
+	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Ctx(r.Context(), handler.logger).Error("List calls failed", zap.Error(err))
+		http.Error(w, "Failed to list calls", http.StatusInternalServerError)
+		return
+	}
+
+	if err := common.WriteResponse(w, http.StatusOK, calls); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// callAction serves the requests on a single call of the caller.
+func (handler *Handler) callAction(w http.ResponseWriter, r *http.Request, action string, do func(ctx context.Context, callID, userID string) (Call, error)) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	callID := common.GetParam(r, "callID")
+	if callID == "" {
+		http.Error(w, "Missing call ID", http.StatusBadRequest)
+		return
+	}
+
+	call, err := do(r.Context(), callID, userID)
+	if err != nil {
+		if !handler.writeError(w, err) {
+			log.Ctx(r.Context(), handler.logger).Error("Call "+action+" failed", zap.String("callID", callID), zap.Error(err))
+			http.Error(w, "Failed to "+action+" call", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := common.WriteResponse(w, http.StatusOK, call); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// writeError answers the errors a client can cause and reports whether err
+// was one of them.
+func (handler *Handler) writeError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, room.ErrForbidden), errors.Is(err, ErrNotAnswerer):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrInvalidCallee):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNotRinging):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, room.ErrShuttingDown):
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,315 @@
+package call
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"vidcall/config"
+	"vidcall/internal/module/room"
+	"vidcall/internal/module/user"
+	"vidcall/pkg/log"
+	"vidcall/pkg/repository"
+
+	"github.com/oklog/ulid/v2"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrInvalidCallee = errors.New("callee must be another user")
+	ErrNotRinging    = errors.New("call is not ringing")
+	ErrNotAnswerer   = errors.New("only the callee may answer a call and the caller cancel it")
+)
+
+// joinWindow is how long the room of a call waits for its first participant
+// once the call stopped ringing. Like any empty room, it then expires.
+const joinWindow = time.Minute
+
+type Service struct {
+	// mu serialises the answers to calls with their ring timeouts
+	mu     sync.Mutex
+	repo   repository.Repository[string, Call]
+	rooms  *room.Service
+	users  *user.Service
+	logger *zap.Logger
+
+	// ringTimeout is from the room section of the config
+	ringTimeout atomic.Int64
+	// ringing are the ring timers of the calls in progress, keyed by call ID
+	ringing map[string]*time.Timer
+}
+
+type ServiceParams struct {
+	fx.In
+
+	Config     config.Config
+	Watcher    *config.Watcher
+	Logger     *zap.Logger
+	Rooms      *room.Service
+	Users      *user.Service
+	Repository repository.Repository[string, Call]
+}
+
+func NewService(params ServiceParams) *Service {
+	service := &Service{
+		repo:    params.Repository,
+		rooms:   params.Rooms,
+		users:   params.Users,
+		logger:  params.Logger,
+		ringing: make(map[string]*time.Timer),
+	}
+
+	service.ringTimeout.Store(int64(params.Config.Room.RingTimeout))
+	config.Subscribe(params.Watcher, func(c config.Config) time.Duration { return c.Room.RingTimeout }, func(timeout time.Duration) {
+		service.ringTimeout.Store(int64(timeout))
+	})
+
+	return service
+}
+
+// StartCall rings calleeID on behalf of callerID, in a new private room for
+// the two of them. A callee without a presence stream misses the call right
+// away.
+func (service *Service) StartCall(ctx context.Context, callerID, calleeID string) (Call, error) {
+	if calleeID == "" || calleeID == callerID {
+		return Call{}, ErrInvalidCallee
+	}
+	if _, err := service.users.GetUser(ctx, calleeID); err != nil {
+		return Call{}, err
+	}
+
+	ringTimeout := time.Duration(service.ringTimeout.Load())
+	now := time.Now()
+	expiredAt := now.Add(ringTimeout + joinWindow).Unix()
+	callRoom, err := service.rooms.CreateRoom(ctx, room.Room{
+		ID:         ulid.Make().String(),
+		Name:       fmt.Sprintf("Call from %s", callerID),
+		Capacity:   config.MinRoomCapacity,
+		Visibility: room.VisibilityPrivate,
+		Invited:    []string{calleeID},
+		CreatedBy:  callerID,
+		ExpiredAt:  &expiredAt,
+	}, "")
+	if err != nil {
+		return Call{}, fmt.Errorf("create call room: %w", err)
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	call, err := service.repo.Insert(ctx, Call{
+		ID:        ulid.Make().String(),
+		RoomID:    callRoom.ID,
+		CallerID:  callerID,
+		CalleeID:  calleeID,
+		State:     StateRinging,
+		CreatedAt: now.Unix(),
+	})
+	if err != nil {
+		service.deleteRoom(ctx, callRoom.ID, callerID)
+		return Call{}, err
+	}
+
+	logger := log.Ctx(ctx, service.logger).With(zap.String("callID", call.ID), log.RoomID(call.RoomID))
+	if !service.users.Notify(calleeID, user.Notification{Event: EventIncomingCall, Data: call}) {
+		logger.Info("Callee is unreachable")
+		missed, err := service.end(ctx, call, StateMissed)
+		if err != nil {
+			service.deleteRoom(ctx, callRoom.ID, callerID)
+			return Call{}, err
+		}
+		return missed, nil
+	}
+
+	service.ringing[call.ID] = time.AfterFunc(ringTimeout, func() { service.timeout(call.ID) })
+	logger.Info("Call ringing", zap.String("calleeID", calleeID))
+	return call, nil
+}
+
+// AcceptCall answers a ringing call of its callee, who joins its room next.
+func (service *Service) AcceptCall(ctx context.Context, callID, userID string) (Call, error) {
+	return service.answer(ctx, callID, userID, StateAccepted)
+}
+
+func (service *Service) DeclineCall(ctx context.Context, callID, userID string) (Call, error) {
+	return service.answer(ctx, callID, userID, StateDeclined)
+}
+
+// CancelCall hangs up a ringing call of its caller.
+func (service *Service) CancelCall(ctx context.Context, callID, userID string) (Call, error) {
+	return service.answer(ctx, callID, userID, StateCanceled)
+}
+
+// GetCall returns a call of userID, as its caller or callee.
+func (service *Service) GetCall(ctx context.Context, callID, userID string) (Call, error) {
+	return service.find(ctx, callID, userID)
+}
+
+// ListCalls returns one page of the calls of userID, newest first.
+func (service *Service) ListCalls(ctx context.Context, userID string, req ListCallRequest) (repository.Page[Call], error) {
+	query := repository.Query[Call]{
+		Where: []repository.Predicate[Call]{
+			func(call Call) bool { return call.HasUser(userID) },
+		},
+		Sort: []repository.SortKey[Call]{{
+			Name:    "created_at",
+			Compare: func(a, b Call) int { return cmp.Compare(a.CreatedAt, b.CreatedAt) },
+			Desc:    true,
+		}},
+		Cursor: req.Cursor,
+		Limit:  repository.PageSize(req.Limit),
+	}
+	if req.State != "" {
+		query.Where = append(query.Where, func(call Call) bool { return call.State == req.State })
+	}
+
+	return service.repo.FindPage(ctx, query)
+}
+
+// ResetCalls misses the calls a durable store still has ringing: their
+// timers did not survive the restart.
+func (service *Service) ResetCalls(ctx context.Context) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	calls, err := service.repo.FindList(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, call := range calls {
+		if call.State != StateRinging {
+			continue
+		}
+		if _, err := service.end(ctx, call, StateMissed); err != nil {
+			return fmt.Errorf("reset call %s: %w", call.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// StopRinging stops the ring timers, when the server shuts down.
+func (service *Service) StopRinging(context.Context) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	for callID, timer := range service.ringing {
+		timer.Stop()
+		delete(service.ringing, callID)
+	}
+	return nil
+}
+
+// answer stops a ringing call in state on behalf of userID: the callee
+// accepts or declines it, the caller cancels it.
+func (service *Service) answer(ctx context.Context, callID, userID string, state State) (Call, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	call, err := service.find(ctx, callID, userID)
+	if err != nil {
+		return Call{}, err
+	}
+
+	answerer := call.CalleeID
+	if state == StateCanceled {
+		answerer = call.CallerID
+	}
+	if userID != answerer {
+		return Call{}, ErrNotAnswerer
+	}
+	if call.State != StateRinging {
+		return Call{}, ErrNotRinging
+	}
+
+	return service.end(ctx, call, state)
+}
+
+// timeout misses a call still ringing after the ring timeout.
+func (service *Service) timeout(callID string) {
+	ctx := log.WithFields(context.Background(), zap.String("callID", callID))
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	// The call was answered in the meantime
+	if _, ok := service.ringing[callID]; !ok {
+		return
+	}
+
+	call, err := service.repo.Find(ctx, callID)
+	if err == nil {
+		_, err = service.end(ctx, call, StateMissed)
+	}
+	if err != nil {
+		delete(service.ringing, callID)
+		log.Ctx(ctx, service.logger).Error("Miss call failed", zap.Error(err))
+	}
+}
+
+// end stops a ringing call in state and tells the other side. The room of a
+// call that was not accepted is deleted. Callers hold mu.
+func (service *Service) end(ctx context.Context, call Call, state State) (Call, error) {
+	if timer, ok := service.ringing[call.ID]; ok {
+		timer.Stop()
+		delete(service.ringing, call.ID)
+	}
+
+	answeredAt := time.Now().Unix()
+	call.State = state
+	call.AnsweredAt = &answeredAt
+	call, err := service.repo.Update(ctx, call)
+	if err != nil {
+		return Call{}, err
+	}
+
+	logger := log.Ctx(ctx, service.logger).With(zap.String("callID", call.ID), log.RoomID(call.RoomID))
+	if state != StateAccepted {
+		service.deleteRoom(ctx, call.RoomID, call.CallerID)
+	}
+
+	switch state {
+	case StateAccepted:
+		service.notify(call.CallerID, EventCallAccepted, call)
+	case StateDeclined:
+		service.notify(call.CallerID, EventCallDeclined, call)
+	case StateCanceled:
+		service.notify(call.CalleeID, EventCallCanceled, call)
+	case StateMissed:
+		service.notify(call.CalleeID, EventMissedCall, call)
+		service.notify(call.CallerID, EventMissedCall, call)
+	}
+
+	logger.Info("Call stopped ringing", zap.String("state", string(state)))
+	return call, nil
+}
+
+// deleteRoom deletes the room of a call that will not take place.
+func (service *Service) deleteRoom(ctx context.Context, roomID, callerID string) {
+	err := service.rooms.DeleteRoom(ctx, roomID, callerID)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		log.Ctx(ctx, service.logger).Warn("Delete call room failed", log.RoomID(roomID), zap.Error(err))
+	}
+}
+
+func (service *Service) notify(userID, event string, call Call) {
+	service.users.Notify(userID, user.Notification{Event: event, Data: call})
+}
+
+// find returns a call of userID. The calls of others are not found.
+func (service *Service) find(ctx context.Context, callID, userID string) (Call, error) {
+	call, err := service.repo.Find(ctx, callID)
+	if err != nil {
+		return Call{}, err
+	}
+	if !call.HasUser(userID) {
+		return Call{}, repository.ErrNotFound
+	}
+	return call, nil
+}
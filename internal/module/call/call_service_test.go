@@ -0,0 +1,88 @@
+package call
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"vidcall/config"
+	"vidcall/internal/module/metrics"
+	"vidcall/internal/module/room"
+	"vidcall/internal/module/user"
+	"vidcall/pkg/repository"
+
+	"go.uber.org/zap"
+)
+
+// failingCalls is a call repository whose inserts or updates fail.
+type failingCalls struct {
+	repository.Repository[string, Call]
+	insert, update bool
+}
+
+func (calls failingCalls) Insert(ctx context.Context, call Call) (Call, error) {
+	if calls.insert {
+		return Call{}, errors.New("store down")
+	}
+	return calls.Repository.Insert(ctx, call)
+}
+
+func (calls failingCalls) Update(ctx context.Context, call Call) (Call, error) {
+	if calls.update {
+		return Call{}, errors.New("store down")
+	}
+	return calls.Repository.Update(ctx, call)
+}
+
+func TestStartCallFailureDeletesRoom(t *testing.T) {
+	tests := []struct {
+		name  string
+		calls failingCalls
+	}{
+		{name: "call not stored", calls: failingCalls{insert: true}},
+		// bob has no presence stream, so the call is missed right away
+		{name: "missed call not stored", calls: failingCalls{update: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := config.Default()
+
+			roomRepo := repository.NewSyncRepository[string, room.Room]()
+			rooms := room.NewService(room.ServiceParams{
+				Config:     cfg,
+				Watcher:    &config.Watcher{},
+				Logger:     zap.NewNop(),
+				Metrics:    metrics.Nop{},
+				Store:      &repository.Store{},
+				Repository: roomRepo,
+			})
+			users := user.NewService(user.ServiceParams{Metrics: metrics.Nop{}, Repository: repository.NewSyncRepository[string, user.User]()})
+			if _, err := users.CreateUser(ctx, user.User{ID: "bob"}); err != nil {
+				t.Fatal(err)
+			}
+
+			test.calls.Repository = repository.NewSyncRepository[string, Call]()
+			service := NewService(ServiceParams{
+				Config:     cfg,
+				Watcher:    &config.Watcher{},
+				Logger:     zap.NewNop(),
+				Rooms:      rooms,
+				Users:      users,
+				Repository: test.calls,
+			})
+
+			if _, err := service.StartCall(ctx, "alice", "bob"); err == nil {
+				t.Fatal("call started")
+			}
+			left, err := roomRepo.FindList(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left) != 0 {
+				t.Errorf("%d call rooms left behind", len(left))
+			}
+		})
+	}
+}
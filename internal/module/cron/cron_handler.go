@@ -0,0 +1,32 @@
+package cron
+
+import (
+	"net/http"
+
+	"vidcall/internal/common"
+
+	"go.uber.org/fx"
+)
+
+type Handler struct {
+	worker *Worker
+}
+
+type HandlerParams struct {
+	fx.In
+
+	Worker *Worker
+}
+
+func NewHandler(params HandlerParams) *Handler {
+	return &Handler{
+		worker: params.Worker,
+	}
+}
+
+func (handler *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
+	if err := common.WriteResponse(w, http.StatusOK, handler.worker.Stats()); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		return
+	}
+}
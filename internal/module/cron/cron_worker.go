@@ -1 +1,197 @@
 package cron
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	"vidcall/config"
+	"vidcall/internal/module/room"
+	"vidcall/internal/module/user"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+var Module = fx.Module("cron",
+	fx.Provide(NewWorker),
+	fx.Provide(NewHandler),
+	fx.Invoke(func(*Worker) {}),
+)
+
+// Job is a periodic task. Run returns how many items it reaped.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) (int, error)
+}
+
+// JobStats is what the worker keeps about each job.
+type JobStats struct {
+	Runs         int64         `json:"runs"`
+	Failures     int64         `json:"failures"`
+	Reaped       int64         `json:"reaped"`
+	LastRunAt    time.Time     `json:"last_run_at,omitzero"`
+	LastDuration time.Duration `json:"last_duration"`
+	LastError    string        `json:"last_error,omitempty"`
+}
+
+type Worker struct {
+	jobs   []Job
+	logger *zap.Logger
+
+	mu    sync.Mutex
+	stats map[string]JobStats
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type WorkerParams struct {
+	fx.In
+
+	Lifecycle   fx.Lifecycle
+	Config      config.Config
+	Logger      *zap.Logger
+	RoomService *room.Service
+	UserService *user.Service
+}
+
+func NewWorker(params WorkerParams) *Worker {
+	cron := params.Config.Cron
+	worker := &Worker{
+		jobs: []Job{
+			{
+				Name:     "sweep_expired_rooms",
+				Interval: cron.RoomSweepInterval,
+				Run:      params.RoomService.SweepExpired,
+			},
+			{
+				Name:     "mark_inactive_users",
+				Interval: cron.UserSweepInterval,
+				Run: func(ctx context.Context) (int, error) {
+					return params.UserService.MarkInactive(ctx, cron.UserIdleTimeout)
+				},
+			},
+			{
+				Name:     "warn_expiring_rooms",
+				Interval: cron.RoomScheduleInterval,
+				Run:      params.RoomService.WarnExpiring,
+			},
+			{
+				Name:     "end_overdue_rooms",
+				Interval: cron.RoomScheduleInterval,
+				Run:      params.RoomService.EndOverdue,
+			},
+			{
+				Name:     "close_orphan_subscribers",
+				Interval: cron.SubscriberSweepInterval,
+				Run:      params.RoomService.CloseOrphanSubscribers,
+			},
+		},
+		logger: params.Logger,
+		stats:  make(map[string]JobStats),
+	}
+
+	params.Lifecycle.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			worker.Start()
+			return nil
+		},
+		OnStop: worker.Stop,
+	})
+
+	return worker
+}
+
+// Start runs every job with a positive interval on its own ticker.
+func (worker *Worker) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	worker.cancel = cancel
+
+	for _, job := range worker.jobs {
+		if job.Interval <= 0 {
+			worker.logger.Info("Cron job disabled", zap.String("job", job.Name))
+			continue
+		}
+
+		worker.wg.Add(1)
+		go worker.loop(ctx, job)
+	}
+}
+
+// Stop cancels the jobs and waits for the running ones to return, or for ctx
+// to be done.
+func (worker *Worker) Stop(ctx context.Context) error {
+	if worker.cancel == nil {
+		return nil
+	}
+	worker.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		worker.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns a snapshot of every job's counters, keyed by job name.
+func (worker *Worker) Stats() map[string]JobStats {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	return maps.Clone(worker.stats)
+}
+
+func (worker *Worker) loop(ctx context.Context, job Job) {
+	defer worker.wg.Done()
+
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			worker.run(ctx, job)
+		}
+	}
+}
+
+func (worker *Worker) run(ctx context.Context, job Job) {
+	startedAt := time.Now()
+	reaped, err := job.Run(ctx)
+	duration := time.Since(startedAt)
+
+	worker.mu.Lock()
+	stats := worker.stats[job.Name]
+	stats.Runs++
+	stats.Reaped += int64(reaped)
+	stats.LastRunAt = startedAt
+	stats.LastDuration = duration
+	stats.LastError = ""
+	if err != nil {
+		stats.Failures++
+		stats.LastError = err.Error()
+	}
+	worker.stats[job.Name] = stats
+	worker.mu.Unlock()
+
+	if err != nil {
+		worker.logger.Error("Cron job failed", zap.String("job", job.Name), zap.Int("reaped", reaped), zap.Duration("duration", duration), zap.Error(err))
+		return
+	}
+
+	if reaped > 0 {
+		worker.logger.Info("Cron job reaped items", zap.String("job", job.Name), zap.Int("reaped", reaped), zap.Int64("total_reaped", stats.Reaped), zap.Duration("duration", duration))
+	}
+}
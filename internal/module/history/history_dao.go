@@ -0,0 +1,34 @@
+package history
+
+// EndReason is why a participant left a call.
+type EndReason string
+
+const (
+	EndReasonHangup         EndReason = "hangup"
+	EndReasonTimeout        EndReason = "timeout" // stopped answering pings or was not resumed in time
+	EndReasonRoomDeleted    EndReason = "room_deleted"
+	EndReasonRoomEnded      EndReason = "room_ended"
+	EndReasonServerShutdown EndReason = "server_shutdown"
+	EndReasonError          EndReason = "error" // the server failed the session
+)
+
+// Record is the call detail record of one session of a user in a room. It
+// is open, with no LeftAt, while the user is in the call.
+type Record struct {
+	ID              string    `json:"id"`
+	RoomID          string    `json:"room_id"`
+	UserID          string    `json:"user_id"`
+	JoinedAt        int64     `json:"joined_at"` // unix seconds
+	LeftAt          *int64    `json:"left_at"`   // unix seconds
+	Duration        int64     `json:"duration"`  // seconds, once left
+	EndReason       EndReason `json:"end_reason,omitempty"`
+	SignalingErrors int       `json:"signaling_errors"` // messages of the user the server rejected
+}
+
+func (record Record) Id() string {
+	return record.ID
+}
+
+func (record Record) IsOpen() bool {
+	return record.LeftAt == nil
+}
@@ -0,0 +1,18 @@
+package history
+
+// Formats an export of records is written in.
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+type ListRecordRequest struct {
+	Limit  int    `query:"limit"`
+	Cursor string `query:"cursor"`
+	// Format exports every record in one of the formats instead of a page
+	Format string `query:"format"`
+}
+
+func (req ListRecordRequest) IsExport() bool {
+	return req.Format != ""
+}
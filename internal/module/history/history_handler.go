@@ -0,0 +1,183 @@
+package history
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"vidcall/internal/common"
+	"vidcall/internal/module/room"
+	"vidcall/pkg/log"
+	"vidcall/pkg/repository"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+var Module = fx.Module("history",
+	fx.Provide(
+		fx.Private,
+		func(store *repository.Store) (repository.Repository[string, Record], error) {
+			return repository.New[string, Record](store, "call_records")
+		},
+	),
+	fx.Provide(NewService),
+	fx.Provide(NewHandler),
+	fx.Invoke(func(lc fx.Lifecycle, service *Service) {
+		lc.Append(fx.Hook{OnStart: service.ResetRecords})
+	}),
+)
+
+// csvHeader names the columns of a csv export, one record per row.
+var csvHeader = []string{"id", "room_id", "user_id", "joined_at", "left_at", "duration", "end_reason", "signaling_errors"}
+
+type Handler struct {
+	service *Service
+	logger  *zap.Logger
+}
+
+type HandlerParams struct {
+	fx.In
+
+	Logger  *zap.Logger
+	Service *Service
+}
+
+func NewHandler(params HandlerParams) *Handler {
+	return &Handler{
+		service: params.Service,
+		logger:  params.Logger,
+	}
+}
+
+// ListUserCalls lists the calls of a user, or exports them with ?format=.
+func (handler *Handler) ListUserCalls(w http.ResponseWriter, r *http.Request) {
+	userID := common.GetParam(r, "userID")
+	if userID == "" {
+		http.Error(w, "Missing user ID", http.StatusBadRequest)
+		return
+	}
+
+	handler.listRecords(w, r, "calls-"+userID, func(ctx context.Context, viewerID string, req ListRecordRequest) (repository.Page[Record], error) {
+		return handler.service.UserCalls(ctx, userID, viewerID, req)
+	})
+}
+
+// ListRoomHistory lists the calls made in a room, or exports them with
+// ?format=.
+func (handler *Handler) ListRoomHistory(w http.ResponseWriter, r *http.Request) {
+	roomID := common.GetParam(r, "roomID")
+	if roomID == "" {
+		http.Error(w, "Missing room ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx := log.WithFields(r.Context(), log.RoomID(roomID))
+	handler.listRecords(w, r.WithContext(ctx), "history-"+roomID, func(ctx context.Context, viewerID string, req ListRecordRequest) (repository.Page[Record], error) {
+		return handler.service.RoomHistory(ctx, roomID, viewerID, req)
+	})
+}
+
+// listRecords writes the records list finds, as a page or as an export
+// downloaded under name.
+func (handler *Handler) listRecords(w http.ResponseWriter, r *http.Request, name string, list func(ctx context.Context, viewerID string, req ListRecordRequest) (repository.Page[Record], error)) {
+	viewerID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req ListRecordRequest
+	if err := common.BindRequest(r, &req); err != nil {
+		http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	records, err := list(r.Context(), viewerID, req)
+	if err != nil {
+		if !handler.writeError(w, err) {
+			log.Ctx(r.Context(), handler.logger).Error("List call records failed", zap.Error(err))
+			http.Error(w, "Failed to list call records", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !req.IsExport() {
+		if err := common.WriteResponse(w, http.StatusOK, records); err != nil {
+			http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+req.Format))
+	if req.Format == FormatJSON {
+		if err := common.WriteResponse(w, http.StatusOK, records.Items); err != nil {
+			http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	if err := writeCSV(w, records.Items); err != nil {
+		// The export is already partly sent, it can only be cut short
+		log.Ctx(r.Context(), handler.logger).Warn("Write csv export failed", zap.Error(err))
+	}
+}
+
+// writeCSV writes records under csvHeader. Times are RFC 3339 in UTC, which
+// spreadsheets read.
+func writeCSV(w io.Writer, records []Record) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		var leftAt string
+		if record.LeftAt != nil {
+			leftAt = formatUnix(*record.LeftAt)
+		}
+
+		err := out.Write([]string{
+			record.ID,
+			record.RoomID,
+			record.UserID,
+			formatUnix(record.JoinedAt),
+			leftAt,
+			strconv.FormatInt(record.Duration, 10),
+			string(record.EndReason),
+			strconv.Itoa(record.SignalingErrors),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+func formatUnix(seconds int64) string {
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+}
+
+// writeError answers the errors a client can cause and reports whether err
+// was one of them.
+func (handler *Handler) writeError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, room.ErrForbidden), errors.Is(err, ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, repository.ErrInvalidCursor), errors.Is(err, ErrInvalidFormat):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package history
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"vidcall/internal/module/room"
+	"vidcall/pkg/log"
+	"vidcall/pkg/repository"
+
+	"github.com/oklog/ulid/v2"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrForbidden     = errors.New("users may only see their own calls")
+	ErrInvalidFormat = errors.New("format must be json or csv")
+)
+
+type Service struct {
+	repo   repository.Repository[string, Record]
+	rooms  *room.Service
+	logger *zap.Logger
+}
+
+type ServiceParams struct {
+	fx.In
+
+	Logger     *zap.Logger
+	Rooms      *room.Service
+	Repository repository.Repository[string, Record]
+}
+
+func NewService(params ServiceParams) *Service {
+	return &Service{
+		repo:   params.Repository,
+		rooms:  params.Rooms,
+		logger: params.Logger,
+	}
+}
+
+// Open starts the record of userID joining the room, for Close to end.
+func (service *Service) Open(ctx context.Context, roomID, userID string) (Record, error) {
+	return service.repo.Insert(ctx, Record{
+		ID:       ulid.Make().String(),
+		RoomID:   roomID,
+		UserID:   userID,
+		JoinedAt: time.Now().Unix(),
+	})
+}
+
+// Close ends an open record as its user leaves the call for reason, having
+// sent signalingErrors rejected messages.
+func (service *Service) Close(ctx context.Context, recordID string, reason EndReason, signalingErrors int) (Record, error) {
+	record, err := service.repo.Find(ctx, recordID)
+	if err != nil {
+		return Record{}, err
+	}
+	if !record.IsOpen() {
+		return record, nil
+	}
+
+	record.SignalingErrors = signalingErrors
+	record, err = service.close(ctx, record, time.Now(), reason)
+	if err != nil {
+		return Record{}, err
+	}
+
+	log.Ctx(ctx, service.logger).Info("Call record closed",
+		zap.String("recordID", record.ID), zap.String("reason", string(reason)), zap.Int64("duration", record.Duration))
+	return record, nil
+}
+
+// UserCalls returns the records of userID, newest first, to that user only.
+func (service *Service) UserCalls(ctx context.Context, userID, viewerID string, req ListRecordRequest) (repository.Page[Record], error) {
+	if userID != viewerID {
+		return repository.Page[Record]{}, ErrForbidden
+	}
+
+	return service.find(ctx, req, func(record Record) bool { return record.UserID == userID })
+}
+
+// RoomHistory returns the records of the room, newest first. They are shown
+// to the managers of the room while it exists and to whoever took part in
+// its calls, even once it is deleted.
+func (service *Service) RoomHistory(ctx context.Context, roomID, viewerID string, req ListRecordRequest) (repository.Page[Record], error) {
+	if err := service.authorize(ctx, roomID, viewerID); err != nil {
+		return repository.Page[Record]{}, err
+	}
+
+	return service.find(ctx, req, func(record Record) bool { return record.RoomID == roomID })
+}
+
+// ResetRecords closes the records a durable store still has open: their
+// sessions did not survive the restart, which is taken as when they left.
+func (service *Service) ResetRecords(ctx context.Context) error {
+	records, err := service.repo.FindList(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, record := range records {
+		if !record.IsOpen() {
+			continue
+		}
+		if _, err := service.close(ctx, record, now, EndReasonServerShutdown); err != nil {
+			return fmt.Errorf("reset record %s: %w", record.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (service *Service) close(ctx context.Context, record Record, leftAt time.Time, reason EndReason) (Record, error) {
+	left := leftAt.Unix()
+	record.LeftAt = &left
+	record.Duration = max(left-record.JoinedAt, 0)
+	record.EndReason = reason
+	return service.repo.Update(ctx, record)
+}
+
+// find returns the records matching where, one page of them or all of them
+// for an export.
+func (service *Service) find(ctx context.Context, req ListRecordRequest, where repository.Predicate[Record]) (repository.Page[Record], error) {
+	query := repository.Query[Record]{
+		Where: []repository.Predicate[Record]{where},
+		Sort: []repository.SortKey[Record]{{
+			Name:    "joined_at",
+			Compare: func(a, b Record) int { return cmp.Compare(a.JoinedAt, b.JoinedAt) },
+			Desc:    true,
+		}},
+		Cursor: req.Cursor,
+		Limit:  repository.PageSize(req.Limit),
+	}
+
+	if req.IsExport() {
+		if req.Format != FormatJSON && req.Format != FormatCSV {
+			return repository.Page[Record]{}, ErrInvalidFormat
+		}
+		query.Cursor = ""
+		query.Limit = 0
+	}
+
+	return service.repo.FindPage(ctx, query)
+}
+
+// authorize checks that userID may see the history of the room. Rooms the
+// user may not see and took no part in are not found.
+func (service *Service) authorize(ctx context.Context, roomID, userID string) error {
+	commonRoom, viewErr := service.rooms.ViewRoom(ctx, roomID, userID)
+	if viewErr != nil && !errors.Is(viewErr, repository.ErrNotFound) {
+		return viewErr
+	}
+	if viewErr == nil && commonRoom.CanManage(userID) {
+		return nil
+	}
+
+	joined, err := service.repo.FindPage(ctx, repository.Query[Record]{
+		Where: []repository.Predicate[Record]{
+			func(record Record) bool { return record.RoomID == roomID && record.UserID == userID },
+		},
+		Limit: 1,
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(joined.Items) > 0:
+		return nil
+	case viewErr != nil:
+		return viewErr
+	default:
+		return room.ErrForbidden
+	}
+}
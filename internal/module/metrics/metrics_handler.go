@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+var Module = fx.Module("metrics",
+	fx.Provide(
+		fx.Annotate(
+			NewPrometheus,
+			fx.As(fx.Self()),
+			fx.As(new(Recorder)),
+		),
+	),
+	fx.Provide(NewHandler),
+	fx.Invoke(func(p *Prometheus, rooms RoomCounter) {
+		p.WatchRooms(rooms)
+	}),
+)
+
+type Handler struct {
+	metrics http.Handler
+}
+
+type HandlerParams struct {
+	fx.In
+
+	Logger     *zap.Logger
+	Prometheus *Prometheus
+}
+
+func NewHandler(params HandlerParams) *Handler {
+	return &Handler{
+		metrics: promhttp.HandlerFor(params.Prometheus.Registry(), promhttp.HandlerOpts{
+			ErrorLog: zap.NewStdLog(params.Logger),
+			// a room store that fails is reported without hiding the rest
+			ErrorHandling: promhttp.ContinueOnError,
+		}),
+	}
+}
+
+// GetMetrics serves the metrics in the Prometheus text format.
+func (handler *Handler) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	handler.metrics.ServeHTTP(w, r)
+}
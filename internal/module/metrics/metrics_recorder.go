@@ -0,0 +1,207 @@
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "vidcall"
+
+// Recorder is what the services record into. Prometheus is the real one and
+// Nop stands in where nothing should be recorded.
+type Recorder interface {
+	ConnectionOpened()
+	ConnectionClosed()
+	UsersOnline(delta int)
+	RoomJoined()
+	RoomLeft()
+	SignalingMessage(msgType string)
+	RelayError(msgType string)
+	ObserveMessage(msgType string, duration time.Duration)
+	ObserveRequest(method, route string, status int, duration time.Duration)
+	ObserveRTT(rtt time.Duration)
+	PeerTimedOut()
+}
+
+// RoomCounter reports how many rooms are in each call state. It is asked on
+// every scrape, so that the gauge never drifts from the store.
+type RoomCounter interface {
+	CountRoomsByState(ctx context.Context) (map[string]int, error)
+}
+
+// Prometheus keeps its metrics in a registry of its own, which can be
+// gathered without a scrape server.
+type Prometheus struct {
+	registry *prometheus.Registry
+
+	connections      prometheus.Gauge
+	usersOnline      prometheus.Gauge
+	joins            prometheus.Counter
+	leaves           prometheus.Counter
+	messages         *prometheus.CounterVec
+	relayErrors      *prometheus.CounterVec
+	messageDurations *prometheus.HistogramVec
+	requestDurations *prometheus.HistogramVec
+	rtts             prometheus.Histogram
+	peerTimeouts     prometheus.Counter
+}
+
+func NewPrometheus() *Prometheus {
+	p := &Prometheus{
+		registry: prometheus.NewRegistry(),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "websocket_connections",
+			Help:      "Live WebSocket connections.",
+		}),
+		usersOnline: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "users_online",
+			Help:      "Users marked online.",
+		}),
+		joins: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "room_joins_total",
+			Help:      "Users who joined a room.",
+		}),
+		leaves: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "room_leaves_total",
+			Help:      "Users who left a room.",
+		}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "signaling_messages_total",
+			Help:      "Signaling messages received from clients, by type.",
+		}, []string{"type"}),
+		relayErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "relay_errors_total",
+			Help:      "Signaling messages that could not be relayed, by type.",
+		}, []string{"type"}),
+		messageDurations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "signaling_message_duration_seconds",
+			Help:      "Time spent handling a signaling message, by type.",
+			Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+		}, []string{"type"}),
+		requestDurations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time spent serving HTTP requests, by method, route pattern and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		rtts: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "websocket_rtt_seconds",
+			Help:      "Round trip times of WebSocket pings.",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}),
+		peerTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "peer_timeouts_total",
+			Help:      "Participants evicted for leaving their pings unanswered.",
+		}),
+	}
+
+	p.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		p.connections,
+		p.usersOnline,
+		p.joins,
+		p.leaves,
+		p.messages,
+		p.relayErrors,
+		p.messageDurations,
+		p.requestDurations,
+		p.rtts,
+		p.peerTimeouts,
+	)
+
+	return p
+}
+
+func (p *Prometheus) ConnectionOpened()     { p.connections.Inc() }
+func (p *Prometheus) ConnectionClosed()     { p.connections.Dec() }
+func (p *Prometheus) UsersOnline(delta int) { p.usersOnline.Add(float64(delta)) }
+func (p *Prometheus) RoomJoined()           { p.joins.Inc() }
+func (p *Prometheus) RoomLeft()             { p.leaves.Inc() }
+func (p *Prometheus) PeerTimedOut()         { p.peerTimeouts.Inc() }
+
+func (p *Prometheus) ObserveRTT(rtt time.Duration) {
+	p.rtts.Observe(rtt.Seconds())
+}
+
+func (p *Prometheus) SignalingMessage(msgType string) {
+	p.messages.WithLabelValues(msgType).Inc()
+}
+
+func (p *Prometheus) RelayError(msgType string) {
+	p.relayErrors.WithLabelValues(msgType).Inc()
+}
+
+func (p *Prometheus) ObserveMessage(msgType string, duration time.Duration) {
+	p.messageDurations.WithLabelValues(msgType).Observe(duration.Seconds())
+}
+
+func (p *Prometheus) ObserveRequest(method, route string, status int, duration time.Duration) {
+	p.requestDurations.WithLabelValues(method, route, strconv.Itoa(status)).Observe(duration.Seconds())
+}
+
+// WatchRooms adds the rooms by state to the metrics. The room service records
+// into the Prometheus, so it cannot be given to NewPrometheus.
+func (p *Prometheus) WatchRooms(rooms RoomCounter) {
+	p.registry.MustRegister(&roomStateCollector{rooms: rooms})
+}
+
+// Registry is where the metrics are gathered from.
+func (p *Prometheus) Registry() *prometheus.Registry {
+	return p.registry
+}
+
+// roomStateCollector asks the room counter on every scrape.
+type roomStateCollector struct {
+	rooms RoomCounter
+}
+
+var roomsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "rooms"),
+	"Rooms, by call state.",
+	[]string{"state"}, nil,
+)
+
+func (collector *roomStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- roomsDesc
+}
+
+func (collector *roomStateCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := collector.rooms.CountRoomsByState(context.Background())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(roomsDesc, err)
+		return
+	}
+
+	for state, count := range counts {
+		ch <- prometheus.MustNewConstMetric(roomsDesc, prometheus.GaugeValue, float64(count), state)
+	}
+}
+
+// Nop records nothing.
+type Nop struct{}
+
+func (Nop) ConnectionOpened()                                 {}
+func (Nop) ConnectionClosed()                                 {}
+func (Nop) UsersOnline(int)                                   {}
+func (Nop) RoomJoined()                                       {}
+func (Nop) RoomLeft()                                         {}
+func (Nop) SignalingMessage(string)                           {}
+func (Nop) RelayError(string)                                 {}
+func (Nop) ObserveMessage(string, time.Duration)              {}
+func (Nop) ObserveRequest(string, string, int, time.Duration) {}
+func (Nop) ObserveRTT(time.Duration)                          {}
+func (Nop) PeerTimedOut()                                     {}
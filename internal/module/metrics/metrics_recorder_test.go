@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	_ Recorder = (*Prometheus)(nil)
+	_ Recorder = Nop{}
+)
+
+type fakeRoomCounter struct {
+	counts map[string]int
+	err    error
+}
+
+func (counter fakeRoomCounter) CountRoomsByState(context.Context) (map[string]int, error) {
+	return counter.counts, counter.err
+}
+
+// gather returns the metrics of p by name, each keyed by its label values.
+func gather(t *testing.T, p *Prometheus) map[string]map[string]*dto.Metric {
+	t.Helper()
+
+	families, err := p.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gathered := make(map[string]map[string]*dto.Metric)
+	for _, family := range families {
+		metrics := make(map[string]*dto.Metric)
+		for _, metric := range family.GetMetric() {
+			var key string
+			for i, label := range metric.GetLabel() {
+				if i > 0 {
+					key += ","
+				}
+				key += label.GetValue()
+			}
+			metrics[key] = metric
+		}
+		gathered[family.GetName()] = metrics
+	}
+	return gathered
+}
+
+// metric returns the metric of name with the label values key.
+func metric(t *testing.T, gathered map[string]map[string]*dto.Metric, name, key string) *dto.Metric {
+	t.Helper()
+
+	m, ok := gathered[name][key]
+	if !ok {
+		t.Fatalf("%s{%s} not gathered", name, key)
+	}
+	return m
+}
+
+func TestPrometheusRecords(t *testing.T) {
+	p := NewPrometheus()
+	p.WatchRooms(fakeRoomCounter{counts: map[string]int{"idle": 2, "active": 1}})
+
+	p.ConnectionOpened()
+	p.ConnectionOpened()
+	p.ConnectionClosed()
+	p.UsersOnline(3)
+	p.UsersOnline(-1)
+	p.RoomJoined()
+	p.RoomJoined()
+	p.RoomLeft()
+	p.SignalingMessage("offer")
+	p.SignalingMessage("offer")
+	p.SignalingMessage("answer")
+	p.RelayError("offer")
+	p.ObserveMessage("offer", 2*time.Millisecond)
+	p.ObserveRequest("GET", "/rooms/{roomID}", 404, 10*time.Millisecond)
+	p.ObserveRTT(30 * time.Millisecond)
+	p.ObserveRTT(50 * time.Millisecond)
+	p.PeerTimedOut()
+
+	gathered := gather(t, p)
+
+	gauges := []struct {
+		name, key string
+		want      float64
+	}{
+		{"vidcall_websocket_connections", "", 1},
+		{"vidcall_users_online", "", 2},
+		{"vidcall_rooms", "idle", 2},
+		{"vidcall_rooms", "active", 1},
+	}
+	for _, gauge := range gauges {
+		if got := metric(t, gathered, gauge.name, gauge.key).GetGauge().GetValue(); got != gauge.want {
+			t.Errorf("%s{%s} = %v, want %v", gauge.name, gauge.key, got, gauge.want)
+		}
+	}
+
+	counters := []struct {
+		name, key string
+		want      float64
+	}{
+		{"vidcall_room_joins_total", "", 2},
+		{"vidcall_room_leaves_total", "", 1},
+		{"vidcall_signaling_messages_total", "offer", 2},
+		{"vidcall_signaling_messages_total", "answer", 1},
+		{"vidcall_relay_errors_total", "offer", 1},
+		{"vidcall_peer_timeouts_total", "", 1},
+	}
+	for _, counter := range counters {
+		if got := metric(t, gathered, counter.name, counter.key).GetCounter().GetValue(); got != counter.want {
+			t.Errorf("%s{%s} = %v, want %v", counter.name, counter.key, got, counter.want)
+		}
+	}
+
+	histograms := []struct {
+		name, key string
+		count     uint64
+		sum       float64
+	}{
+		{"vidcall_signaling_message_duration_seconds", "offer", 1, 0.002},
+		{"vidcall_http_request_duration_seconds", "GET,/rooms/{roomID},404", 1, 0.01},
+		{"vidcall_websocket_rtt_seconds", "", 2, 0.08},
+	}
+	for _, histogram := range histograms {
+		h := metric(t, gathered, histogram.name, histogram.key).GetHistogram()
+		if h.GetSampleCount() != histogram.count || math.Abs(h.GetSampleSum()-histogram.sum) > 1e-9 {
+			t.Errorf("%s{%s}: %d samples summing to %v, want %d summing to %v",
+				histogram.name, histogram.key, h.GetSampleCount(), h.GetSampleSum(), histogram.count, histogram.sum)
+		}
+	}
+
+	if _, ok := gathered["go_goroutines"]; !ok {
+		t.Error("runtime metrics not gathered")
+	}
+}
+
+func TestPrometheusRoomCountFailure(t *testing.T) {
+	p := NewPrometheus()
+	p.WatchRooms(fakeRoomCounter{err: errors.New("store down")})
+
+	if _, err := p.Registry().Gather(); err == nil {
+		t.Fatal("gathered rooms the counter failed to count")
+	}
+}
@@ -0,0 +1,57 @@
+package recording
+
+import "slices"
+
+// State is the lifecycle of a recording:
+//
+//	recording --stop or room deleted--> stopped
+//	recording --server restarted--> failed
+type State string
+
+const (
+	StateRecording State = "recording"
+	StateStopped   State = "stopped"
+	StateFailed    State = "failed"
+)
+
+// File is the recording of one track.
+type File struct {
+	Name      string `json:"name"`    // within the recording, as downloaded
+	UserID    string `json:"user_id"` // publisher of the track
+	TrackID   string `json:"track_id"`
+	MimeType  string `json:"mime_type"`
+	StartedAt int64  `json:"started_at"` // unix seconds
+	Size      int64  `json:"size"`       // bytes
+}
+
+type Recording struct {
+	ID           string   `json:"id"`
+	RoomID       string   `json:"room_id"`
+	StartedBy    string   `json:"started_by"` // as UserID
+	Managers     []string `json:"managers"`   // of the room when the recording started
+	State        State    `json:"state"`
+	StartedAt    int64    `json:"started_at"`   // unix seconds
+	StoppedAt    *int64   `json:"stopped_at"`   // unix seconds
+	Participants []string `json:"participants"` // in the room or publishing while recording
+	Files        []File   `json:"files"`
+	Size         int64    `json:"size"` // bytes, of all files
+}
+
+func (recording Recording) Id() string {
+	return recording.ID
+}
+
+// CanManage reports whether userID managed the room when the recording
+// started, which grants access to it once the room is deleted.
+func (recording Recording) CanManage(userID string) bool {
+	return recording.StartedBy == userID || slices.Contains(recording.Managers, userID)
+}
+
+func (recording Recording) File(name string) (File, bool) {
+	for _, file := range recording.Files {
+		if file.Name == name {
+			return file, true
+		}
+	}
+	return File{}, false
+}
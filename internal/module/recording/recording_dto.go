@@ -0,0 +1,6 @@
+package recording
+
+type ListRecordingRequest struct {
+	Limit  int    `query:"limit"`
+	Cursor string `query:"cursor"`
+}
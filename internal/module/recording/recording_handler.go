@@ -0,0 +1,239 @@
+package recording
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+
+	"vidcall/internal/common"
+	"vidcall/internal/module/room"
+	"vidcall/pkg/log"
+	"vidcall/pkg/repository"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+var Module = fx.Module("recording",
+	fx.Provide(
+		fx.Private,
+		func(store *repository.Store) (repository.Repository[string, Recording], error) {
+			return repository.New[string, Recording](store, "recordings")
+		},
+	),
+	fx.Provide(NewService),
+	fx.Provide(NewHandler),
+	fx.Invoke(func(lc fx.Lifecycle, service *Service, rooms *room.Service) {
+		rooms.OnDelete(service.roomDeleted)
+		lc.Append(fx.Hook{OnStart: service.ResetRecordings, OnStop: service.StopAll})
+	}),
+)
+
+// contentTypes are served for the file extensions the media package writes.
+var contentTypes = map[string]string{
+	".ogg": "audio/ogg",
+	".ivf": "video/x-ivf",
+}
+
+type Handler struct {
+	service *Service
+	logger  *zap.Logger
+}
+
+type HandlerParams struct {
+	fx.In
+
+	Logger  *zap.Logger
+	Service *Service
+}
+
+func NewHandler(params HandlerParams) *Handler {
+	return &Handler{
+		service: params.Service,
+		logger:  params.Logger,
+	}
+}
+
+func (handler *Handler) StartRecording(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	roomID := common.GetParam(r, "roomID")
+	if roomID == "" {
+		http.Error(w, "Missing room ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx := log.WithFields(r.Context(), log.RoomID(roomID))
+	recording, err := handler.service.StartRecording(ctx, roomID, userID)
+	if err != nil {
+		if !handler.writeError(w, err) {
+			log.Ctx(ctx, handler.logger).Error("Start recording failed", zap.Error(err))
+			http.Error(w, "Failed to start recording", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := common.WriteResponse(w, http.StatusCreated, recording); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (handler *Handler) StopRecording(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	roomID := common.GetParam(r, "roomID")
+	recordingID := common.GetParam(r, "recordingID")
+	if roomID == "" || recordingID == "" {
+		http.Error(w, "Missing room or recording ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx := log.WithFields(r.Context(), log.RoomID(roomID))
+	recording, err := handler.service.StopRecording(ctx, roomID, recordingID, userID)
+	if err != nil {
+		if !handler.writeError(w, err) {
+			log.Ctx(ctx, handler.logger).Error("Stop recording failed", zap.Error(err))
+			http.Error(w, "Failed to stop recording", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := common.WriteResponse(w, http.StatusOK, recording); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (handler *Handler) GetRecording(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	roomID := common.GetParam(r, "roomID")
+	recordingID := common.GetParam(r, "recordingID")
+	if roomID == "" || recordingID == "" {
+		http.Error(w, "Missing room or recording ID", http.StatusBadRequest)
+		return
+	}
+
+	recording, err := handler.service.GetRecording(r.Context(), roomID, recordingID, userID)
+	if err != nil {
+		if !handler.writeError(w, err) {
+			log.Ctx(r.Context(), handler.logger).Error("Get recording failed", zap.Error(err))
+			http.Error(w, "Failed to get recording", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := common.WriteResponse(w, http.StatusOK, recording); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (handler *Handler) ListRecordings(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	roomID := common.GetParam(r, "roomID")
+	if roomID == "" {
+		http.Error(w, "Missing room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ListRecordingRequest
+	if err := common.BindRequest(r, &req); err != nil {
+		http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	recordings, err := handler.service.ListRecordings(r.Context(), roomID, userID, req)
+	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !handler.writeError(w, err) {
+			log.Ctx(r.Context(), handler.logger).Error("List recordings failed", zap.Error(err))
+			http.Error(w, "Failed to list recordings", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := common.WriteResponse(w, http.StatusOK, recordings); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// DownloadRecording serves one file of a recording, with range requests.
+func (handler *Handler) DownloadRecording(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	roomID := common.GetParam(r, "roomID")
+	recordingID := common.GetParam(r, "recordingID")
+	name := common.GetParam(r, "name")
+	if roomID == "" || recordingID == "" || name == "" {
+		http.Error(w, "Missing room or recording ID or file name", http.StatusBadRequest)
+		return
+	}
+
+	file, err := handler.service.OpenFile(r.Context(), roomID, recordingID, name, userID)
+	if err != nil {
+		if !handler.writeError(w, err) {
+			log.Ctx(r.Context(), handler.logger).Error("Open recording file failed", zap.Error(err))
+			http.Error(w, "Failed to open recording file", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to open recording file", http.StatusInternalServerError)
+		return
+	}
+
+	if contentType, ok := contentTypes[path.Ext(name)]; ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", recordingID+"-"+name))
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+// writeError answers the errors a client can cause and reports whether err
+// was one of them.
+func (handler *Handler) writeError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, room.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrNotSFURoom):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrAlreadyRecording), errors.Is(err, ErrNotRecording):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,430 @@
+package recording
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"vidcall/config"
+	"vidcall/internal/module/room"
+	"vidcall/internal/module/rtc"
+	"vidcall/pkg/log"
+	"vidcall/pkg/media"
+	"vidcall/pkg/repository"
+
+	"github.com/oklog/ulid/v2"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrNotSFURoom       = errors.New("only sfu rooms can be recorded")
+	ErrAlreadyRecording = errors.New("room is already being recorded")
+	ErrNotRecording     = errors.New("recording is not in progress")
+)
+
+type Service struct {
+	// mu guards sessions
+	mu     sync.Mutex
+	repo   repository.Repository[string, Recording]
+	rooms  *room.Service
+	sfu    tapper
+	dir    string
+	logger *zap.Logger
+
+	// sessions are the recordings in progress, keyed by room ID
+	sessions map[string]*session
+}
+
+// tapper hands the tracks published in a room to a tap, as rtc.SFU does.
+type tapper interface {
+	Tap(roomID string, tap rtc.Tap) (func() error, error)
+}
+
+// session is a recording in progress. Its tracks are opened from the SFU,
+// so recording is guarded by mu.
+type session struct {
+	mu        sync.Mutex
+	recording Recording
+	dir       string
+	untap     func() error
+}
+
+type ServiceParams struct {
+	fx.In
+
+	Config     config.Config
+	Logger     *zap.Logger
+	Rooms      *room.Service
+	SFU        *rtc.SFU
+	Repository repository.Repository[string, Recording]
+}
+
+func NewService(params ServiceParams) *Service {
+	return &Service{
+		repo:     params.Repository,
+		rooms:    params.Rooms,
+		sfu:      params.SFU,
+		dir:      params.Config.Recording.Dir,
+		logger:   params.Logger,
+		sessions: make(map[string]*session),
+	}
+}
+
+// StartRecording records every track published in the room from now on,
+// until StopRecording or the room is deleted. Only the managers of an sfu
+// room may record it.
+func (service *Service) StartRecording(ctx context.Context, roomID, userID string) (Recording, error) {
+	commonRoom, err := service.authorize(ctx, roomID, userID)
+	if err != nil {
+		return Recording{}, err
+	}
+	if !commonRoom.IsSFU() {
+		return Recording{}, ErrNotSFURoom
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if _, ok := service.sessions[roomID]; ok {
+		return Recording{}, ErrAlreadyRecording
+	}
+
+	participants := make([]string, 0, len(commonRoom.Participants))
+	for _, participant := range commonRoom.Participants {
+		participants = append(participants, participant.UserID)
+	}
+
+	recording := Recording{
+		ID:           ulid.Make().String(),
+		RoomID:       roomID,
+		StartedBy:    userID,
+		Managers:     append([]string{commonRoom.CreatedBy}, commonRoom.Moderators...),
+		State:        StateRecording,
+		StartedAt:    time.Now().Unix(),
+		Participants: participants,
+		Files:        []File{},
+	}
+
+	dir := filepath.Join(service.dir, recording.ID)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return Recording{}, fmt.Errorf("create recording directory: %w", err)
+	}
+
+	recording, err = service.repo.Insert(ctx, recording)
+	if err != nil {
+		return Recording{}, err
+	}
+
+	current := &session{recording: recording, dir: dir}
+	current.untap, err = service.sfu.Tap(roomID, service.openTrack(current))
+	if err != nil {
+		recording.State = StateFailed
+		if _, updateErr := service.repo.Update(ctx, recording); updateErr != nil {
+			err = errors.Join(err, updateErr)
+		}
+		return Recording{}, fmt.Errorf("tap sfu: %w", err)
+	}
+	service.sessions[roomID] = current
+
+	log.Ctx(ctx, service.logger).Info("Recording started", zap.String("recordingID", recording.ID))
+	return current.snapshot(), nil
+}
+
+// StopRecording stops the recording in progress in the room, closing its
+// files.
+func (service *Service) StopRecording(ctx context.Context, roomID, recordingID, userID string) (Recording, error) {
+	if _, err := service.authorize(ctx, roomID, userID); err != nil {
+		return Recording{}, err
+	}
+
+	service.mu.Lock()
+	current, ok := service.sessions[roomID]
+	if ok && current.recording.ID == recordingID {
+		delete(service.sessions, roomID)
+	}
+	service.mu.Unlock()
+
+	if !ok || current.recording.ID != recordingID {
+		if _, err := service.find(ctx, roomID, recordingID); err != nil {
+			return Recording{}, err
+		}
+		return Recording{}, ErrNotRecording
+	}
+
+	return service.finish(ctx, current, StateStopped)
+}
+
+// GetRecording returns a recording of the room, with the size of its files
+// so far when it is in progress.
+func (service *Service) GetRecording(ctx context.Context, roomID, recordingID, userID string) (Recording, error) {
+	deleted, err := service.authorizeRead(ctx, roomID, userID)
+	if err != nil {
+		return Recording{}, err
+	}
+
+	recording, err := service.find(ctx, roomID, recordingID)
+	if err != nil {
+		return Recording{}, err
+	}
+	if deleted && !recording.CanManage(userID) {
+		return Recording{}, repository.ErrNotFound
+	}
+
+	if recording.State == StateRecording {
+		service.measure(&recording)
+	}
+	return recording, nil
+}
+
+// ListRecordings returns one page of the recordings of the room, newest
+// first. Once the room is deleted, only those userID managed are listed.
+func (service *Service) ListRecordings(ctx context.Context, roomID, userID string, req ListRecordingRequest) (repository.Page[Recording], error) {
+	deleted, err := service.authorizeRead(ctx, roomID, userID)
+	if err != nil {
+		return repository.Page[Recording]{}, err
+	}
+
+	query := repository.Query[Recording]{
+		Where: []repository.Predicate[Recording]{
+			func(recording Recording) bool { return recording.RoomID == roomID },
+		},
+		Sort: []repository.SortKey[Recording]{{
+			Name:    "started_at",
+			Compare: func(a, b Recording) int { return cmp.Compare(a.StartedAt, b.StartedAt) },
+			Desc:    true,
+		}},
+		Cursor: req.Cursor,
+		Limit:  repository.PageSize(req.Limit),
+	}
+	if deleted {
+		query.Where = append(query.Where, func(recording Recording) bool { return recording.CanManage(userID) })
+	}
+
+	return service.repo.FindPage(ctx, query)
+}
+
+// OpenFile opens a file of a recording of the room for download. The caller
+// closes it.
+func (service *Service) OpenFile(ctx context.Context, roomID, recordingID, name, userID string) (*os.File, error) {
+	recording, err := service.GetRecording(ctx, roomID, recordingID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	file, ok := recording.File(name)
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+
+	return os.Open(filepath.Join(service.dir, recording.ID, file.Name))
+}
+
+// StopAll stops every recording in progress, when the server shuts down.
+func (service *Service) StopAll(ctx context.Context) error {
+	service.mu.Lock()
+	sessions := service.sessions
+	service.sessions = make(map[string]*session)
+	service.mu.Unlock()
+
+	var errs []error
+	for _, current := range sessions {
+		if _, err := service.finish(ctx, current, StateStopped); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ResetRecordings marks the recordings a durable store still has in progress
+// as failed: nothing is recorded across a restart. Their files are kept up
+// to where they were cut.
+func (service *Service) ResetRecordings(ctx context.Context) error {
+	recordings, err := service.repo.FindList(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, recording := range recordings {
+		if recording.State != StateRecording {
+			continue
+		}
+
+		service.measure(&recording)
+		recording.State = StateFailed
+		stoppedAt := time.Now().Unix()
+		recording.StoppedAt = &stoppedAt
+		if _, err := service.repo.Update(ctx, recording); err != nil {
+			return fmt.Errorf("reset recording %s: %w", recording.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// roomDeleted stops the recording of a deleted room.
+func (service *Service) roomDeleted(ctx context.Context, roomID string) {
+	service.mu.Lock()
+	current, ok := service.sessions[roomID]
+	delete(service.sessions, roomID)
+	service.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if _, err := service.finish(ctx, current, StateStopped); err != nil {
+		log.Ctx(ctx, service.logger).Error("Stop recording of deleted room failed", zap.Error(err))
+	}
+}
+
+// openTrack returns the tap creating a file for every track of the session
+// in a format the media package writes.
+func (service *Service) openTrack(current *session) rtc.Tap {
+	logger := service.logger.With(log.RoomID(current.recording.RoomID), zap.String("recordingID", current.recording.ID))
+
+	return func(track rtc.TrackInfo) media.Writer {
+		logger := logger.With(log.UserID(track.Publisher), zap.String("track", track.ID))
+
+		ext := media.Extension(track.MimeType)
+		if ext == "" {
+			logger.Info("Track not recorded, no writer for its codec", zap.String("codec", track.MimeType))
+			return nil
+		}
+
+		current.mu.Lock()
+		defer current.mu.Unlock()
+
+		kind, _, _ := strings.Cut(track.MimeType, "/")
+		// Track IDs come from clients, so they stay out of file names
+		name := fmt.Sprintf("%02d-%s.%s", len(current.recording.Files)+1, strings.ToLower(kind), ext)
+
+		file, err := os.Create(filepath.Join(current.dir, name))
+		if err != nil {
+			logger.Error("Create recording file failed", zap.Error(err))
+			return nil
+		}
+		writer, err := media.NewWriter(file, track.MimeType, track.Channels)
+		if err != nil {
+			_ = file.Close()
+			logger.Error("Start recording file failed", zap.Error(err))
+			return nil
+		}
+
+		current.recording.Files = append(current.recording.Files, File{
+			Name:      name,
+			UserID:    track.Publisher,
+			TrackID:   track.ID,
+			MimeType:  track.MimeType,
+			StartedAt: time.Now().Unix(),
+		})
+		if !slices.Contains(current.recording.Participants, track.Publisher) {
+			current.recording.Participants = append(current.recording.Participants, track.Publisher)
+		}
+		// Tracks are opened from the SFU, outside of any request
+		if _, err := service.repo.Update(context.Background(), current.recording); err != nil {
+			logger.Warn("Save recording failed", zap.Error(err))
+		}
+
+		logger.Info("Recording track", zap.String("file", name))
+		return writer
+	}
+}
+
+// finish closes the files of a session that was removed from the sessions
+// and saves it in its final state.
+func (service *Service) finish(ctx context.Context, current *session, state State) (Recording, error) {
+	logger := log.Ctx(ctx, service.logger).With(zap.String("recordingID", current.recording.ID))
+
+	if err := current.untap(); err != nil {
+		logger.Warn("Close recording files failed", zap.Error(err))
+	}
+
+	recording := current.snapshot()
+	service.measure(&recording)
+	recording.State = state
+	stoppedAt := time.Now().Unix()
+	recording.StoppedAt = &stoppedAt
+
+	recording, err := service.repo.Update(ctx, recording)
+	if err != nil {
+		return Recording{}, err
+	}
+
+	logger.Info("Recording stopped", zap.Int("files", len(recording.Files)), zap.Int64("size", recording.Size))
+	return recording, nil
+}
+
+// measure fills in the size of the files of recording from the disk.
+func (service *Service) measure(recording *Recording) {
+	recording.Size = 0
+	for i, file := range recording.Files {
+		info, err := os.Stat(filepath.Join(service.dir, recording.ID, file.Name))
+		if err != nil {
+			continue
+		}
+		recording.Files[i].Size = info.Size()
+		recording.Size += info.Size()
+	}
+}
+
+// authorize returns the room if userID may manage its recordings. Rooms the
+// user may not see are not found.
+func (service *Service) authorize(ctx context.Context, roomID, userID string) (room.Room, error) {
+	commonRoom, err := service.rooms.ViewRoom(ctx, roomID, userID)
+	if err != nil {
+		return room.Room{}, err
+	}
+	if !commonRoom.CanManage(userID) {
+		return room.Room{}, room.ErrForbidden
+	}
+	return commonRoom, nil
+}
+
+// authorizeRead checks that userID may see the recordings of the room and
+// reports whether it is deleted. Recordings outlive their room: those of a
+// deleted room are left to whoever managed it when they started, which the
+// callers check on every recording.
+func (service *Service) authorizeRead(ctx context.Context, roomID, userID string) (bool, error) {
+	_, err := service.authorize(ctx, roomID, userID)
+	if !errors.Is(err, repository.ErrNotFound) {
+		return false, err
+	}
+
+	// ViewRoom also hides the rooms userID may not see
+	if _, err := service.rooms.GetRoom(ctx, roomID); !errors.Is(err, repository.ErrNotFound) {
+		if err == nil {
+			err = repository.ErrNotFound
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (service *Service) find(ctx context.Context, roomID, recordingID string) (Recording, error) {
+	recording, err := service.repo.Find(ctx, recordingID)
+	if err != nil {
+		return Recording{}, err
+	}
+	if recording.RoomID != roomID {
+		return Recording{}, repository.ErrNotFound
+	}
+	return recording, nil
+}
+
+// snapshot copies the recording of the session.
+func (current *session) snapshot() Recording {
+	current.mu.Lock()
+	defer current.mu.Unlock()
+
+	recording := current.recording
+	recording.Files = slices.Clone(recording.Files)
+	recording.Participants = slices.Clone(recording.Participants)
+	return recording
+}
@@ -0,0 +1,174 @@
+package recording
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"vidcall/config"
+	"vidcall/internal/module/metrics"
+	"vidcall/internal/module/room"
+	"vidcall/internal/module/rtc"
+	"vidcall/pkg/media"
+	"vidcall/pkg/repository"
+
+	"go.uber.org/zap"
+)
+
+// fakeSFU stands in for rtc.SFU: the test publishes tracks through the tap
+// of the room, and removing the tap closes the writers it opened.
+type fakeSFU struct {
+	roomID  string
+	tap     rtc.Tap
+	writers []media.Writer
+}
+
+func (sfu *fakeSFU) Tap(roomID string, tap rtc.Tap) (func() error, error) {
+	sfu.roomID, sfu.tap = roomID, tap
+	return func() error {
+		var errs []error
+		for _, writer := range sfu.writers {
+			errs = append(errs, writer.Close())
+		}
+		sfu.tap, sfu.writers = nil, nil
+		return errors.Join(errs...)
+	}, nil
+}
+
+// publish opens the writer of track, which is nil when it is not recorded.
+func (sfu *fakeSFU) publish(t *testing.T, track rtc.TrackInfo) media.Writer {
+	t.Helper()
+	if sfu.tap == nil {
+		t.Fatal("room is not tapped")
+	}
+	writer := sfu.tap(track)
+	if writer != nil {
+		sfu.writers = append(sfu.writers, writer)
+	}
+	return writer
+}
+
+func newTestService(t *testing.T) (*Service, *room.Service, *fakeSFU) {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.SFU.Enabled = true
+	rooms := room.NewService(room.ServiceParams{
+		Config:     cfg,
+		Watcher:    &config.Watcher{},
+		Logger:     zap.NewNop(),
+		Metrics:    metrics.Nop{},
+		Store:      &repository.Store{},
+		Repository: repository.NewSyncRepository[string, room.Room](),
+	})
+
+	sfu := &fakeSFU{}
+	service := NewService(ServiceParams{
+		Config:     cfg,
+		Logger:     zap.NewNop(),
+		Rooms:      rooms,
+		Repository: repository.NewSyncRepository[string, Recording](),
+	})
+	service.sfu = sfu
+	service.dir = t.TempDir()
+	return service, rooms, sfu
+}
+
+func TestRecordingTracks(t *testing.T) {
+	ctx := context.Background()
+	service, rooms, sfu := newTestService(t)
+
+	sfuRoom, err := rooms.CreateRoom(ctx, room.Room{ID: "room", Name: "sfu", CreatedBy: "alice", Mode: room.ModeSFU}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.StartRecording(ctx, sfuRoom.ID, "bob"); !errors.Is(err, room.ErrForbidden) {
+		t.Fatalf("recording started by a participant: %v", err)
+	}
+
+	recording, err := service.StartRecording(ctx, sfuRoom.ID, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sfu.roomID != sfuRoom.ID || recording.State != StateRecording {
+		t.Fatalf("tapped room %q, state %q", sfu.roomID, recording.State)
+	}
+	if _, err := service.StartRecording(ctx, sfuRoom.ID, "alice"); !errors.Is(err, ErrAlreadyRecording) {
+		t.Fatalf("second recording: %v", err)
+	}
+
+	audio := sfu.publish(t, rtc.TrackInfo{Publisher: "bob", ID: "mic", MimeType: media.MimeTypeOpus, ClockRate: 48000, Channels: 2})
+	video := sfu.publish(t, rtc.TrackInfo{Publisher: "carol", ID: "cam", MimeType: media.MimeTypeVP8, ClockRate: 90000})
+	if audio == nil || video == nil {
+		t.Fatal("opus or vp8 track not recorded")
+	}
+	if writer := sfu.publish(t, rtc.TrackInfo{Publisher: "bob", ID: "h264", MimeType: "video/H264"}); writer != nil {
+		t.Fatal("h264 track recorded")
+	}
+
+	for i := range 3 {
+		packet := media.Packet{SequenceNumber: uint16(i), Timestamp: uint32(960 * i), Payload: []byte{0xFC, byte(i)}}
+		if err := audio.WriteRTP(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a single packet keyframe of 16x16
+	keyframe := []byte{0x10, 0x50, 0x00, 0x00, 0x9D, 0x01, 0x2A, 16, 0, 16, 0}
+	if err := video.WriteRTP(media.Packet{SequenceNumber: 1, Marker: true, Payload: keyframe}); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped, err := service.StopRecording(ctx, sfuRoom.ID, recording.ID, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stopped.State != StateStopped || stopped.StoppedAt == nil {
+		t.Errorf("state %q, stopped at %v", stopped.State, stopped.StoppedAt)
+	}
+	if sfu.tap != nil {
+		t.Error("room still tapped")
+	}
+	if !slices.Equal(stopped.Participants, []string{"bob", "carol"}) {
+		t.Errorf("participants %v", stopped.Participants)
+	}
+
+	want := []struct{ name, userID, magic string }{
+		{"01-audio.ogg", "bob", "OggS"},
+		{"02-video.ivf", "carol", "DKIF"},
+	}
+	if len(stopped.Files) != len(want) {
+		t.Fatalf("got %d files, want %d", len(stopped.Files), len(want))
+	}
+	var size int64
+	for i, file := range stopped.Files {
+		if file.Name != want[i].name || file.UserID != want[i].userID {
+			t.Errorf("file %d: %s of %s, want %s of %s", i, file.Name, file.UserID, want[i].name, want[i].userID)
+		}
+		data, err := os.ReadFile(filepath.Join(service.dir, recording.ID, file.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, []byte(want[i].magic)) || file.Size != int64(len(data)) {
+			t.Errorf("file %s: %d bytes starting % x, recorded as %d bytes", file.Name, len(data), data[:min(len(data), 4)], file.Size)
+		}
+		size += file.Size
+	}
+	if stopped.Size != size {
+		t.Errorf("size %d, want %d", stopped.Size, size)
+	}
+
+	// Recordings outlive their room, for its managers only
+	if err := rooms.DeleteRoom(ctx, sfuRoom.ID, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.GetRecording(ctx, sfuRoom.ID, recording.ID, "alice"); err != nil {
+		t.Errorf("recording of deleted room: %v", err)
+	}
+	if _, err := service.GetRecording(ctx, sfuRoom.ID, recording.ID, "bob"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("recording of deleted room shown to a participant: %v", err)
+	}
+}
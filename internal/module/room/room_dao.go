@@ -1,35 +1,158 @@
 package room
 
-import "time"
+import (
+	"slices"
+	"time"
+)
 
 var expandedRoomDuration = 10 * time.Minute // 5 minutes in seconds
+
+// CallState is the lifecycle of the call held in a room:
+//
+//	idle --offer--> ringing --answer--> connected
+//	ringing/connected --fewer than 2 participants--> ended --join--> idle
+type CallState string
+
+const (
+	CallStateIdle      CallState = "idle"
+	CallStateRinging   CallState = "ringing"
+	CallStateConnected CallState = "connected"
+	CallStateEnded     CallState = "ended"
+)
+
+// CallSignal is a step of the signaling flow that can move the call state.
+type CallSignal string
+
+const (
+	CallSignalOffer  CallSignal = "offer"
+	CallSignalAnswer CallSignal = "answer"
+	CallSignalJoin   CallSignal = "join"
+	CallSignalLeave  CallSignal = "leave"
+)
+
+// Next returns the state reached from state on signal, given the number of
+// participants left in the room after the signal.
+func (state CallState) Next(signal CallSignal, participants int) CallState {
+	switch signal {
+	case CallSignalOffer:
+		if state == CallStateIdle || state == CallStateEnded {
+			return CallStateRinging
+		}
+	case CallSignalAnswer:
+		if state == CallStateRinging {
+			return CallStateConnected
+		}
+	case CallSignalJoin:
+		if state == CallStateEnded {
+			return CallStateIdle
+		}
+	case CallSignalLeave:
+		if (state == CallStateRinging || state == CallStateConnected) && participants < 2 {
+			return CallStateEnded
+		}
+	}
+	return state
+}
+
+// MediaState is what a participant currently publishes, as reported by its
+// own client.
+type MediaState struct {
+	AudioMuted    bool `json:"audio_muted"`
+	VideoOff      bool `json:"video_off"`
+	ScreenSharing bool `json:"screen_sharing"`
+}
+
+type Participant struct {
+	UserID   string     `json:"user_id"`
+	JoinedAt int64      `json:"joined_at"`
+	Media    MediaState `json:"media"`
+}
+
+// Mode is how the media of a room flows.
+type Mode string
+
+const (
+	ModeMesh Mode = "mesh" // every participant connects to every other one
+	ModeSFU  Mode = "sfu"  // every participant connects to the server, which forwards the tracks
+)
+
+type Visibility string
+
+const (
+	VisibilityPublic  Visibility = "public"
+	VisibilityPrivate Visibility = "private"
+)
+
 type Room struct {
-	ID          string                `json:"id"`
-	Name        string                `json:"name"`
-	Description string                `json:"description"`
-	Users       [2]*string            `json:"users"`
-	CreatedAt   int64                 `json:"created_at"`
-	CreatedBy   string                `json:"created_by"` // as UserID
-	ExpiredAt   *int64                `json:"expired_at"`
-	Subscribers map[string]chan Event `json:"-"`
+	ID           string        `json:"id"`
+	Name         string        `json:"name"`
+	Description  string        `json:"description"`
+	Capacity     int           `json:"capacity"`
+	Participants []Participant `json:"participants"` // ordered by join time
+	CallState    CallState     `json:"call_state"`
+	Mode         Mode          `json:"mode"`
+	CreatedAt    int64         `json:"created_at"`
+	CreatedBy    string        `json:"created_by"` // as UserID
+	Visibility   Visibility    `json:"visibility"`
+	PasscodeHash string        `json:"passcode_hash,omitempty"`
+	Invited      []string      `json:"invited,omitempty"`    // allow-list of user IDs
+	Moderators   []string      `json:"moderators,omitempty"` // may manage the room like its owner
+	StartsAt     *int64        `json:"starts_at"`            // joins are rejected before
+	EndsAt       *int64        `json:"ends_at"`              // hard end of the meeting
+	ExpiredAt    *int64        `json:"expired_at"`
+	ExpiryWarned bool          `json:"expiry_warned,omitempty"` // room_expiring was sent
 }
 
 func (room Room) Id() string {
 	return room.ID
 }
 
+// IsSFU reports whether the media of the room goes through the server. Rooms
+// stored before modes existed are mesh rooms.
+func (room Room) IsSFU() bool {
+	return room.Mode == ModeSFU
+}
+
 func (room Room) IsFull() bool {
-	return room.Users[0] != nil && room.Users[1] != nil
+	return len(room.Participants) >= room.Capacity
 }
 
-func (room Room) GetUserDest(userID string) string {
-	if room.Users[0] != nil && *room.Users[0] != userID {
-		return *room.Users[0]
-	}
-	if room.Users[1] != nil && *room.Users[1] != userID {
-		return *room.Users[1]
+func (room Room) HasUser(userID string) bool {
+	return room.indexOf(userID) >= 0
+}
+
+// Peers returns the IDs of every participant except userID, in join order.
+func (room Room) Peers(userID string) []string {
+	peers := make([]string, 0, len(room.Participants))
+	for _, participant := range room.Participants {
+		if participant.UserID != userID {
+			peers = append(peers, participant.UserID)
+		}
 	}
-	return ""
+	return peers
+}
+
+// CanManage reports whether the user may update or delete the room.
+func (room Room) CanManage(userID string) bool {
+	return room.CreatedBy == userID || slices.Contains(room.Moderators, userID)
+}
+
+// IsRestricted reports whether only invited users may join.
+func (room Room) IsRestricted() bool {
+	return room.Visibility == VisibilityPrivate || len(room.Invited) > 0
+}
+
+// IsMember reports whether the user is allowed to see the room.
+func (room Room) IsMember(userID string) bool {
+	return room.CanManage(userID) || slices.Contains(room.Invited, userID) || room.HasUser(userID)
+}
+
+func (room Room) CanView(userID string) bool {
+	return room.Visibility != VisibilityPrivate || room.IsMember(userID)
+}
+
+func (room Room) HasStarted(now time.Time) bool {
+	return room.StartsAt == nil || *room.StartsAt <= now.Unix()
 }
 
 func (room Room) IsExpired() bool {
@@ -40,3 +163,9 @@ func (room Room) ShouldDelete() bool {
 	// Consider room expired if ExpiredAt is set and is older than expandedRoomDuration ago
 	return room.ExpiredAt != nil && *room.ExpiredAt < time.Now().Add(-expandedRoomDuration).Unix()
 }
+
+func (room Room) indexOf(userID string) int {
+	return slices.IndexFunc(room.Participants, func(participant Participant) bool {
+		return participant.UserID == userID
+	})
+}
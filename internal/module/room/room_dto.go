@@ -1,9 +1,14 @@
 package room
 
+import "vidcall/pkg/repository"
+
 const (
 	EventNewComer    = "new_comer"
 	EventLeaveRoom   = "leave_room"
 	EventRoomDeleted = "room_deleted"
+	EventCallState   = "call_state"    // Data is the new CallState
+	EventExpiring    = "room_expiring" // Data is the EndsAt unix time
+	EventRoomEnded   = "room_ended"    // the scheduled end has passed, participants are let go
 )
 
 type Event struct {
@@ -33,6 +38,72 @@ func (event Event) LeaveRoom() (string, bool) {
 	return userID, true
 }
 
+func (event Event) CallState() (CallState, bool) {
+	if event.EventName != EventCallState {
+		return "", false
+	}
+	state, ok := event.Data.(CallState)
+	return state, ok
+}
+
 type ListRoomRequest struct {
 	OwnerID string `query:"owner_id"`
+	Limit   int    `query:"limit"`
+	Cursor  string `query:"cursor"`
+	Sort    string `query:"sort"` // created_at, name or participants, "-" prefix for descending
+}
+
+type CreateRoomRequest struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Capacity    int        `json:"capacity"`
+	Visibility  Visibility `json:"visibility"`
+	Mode        Mode       `json:"mode"` // mesh by default, fixed for the life of the room
+	Passcode    string     `json:"passcode"`
+	Invited     []string   `json:"invited"`
+	Moderators  []string   `json:"moderators"`
+	StartsAt    *int64     `json:"starts_at"` // unix seconds
+	EndsAt      *int64     `json:"ends_at"`   // unix seconds
+}
+
+type UpdateRoomRequest struct {
+	Name        *string     `json:"name"`
+	Description *string     `json:"description"`
+	Capacity    *int        `json:"capacity"`
+	Visibility  *Visibility `json:"visibility"`
+	Passcode    *string     `json:"passcode"` // empty string removes the passcode
+	Invited     *[]string   `json:"invited"`
+	Moderators  *[]string   `json:"moderators"` // owner only
+}
+
+// RoomResponse is the API representation of a room, without its secrets.
+type RoomResponse struct {
+	Room
+	HasPasscode bool `json:"has_passcode"`
+}
+
+// NewRoomResponse shows room to viewerID. Only those who manage the room see
+// who is invited and who moderates it.
+func NewRoomResponse(room Room, viewerID string) RoomResponse {
+	response := RoomResponse{
+		Room:        room,
+		HasPasscode: room.PasscodeHash != "",
+	}
+	response.PasscodeHash = ""
+	if !room.CanManage(viewerID) {
+		response.Invited = nil
+		response.Moderators = nil
+	}
+	return response
+}
+
+func NewRoomPageResponse(page repository.Page[Room], viewerID string) repository.Page[RoomResponse] {
+	responses := make([]RoomResponse, 0, len(page.Items))
+	for _, room := range page.Items {
+		responses = append(responses, NewRoomResponse(room, viewerID))
+	}
+	return repository.Page[RoomResponse]{
+		Items:      responses,
+		NextCursor: page.NextCursor,
+	}
 }
@@ -1,9 +1,12 @@
 package room
 
 import (
+	"errors"
 	"net/http"
 
 	"vidcall/internal/common"
+	"vidcall/internal/module/metrics"
+	"vidcall/pkg/log"
 	"vidcall/pkg/repository"
 
 	"github.com/oklog/ulid/v2"
@@ -14,13 +17,21 @@ import (
 var Module = fx.Module("room",
 	fx.Provide(
 		fx.Private,
+		func(store *repository.Store) (repository.Repository[string, Room], error) {
+			return repository.New[string, Room](store, "rooms")
+		},
+	),
+	fx.Provide(
 		fx.Annotate(
-			repository.NewSyncRepository[string, Room],
-			fx.As(new(repository.Repository[string, Room])),
+			NewService,
+			fx.As(fx.Self()),
+			fx.As(new(metrics.RoomCounter)),
 		),
 	),
-	fx.Provide(NewService),
 	fx.Provide(NewHandler),
+	fx.Invoke(func(lc fx.Lifecycle, service *Service) {
+		lc.Append(fx.Hook{OnStart: service.ResetSessions})
+	}),
 )
 
 type Handler struct {
@@ -43,53 +54,149 @@ func NewHandler(params HandlerParams) *Handler {
 }
 
 func (handler *Handler) CreateRoom(w http.ResponseWriter, r *http.Request) {
-	var room Room
-	if err := common.BindRequest(r, &room); err != nil {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateRoomRequest
+	if err := common.BindRequest(r, &req); err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
 
-	room.ID = ulid.Make().String()
-	room.CreatedBy, _ = common.GetUserID(r)
-	if _, err := handler.service.CreateRoom(r.Context(), room); err != nil {
+	room := Room{
+		ID:          ulid.Make().String(),
+		Name:        req.Name,
+		Description: req.Description,
+		Capacity:    req.Capacity,
+		CreatedBy:   userID,
+		Visibility:  req.Visibility,
+		Mode:        req.Mode,
+		Invited:     req.Invited,
+		Moderators:  req.Moderators,
+		StartsAt:    req.StartsAt,
+		EndsAt:      req.EndsAt,
+	}
+
+	ctx := log.WithFields(r.Context(), log.RoomID(room.ID))
+	room, err = handler.service.CreateRoom(ctx, room, req.Passcode)
+	if err != nil {
+		if errors.Is(err, ErrInvalidRoomCapacity) || errors.Is(err, ErrInvalidVisibility) || errors.Is(err, ErrInvalidSchedule) ||
+			errors.Is(err, ErrInvalidMode) || errors.Is(err, ErrSFUDisabled) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if errors.Is(err, ErrShuttingDown) {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		log.Ctx(ctx, handler.logger).Error("Create room failed", zap.Error(err))
 		http.Error(w, "Failed to create room", http.StatusInternalServerError)
 		return
 	}
 
-	if err := common.WriteResponse(w, http.StatusCreated, room); err != nil {
+	if err := common.WriteResponse(w, http.StatusCreated, NewRoomResponse(room, userID)); err != nil {
 		http.Error(w, "Failed to write response", http.StatusInternalServerError)
 		return
 	}
 }
 
 func (handler *Handler) GetRoom(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	roomID := common.GetParam(r, "roomID")
 	if roomID == "" {
 		http.Error(w, "Missing room ID", http.StatusBadRequest)
 		return
 	}
 
-	room, err := handler.service.GetRoom(r.Context(), roomID)
+	room, err := handler.service.ViewRoom(r.Context(), roomID, userID)
 	if err != nil {
 		http.Error(w, "Room not found", http.StatusNotFound)
 		return
 	}
 
-	if err := common.WriteResponse(w, http.StatusOK, room); err != nil {
+	if err := common.WriteResponse(w, http.StatusOK, NewRoomResponse(room, userID)); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (handler *Handler) UpdateRoom(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	roomID := common.GetParam(r, "roomID")
+	if roomID == "" {
+		http.Error(w, "Missing room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req UpdateRoomRequest
+	if err := common.BindRequest(r, &req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	ctx := log.WithFields(r.Context(), log.RoomID(roomID))
+	room, err := handler.service.UpdateRoom(ctx, roomID, userID, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			http.Error(w, "Room not found", http.StatusNotFound)
+		case errors.Is(err, ErrForbidden):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, ErrInvalidRoomCapacity), errors.Is(err, ErrInvalidVisibility), errors.Is(err, ErrCapacityBelowUsers):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			log.Ctx(ctx, handler.logger).Error("Update room failed", zap.Error(err))
+			http.Error(w, "Failed to update room", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := common.WriteResponse(w, http.StatusOK, NewRoomResponse(room, userID)); err != nil {
 		http.Error(w, "Failed to write response", http.StatusInternalServerError)
 		return
 	}
 }
 
 func (handler *Handler) DeleteRoom(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	roomID := common.GetParam(r, "roomID")
 	if roomID == "" {
 		http.Error(w, "Missing room ID", http.StatusBadRequest)
 		return
 	}
 
-	if err := handler.service.DeleteRoom(r.Context(), roomID); err != nil {
-		http.Error(w, "Failed to delete room", http.StatusInternalServerError)
+	ctx := log.WithFields(r.Context(), log.RoomID(roomID))
+	if err := handler.service.DeleteRoom(ctx, roomID, userID); err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			http.Error(w, "Room not found", http.StatusNotFound)
+		case errors.Is(err, ErrForbidden):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			log.Ctx(ctx, handler.logger).Error("Delete room failed", zap.Error(err))
+			http.Error(w, "Failed to delete room", http.StatusInternalServerError)
+		}
 		return
 	}
 
@@ -97,19 +204,31 @@ func (handler *Handler) DeleteRoom(w http.ResponseWriter, r *http.Request) {
 }
 
 func (handler *Handler) ListRooms(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	var req ListRoomRequest
 	if err := common.BindRequest(r, &req); err != nil {
 		http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	rooms, err := handler.service.ListRooms(r.Context())
+	rooms, err := handler.service.ListRooms(r.Context(), userID, req)
 	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) || errors.Is(err, repository.ErrInvalidSort) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Ctx(r.Context(), handler.logger).Error("List rooms failed", zap.Error(err))
 		http.Error(w, "Failed to list rooms", http.StatusInternalServerError)
 		return
 	}
 
-	if err := common.WriteResponse(w, http.StatusOK, rooms); err != nil {
+	if err := common.WriteResponse(w, http.StatusOK, NewRoomPageResponse(rooms, userID)); err != nil {
 		http.Error(w, "Failed to write response", http.StatusInternalServerError)
 		return
 	}
@@ -1,190 +1,591 @@
 package room
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
-	"sort"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-	
-	"vidcall/internal/common"
+
+	"vidcall/config"
+	"vidcall/internal/module/metrics"
+	"vidcall/pkg/log"
+	"vidcall/pkg/password"
 	"vidcall/pkg/repository"
 
 	"go.uber.org/fx"
+	"go.uber.org/zap"
 )
 
 var (
-	ErrRoomIsFull    = errors.New("room is full")
-	ErrRoomIsExpired = errors.New("room is expired")
-	ErrUserNotInRoom = errors.New("user not in room")
+	ErrRoomIsFull          = errors.New("room is full")
+	ErrRoomIsExpired       = errors.New("room is expired")
+	ErrUserNotInRoom       = errors.New("user not in room")
+	ErrUserAlreadyInRoom   = errors.New("user already in room")
+	ErrInvalidRoomCapacity = errors.New("invalid room capacity")
+	ErrInvalidVisibility   = errors.New("room visibility must be public or private")
+	ErrCapacityBelowUsers  = errors.New("room capacity is below the number of participants")
+	ErrForbidden           = errors.New("only the room owner or a moderator may do this")
+	ErrNotInvited          = errors.New("user is not invited to this room")
+	ErrInvalidPasscode     = errors.New("invalid room passcode")
+	ErrInvalidSchedule     = errors.New("room must end after it starts and in the future")
+	ErrRoomNotStarted      = errors.New("room has not started yet")
+	ErrShuttingDown        = errors.New("server is shutting down")
+	ErrInvalidMode         = errors.New("room mode must be mesh or sfu")
+	ErrSFUDisabled         = errors.New("sfu rooms are not enabled on this server")
 )
 
+// subscriberBuffer is how many undelivered events a participant may lag behind
+// before further events to it are dropped.
+const subscriberBuffer = 16
+
 type Service struct {
-	repo repository.Repository[string, Room]
+	// mu serialises read-modify-write cycles on rooms and access to their subscribers
+	mu      sync.Mutex
+	repo    repository.Repository[string, Room]
+	logger  *zap.Logger
+	metrics metrics.Recorder
+
+	// settings are the room section of the config, swapped on reload
+	settings atomic.Pointer[config.Room]
+
+	// durable is whether rooms outlive the process
+	durable bool
+	// sfuEnabled is whether rooms may be created in sfu mode
+	sfuEnabled bool
+	// draining is set once the server shuts down: no room is created and
+	// rooms emptied by the shutdown are kept for after the restart
+	draining atomic.Bool
+
+	// subscribers are the live event channels of the participants, keyed by
+	// room ID then user ID. They only exist in memory, whatever the storage.
+	subscribers map[string]map[string]chan Event
+
+	// deleteHooks are called with the ID of every deleted room
+	deleteHooks []func(ctx context.Context, roomID string)
 }
 
 type ServiceParams struct {
 	fx.In
 
+	Config     config.Config
+	Watcher    *config.Watcher
+	Logger     *zap.Logger
+	Metrics    metrics.Recorder
+	Store      *repository.Store
 	Repository repository.Repository[string, Room]
 }
 
 func NewService(params ServiceParams) *Service {
-	return &Service{
-		repo: params.Repository,
+	service := &Service{
+		repo:        params.Repository,
+		logger:      params.Logger,
+		metrics:     params.Metrics,
+		durable:     params.Store.IsDurable(),
+		sfuEnabled:  params.Config.SFU.Enabled,
+		subscribers: make(map[string]map[string]chan Event),
 	}
+
+	settings := params.Config.Room
+	service.settings.Store(&settings)
+	config.Subscribe(params.Watcher, func(c config.Config) config.Room { return c.Room }, func(settings config.Room) {
+		service.settings.Store(&settings)
+	})
+
+	return service
 }
 
-func (service *Service) CreateRoom(ctx context.Context, room Room) (Room, error) {
+func (service *Service) CreateRoom(ctx context.Context, room Room, passcode string) (Room, error) {
+	if service.draining.Load() {
+		return Room{}, ErrShuttingDown
+	}
+
+	if room.Capacity == 0 {
+		room.Capacity = service.settings.Load().DefaultCapacity
+	}
+	if err := service.checkCapacity(room.Capacity); err != nil {
+		return Room{}, err
+	}
+
+	if room.Visibility == "" {
+		room.Visibility = VisibilityPublic
+	}
+	if room.Visibility != VisibilityPublic && room.Visibility != VisibilityPrivate {
+		return Room{}, ErrInvalidVisibility
+	}
+
+	switch room.Mode {
+	case "", ModeMesh:
+		room.Mode = ModeMesh
+	case ModeSFU:
+		if !service.sfuEnabled {
+			return Room{}, ErrSFUDisabled
+		}
+	default:
+		return Room{}, ErrInvalidMode
+	}
+
+	if passcode != "" {
+		hash, err := password.Hash(passcode)
+		if err != nil {
+			return Room{}, fmt.Errorf("hash passcode: %w", err)
+		}
+		room.PasscodeHash = hash
+	}
+
 	room.CreatedAt = time.Now().Unix()
-	room.Subscribers = make(map[string]chan Event, 2)
-	return service.repo.Insert(ctx, room)
+	if room.EndsAt != nil {
+		if *room.EndsAt <= room.CreatedAt || (room.StartsAt != nil && *room.EndsAt <= *room.StartsAt) {
+			return Room{}, ErrInvalidSchedule
+		}
+		room.ExpiredAt = room.EndsAt
+	}
+	room.CallState = CallStateIdle
+	room.Participants = make([]Participant, 0, room.Capacity)
+	room, err := service.repo.Insert(ctx, room)
+	if err != nil {
+		return Room{}, err
+	}
+
+	log.Ctx(ctx, service.logger).Info("Room created", zap.Int("capacity", room.Capacity), zap.String("visibility", string(room.Visibility)), zap.String("mode", string(room.Mode)))
+	return room, nil
 }
 
 func (service *Service) GetRoom(ctx context.Context, id string) (Room, error) {
 	return service.repo.Find(ctx, id)
 }
 
-func (service *Service) DeleteRoom(ctx context.Context, id string) error {
-	room, err := service.GetRoom(ctx, id)
+// ViewRoom returns the room as seen by userID; private rooms are reported as
+// not found to anyone who is not a member.
+func (service *Service) ViewRoom(ctx context.Context, id, userID string) (Room, error) {
+	room, err := service.repo.Find(ctx, id)
 	if err != nil {
-		return err
+		return Room{}, err
+	}
+
+	if !room.CanView(userID) {
+		return Room{}, repository.ErrNotFound
 	}
 
-	// Close the signal channel if it exists and have not been closed yet
-	eventRoomDeleted := Event{EventName: EventRoomDeleted}
-	for _, subscriber := range room.Subscribers {
-		if subscriber != nil {
-			if _, ok := <-subscriber; ok {
-				subscriber <- eventRoomDeleted
-				close(subscriber)
+	return room, nil
+}
+
+// UpdateRoom applies the set fields of req. Only the owner may change the
+// moderators.
+func (service *Service) UpdateRoom(ctx context.Context, id, userID string, req UpdateRoomRequest) (Room, error) {
+	var passcodeHash *string
+	if req.Passcode != nil {
+		hash := ""
+		if *req.Passcode != "" {
+			var err error
+			if hash, err = password.Hash(*req.Passcode); err != nil {
+				return Room{}, fmt.Errorf("hash passcode: %w", err)
 			}
 		}
+		passcodeHash = &hash
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	room, err := service.repo.Find(ctx, id)
+	if err != nil {
+		return Room{}, err
+	}
+
+	if !room.CanManage(userID) || (req.Moderators != nil && room.CreatedBy != userID) {
+		return Room{}, ErrForbidden
+	}
+
+	if req.Name != nil {
+		room.Name = *req.Name
+	}
+	if req.Description != nil {
+		room.Description = *req.Description
+	}
+	if req.Capacity != nil {
+		if err := service.checkCapacity(*req.Capacity); err != nil {
+			return Room{}, err
+		}
+		if *req.Capacity < len(room.Participants) {
+			return Room{}, ErrCapacityBelowUsers
+		}
+		room.Capacity = *req.Capacity
+	}
+	if req.Visibility != nil {
+		if *req.Visibility != VisibilityPublic && *req.Visibility != VisibilityPrivate {
+			return Room{}, ErrInvalidVisibility
+		}
+		room.Visibility = *req.Visibility
+	}
+	if passcodeHash != nil {
+		room.PasscodeHash = *passcodeHash
+	}
+	if req.Invited != nil {
+		room.Invited = *req.Invited
+	}
+	if req.Moderators != nil {
+		room.Moderators = *req.Moderators
 	}
 
-	return service.repo.Delete(ctx, id)
+	return service.repo.Update(ctx, room)
 }
 
-func (service *Service) ListRooms(ctx context.Context) ([]Room, error) {
-	rooms, err := service.repo.FindList(ctx)
+// Events returns the channel on which the participant receives room events.
+// It is closed when the participant leaves or the room is deleted.
+func (service *Service) Events(ctx context.Context, roomID, userID string) (<-chan Event, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	room, err := service.repo.Find(ctx, roomID)
 	if err != nil {
 		return nil, err
 	}
 
-	availableRooms := make([]Room, 0)
-	for _, room := range rooms {
-		if !room.IsExpired() {
-			availableRooms = append(availableRooms, room)
-			continue
+	subscriber, ok := service.subscribers[room.ID][userID]
+	if !ok {
+		return nil, ErrUserNotInRoom
+	}
+
+	return subscriber, nil
+}
+
+// DeleteRoom deletes the room on behalf of userID, who must manage it.
+func (service *Service) DeleteRoom(ctx context.Context, id, userID string) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	room, err := service.repo.Find(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if !room.CanManage(userID) {
+		return ErrForbidden
+	}
+
+	return service.deleteRoom(ctx, id)
+}
+
+func (service *Service) deleteRoom(ctx context.Context, id string) error {
+	room, err := service.repo.Find(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// Tell every participant and close their channel; subscribers are removed
+	// from the map on leave, so each channel is closed exactly once
+	service.publish(room.ID, Event{EventName: EventRoomDeleted}, "")
+	for _, subscriber := range service.subscribers[room.ID] {
+		close(subscriber)
+	}
+	delete(service.subscribers, room.ID)
+
+	if err := service.repo.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	for _, hook := range service.deleteHooks {
+		hook(ctx, id)
+	}
+
+	log.Ctx(ctx, service.logger).Info("Room deleted", zap.Int("participants", len(room.Participants)))
+	return nil
+}
+
+// OnDelete registers hook to be called whenever a room is deleted, by its
+// managers or on expiry. Hooks run under the lock of the service and must
+// not call back into it.
+func (service *Service) OnDelete(hook func(ctx context.Context, roomID string)) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	service.deleteHooks = append(service.deleteHooks, hook)
+}
+
+// roomSortFields are the fields GET /rooms may sort on.
+var roomSortFields = map[string]func(a, b Room) int{
+	"created_at": func(a, b Room) int { return cmp.Compare(a.CreatedAt, b.CreatedAt) },
+	"name":       func(a, b Room) int { return strings.Compare(a.Name, b.Name) },
+	"participants": func(a, b Room) int {
+		return cmp.Compare(len(a.Participants), len(b.Participants))
+	},
+}
+
+// ListRooms returns one page of the rooms visible to viewerID, oldest first
+// unless req says otherwise.
+func (service *Service) ListRooms(ctx context.Context, viewerID string, req ListRoomRequest) (repository.Page[Room], error) {
+	sortKeys, err := repository.ParseSort(cmp.Or(req.Sort, "created_at"), roomSortFields)
+	if err != nil {
+		return repository.Page[Room]{}, err
+	}
+
+	query := repository.Query[Room]{
+		Where: []repository.Predicate[Room]{
+			func(room Room) bool { return !room.IsExpired() && room.CanView(viewerID) },
+		},
+		Sort:   sortKeys,
+		Cursor: req.Cursor,
+		Limit:  repository.PageSize(req.Limit),
+	}
+	if req.OwnerID != "" {
+		query.Where = append(query.Where, func(room Room) bool { return room.CreatedBy == req.OwnerID })
+	}
+
+	return service.repo.FindPage(ctx, query)
+}
+
+// SweepExpired deletes the rooms whose expiry grace period is over and
+// returns how many were deleted.
+func (service *Service) SweepExpired(ctx context.Context) (int, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	expired, err := service.repo.FindPage(ctx, repository.Query[Room]{
+		Where: []repository.Predicate[Room]{Room.ShouldDelete},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, room := range expired.Items {
+		if err := service.deleteRoom(log.WithFields(ctx, log.RoomID(room.ID)), room.ID); err != nil {
+			return i, fmt.Errorf("delete expired room %s: %w", room.ID, err)
+		}
+	}
+
+	return len(expired.Items), nil
+}
+
+// CloseOrphanSubscribers closes the event channels left behind for rooms that
+// no longer exist or users that are no longer in them, and returns how many
+// were closed.
+func (service *Service) CloseOrphanSubscribers(ctx context.Context) (int, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	closed := 0
+	for roomID, subscribers := range service.subscribers {
+		room, err := service.repo.Find(ctx, roomID)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			return closed, err
 		}
 
-		if room.ShouldDelete() {
-			if err := service.DeleteRoom(ctx, room.ID); err != nil {
-				return nil, fmt.Errorf("delete expired room %s: %w", room.ID, err)
+		for userID, subscriber := range subscribers {
+			if err == nil && room.HasUser(userID) {
+				continue
 			}
+
+			close(subscriber)
+			delete(subscribers, userID)
+			closed++
+		}
+
+		if len(subscribers) == 0 {
+			delete(service.subscribers, roomID)
 		}
 	}
 
-	// Sort rooms by CreatedAt ascending
-	sort.Slice(availableRooms, func(i, j int) bool {
-		return availableRooms[i].CreatedAt < availableRooms[j].CreatedAt
+	return closed, nil
+}
+
+// WarnExpiring sends room_expiring to the participants of every room whose
+// scheduled end is less than the configured warning away, once per room, and
+// returns how many rooms were warned.
+func (service *Service) WarnExpiring(ctx context.Context) (int, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	within := service.settings.Load().ExpiryWarning
+	now := time.Now()
+	expiring, err := service.repo.FindPage(ctx, repository.Query[Room]{
+		Where: []repository.Predicate[Room]{
+			func(room Room) bool {
+				return room.EndsAt != nil && !room.ExpiryWarned && len(room.Participants) > 0 &&
+					*room.EndsAt > now.Unix() && *room.EndsAt <= now.Add(within).Unix()
+			},
+		},
 	})
+	if err != nil {
+		return 0, err
+	}
 
-	return availableRooms, nil
+	for i, room := range expiring.Items {
+		service.publish(room.ID, Event{EventName: EventExpiring, Data: *room.EndsAt}, "")
+		room.ExpiryWarned = true
+		if _, err := service.repo.Update(ctx, room); err != nil {
+			return i, err
+		}
+	}
+
+	return len(expiring.Items), nil
 }
 
-func (service *Service) ListOwnRooms(ctx context.Context, ownerID string) ([]Room, error) {
-	rooms, err := service.ListRooms(ctx)
+// EndOverdue tells the participants of every room past its scheduled end that
+// the meeting is over and returns how many rooms were ended. Their sessions
+// then leave the room as usual.
+func (service *Service) EndOverdue(ctx context.Context) (int, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	now := time.Now().Unix()
+	overdue, err := service.repo.FindPage(ctx, repository.Query[Room]{
+		Where: []repository.Predicate[Room]{
+			func(room Room) bool {
+				return room.EndsAt != nil && *room.EndsAt <= now && len(room.Participants) > 0
+			},
+		},
+	})
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	if ownerID == "" {
-		return rooms, nil
+	for _, room := range overdue.Items {
+		service.publish(room.ID, Event{EventName: EventRoomEnded}, "")
+		service.logger.Info("Room reached its scheduled end", log.RoomID(room.ID), zap.Int("participants", len(room.Participants)))
 	}
 
-	ownRooms := make([]Room, 0)
-	for _, room := range rooms {
-		if room.CreatedBy == ownerID {
-			ownRooms = append(ownRooms, room)
-		}
+	return len(overdue.Items), nil
+}
+
+func (service *Service) JoinRoom(ctx context.Context, roomID, userID, passcode string) (Room, error) {
+	// Passcode hashing is slow, so the passcode is verified before taking the
+	// lock. Access is decided on the room loaded under it, which an update may
+	// have changed meanwhile.
+	checked, err := service.repo.Find(ctx, roomID)
+	if err != nil {
+		return Room{}, err
+	}
+	if err := authorizeJoin(checked, userID, passcode, ""); err != nil {
+		return Room{}, err
+	}
+	var verifiedHash string
+	if !checked.CanManage(userID) {
+		verifiedHash = checked.PasscodeHash
 	}
 
-	return ownRooms, nil
-}
+	service.mu.Lock()
+	defer service.mu.Unlock()
 
-func (service *Service) JoinRoom(ctx context.Context, roomID, userID string) (Room, error) {
 	room, err := service.repo.Find(ctx, roomID)
 	if err != nil {
 		return Room{}, err
 	}
 
+	if err := authorizeJoin(room, userID, passcode, verifiedHash); err != nil {
+		return Room{}, err
+	}
+
 	if room.ShouldDelete() {
-		if err := service.DeleteRoom(ctx, roomID); err != nil {
+		if err := service.deleteRoom(ctx, roomID); err != nil {
 			return Room{}, fmt.Errorf("delete expired room: %w", err)
 		}
 
 		return Room{}, ErrRoomIsExpired
 	}
 
+	now := time.Now()
+	if room.IsExpired() {
+		return Room{}, ErrRoomIsExpired
+	}
+
+	if !room.HasStarted(now) {
+		return Room{}, ErrRoomNotStarted
+	}
+
+	if room.HasUser(userID) {
+		return Room{}, ErrUserAlreadyInRoom
+	}
+
 	if room.IsFull() {
 		return Room{}, ErrRoomIsFull
 	}
 
-	// Add user to the room if there's an empty slot
-	if room.Users[0] == nil {
-		room.Users[0] = common.Pointer(userID)
-	} else if room.Users[1] == nil {
-		room.Users[1] = common.Pointer(userID)
-	}
+	room.Participants = append(room.Participants, Participant{
+		UserID:   userID,
+		JoinedAt: now.Unix(),
+	})
 
-	room.Subscribers[userID] = make(chan Event, 5) // Buffered channel to avoid blocking
+	// Someone is back, so the countdown started by the last leave is off
+	room.ExpiredAt = room.EndsAt
 
 	// emit event to subscribers that a new user has joined
-	for id, subscriber := range room.Subscribers {
-		if id != userID {
-			subscriber <- Event{
-				EventName: EventNewComer,
-				Data:      userID,
-			}
-		}
+	service.publish(room.ID, Event{EventName: EventNewComer, Data: userID}, userID)
+	if service.subscribers[room.ID] == nil {
+		service.subscribers[room.ID] = make(map[string]chan Event, room.Capacity)
 	}
+	service.subscribers[room.ID][userID] = make(chan Event, subscriberBuffer)
+	service.transitionCall(&room, CallSignalJoin)
 
 	room, err = service.repo.Update(ctx, room)
 	if err != nil {
 		return Room{}, err
 	}
 
+	service.metrics.RoomJoined()
+	log.Ctx(ctx, service.logger).Info("User joined room", zap.Int("participants", len(room.Participants)))
 	return room, nil
 }
 
+// LeaveRoom removes userID from the room, tells the others and moves the call
+// on, even while the server drains.
 func (service *Service) LeaveRoom(ctx context.Context, roomID, userID string) error {
+	return service.leaveRoom(ctx, roomID, userID, false)
+}
+
+// Disconnect is LeaveRoom for a session the shutdown closed. A durable store
+// keeps the participant listed, for ResetSessions to pick up after the
+// restart.
+func (service *Service) Disconnect(ctx context.Context, roomID, userID string) error {
+	return service.leaveRoom(ctx, roomID, userID, service.draining.Load() && service.durable)
+}
+
+func (service *Service) leaveRoom(ctx context.Context, roomID, userID string, keep bool) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
 	room, err := service.repo.Find(ctx, roomID)
 	if err != nil {
 		return err
 	}
 
-	// Remove user from the room
-	if common.PointerVal(room.Users[0]) == userID {
-		room.Users[0] = nil
-	} else if common.PointerVal(room.Users[1]) == userID {
-		room.Users[1] = nil
-	} else {
+	// Remove user from the room, keeping the join order of the others
+	index := room.indexOf(userID)
+	if index < 0 {
 		return ErrUserNotInRoom
 	}
+	if subscriber, ok := service.subscribers[room.ID][userID]; ok {
+		close(subscriber)
+		delete(service.subscribers[room.ID], userID)
+		if len(service.subscribers[room.ID]) == 0 {
+			delete(service.subscribers, room.ID)
+		}
+	}
+
+	if keep {
+		log.Ctx(ctx, service.logger).Info("User disconnected by shutdown")
+		return nil
+	}
+
+	room.Participants = slices.Delete(room.Participants, index, index+1)
+	service.metrics.RoomLeft()
+	log.Ctx(ctx, service.logger).Info("User left room", zap.Int("participants", len(room.Participants)))
 
 	// emit to subscribers that a user has left
-	for id, subscriber := range room.Subscribers {
-		if id != userID {
-			subscriber <- Event{
-				EventName: EventLeaveRoom,
-				Data:      userID,
-			}
-		}
+	service.publish(room.ID, Event{EventName: EventLeaveRoom, Data: userID}, userID)
+	service.transitionCall(&room, CallSignalLeave)
+
+	// The last one out starts the countdown to expiry
+	if len(room.Participants) == 0 {
+		room.ExpiredAt = service.graceExpiry(room)
 	}
 
 	if room.ShouldDelete() {
-		if err := service.DeleteRoom(ctx, roomID); err != nil {
+		if err := service.deleteRoom(ctx, roomID); err != nil {
 			return fmt.Errorf("delete expired room: %w", err)
 		}
 
@@ -197,3 +598,177 @@ func (service *Service) LeaveRoom(ctx context.Context, roomID, userID string) er
 
 	return nil
 }
+
+// graceExpiry is when the room expires if nobody joins it within the grace
+// period, never past its scheduled end.
+func (service *Service) graceExpiry(room Room) *int64 {
+	expiredAt := time.Now().Add(service.settings.Load().EmptyGracePeriod).Unix()
+	if room.EndsAt != nil {
+		expiredAt = min(expiredAt, *room.EndsAt)
+	}
+	return &expiredAt
+}
+
+// Drain stops room creation for the rest of the process lifetime. From then
+// on, Disconnect keeps the participants of the sessions the shutdown closes
+// in a durable store.
+func (service *Service) Drain(ctx context.Context) {
+	service.draining.Store(true)
+
+	if !service.durable {
+		service.logger.Warn("Storage is not durable, rooms are lost on shutdown")
+		return
+	}
+
+	rooms, err := service.repo.FindList(ctx)
+	if err != nil {
+		service.logger.Error("Count rooms failed", zap.Error(err))
+		return
+	}
+	service.logger.Info("Keeping rooms in durable storage for after the restart", zap.Int("rooms", len(rooms)))
+}
+
+// CountRoomsByState returns how many rooms are in each call state.
+func (service *Service) CountRoomsByState(ctx context.Context) (map[string]int, error) {
+	rooms, err := service.repo.FindList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, room := range rooms {
+		counts[string(room.CallState)]++
+	}
+	return counts, nil
+}
+
+func (service *Service) checkCapacity(capacity int) error {
+	maxCapacity := service.settings.Load().MaxCapacity
+	if capacity < config.MinRoomCapacity || capacity > maxCapacity {
+		return fmt.Errorf("%w: must be between %d and %d", ErrInvalidRoomCapacity, config.MinRoomCapacity, maxCapacity)
+	}
+	return nil
+}
+
+// authorizeJoin checks that userID may join room with passcode, which is
+// known to match verifiedHash.
+func authorizeJoin(room Room, userID, passcode, verifiedHash string) error {
+	if room.CanManage(userID) {
+		return nil
+	}
+
+	if room.IsRestricted() && !slices.Contains(room.Invited, userID) {
+		return ErrNotInvited
+	}
+
+	if room.PasscodeHash != "" && room.PasscodeHash != verifiedHash && !password.Verify(room.PasscodeHash, passcode) {
+		return ErrInvalidPasscode
+	}
+
+	return nil
+}
+
+// ResetSessions empties the participant list of every stored room. No
+// WebSocket session survives a restart, so whoever a durable store still
+// lists as joined is gone. The rooms it empties start their grace period, so
+// that their participants have time to come back.
+func (service *Service) ResetSessions(ctx context.Context) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	rooms, err := service.repo.FindList(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, room := range rooms {
+		if len(room.Participants) == 0 && room.CallState == CallStateIdle {
+			continue
+		}
+
+		if len(room.Participants) > 0 {
+			room.ExpiredAt = service.graceExpiry(room)
+		}
+		room.Participants = []Participant{}
+		room.CallState = CallStateIdle
+		if _, err := service.repo.Update(ctx, room); err != nil {
+			return fmt.Errorf("reset room %s: %w", room.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// AdvanceCall moves the call state of the room on a relayed signaling step.
+func (service *Service) AdvanceCall(ctx context.Context, roomID string, signal CallSignal) (CallState, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	room, err := service.repo.Find(ctx, roomID)
+	if err != nil {
+		return "", err
+	}
+
+	if !service.transitionCall(&room, signal) {
+		return room.CallState, nil
+	}
+
+	if _, err := service.repo.Update(ctx, room); err != nil {
+		return "", err
+	}
+
+	return room.CallState, nil
+}
+
+// UpdateMedia applies change to the media state of a participant.
+func (service *Service) UpdateMedia(ctx context.Context, roomID, userID string, change func(*MediaState)) (MediaState, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	room, err := service.repo.Find(ctx, roomID)
+	if err != nil {
+		return MediaState{}, err
+	}
+
+	index := room.indexOf(userID)
+	if index < 0 {
+		return MediaState{}, ErrUserNotInRoom
+	}
+
+	change(&room.Participants[index].Media)
+	if _, err := service.repo.Update(ctx, room); err != nil {
+		return MediaState{}, err
+	}
+
+	return room.Participants[index].Media, nil
+}
+
+// transitionCall applies signal to the call state of room and tells every
+// participant when it changed. It reports whether the state changed; the
+// caller persists the room.
+func (service *Service) transitionCall(room *Room, signal CallSignal) bool {
+	next := room.CallState.Next(signal, len(room.Participants))
+	if next == room.CallState {
+		return false
+	}
+
+	room.CallState = next
+	service.publish(room.ID, Event{EventName: EventCallState, Data: next}, "")
+	return true
+}
+
+// publish delivers event to every subscriber of the room except the given
+// user. It never blocks: a subscriber that has fallen subscriberBuffer events
+// behind misses the event rather than stalling the whole room.
+func (service *Service) publish(roomID string, event Event, exceptUserID string) {
+	for id, subscriber := range service.subscribers[roomID] {
+		if id == exceptUserID {
+			continue
+		}
+
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
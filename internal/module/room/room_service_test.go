@@ -0,0 +1,221 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"vidcall/config"
+	"vidcall/internal/module/metrics"
+	"vidcall/pkg/password"
+	"vidcall/pkg/repository"
+
+	"go.uber.org/zap"
+)
+
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+
+	return NewService(ServiceParams{
+		Config:     config.Default(),
+		Watcher:    &config.Watcher{},
+		Logger:     zap.NewNop(),
+		Metrics:    metrics.Nop{},
+		Store:      &repository.Store{},
+		Repository: repository.NewSyncRepository[string, Room](),
+	})
+}
+
+// startCall creates a room where alice and bob are connected.
+func startCall(t *testing.T, service *Service) Room {
+	t.Helper()
+	ctx := context.Background()
+
+	room, err := service.CreateRoom(ctx, Room{ID: "room", Name: "call", CreatedBy: "alice"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []string{"alice", "bob"} {
+		if _, err := service.JoinRoom(ctx, room.ID, userID, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, signal := range []CallSignal{CallSignalOffer, CallSignalAnswer} {
+		if _, err := service.AdvanceCall(ctx, room.ID, signal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return room
+}
+
+// drainEvents returns the events already delivered to a subscriber.
+func drainEvents(events <-chan Event) []Event {
+	var delivered []Event
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return delivered
+			}
+			delivered = append(delivered, event)
+		default:
+			return delivered
+		}
+	}
+}
+
+func TestLeaveRoomWhileDraining(t *testing.T) {
+	for _, durable := range []bool{false, true} {
+		service := newTestService(t)
+		service.durable = durable
+		ctx := context.Background()
+
+		room := startCall(t, service)
+		events, err := service.Events(ctx, room.ID, "bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		drainEvents(events)
+
+		service.Drain(ctx)
+		if err := service.LeaveRoom(ctx, room.ID, "alice"); err != nil {
+			t.Fatal(err)
+		}
+
+		left, err := service.GetRoom(ctx, room.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if left.HasUser("alice") || left.CallState != CallStateEnded {
+			t.Errorf("durable %v: hangup kept %v in a %s call", durable, left.Participants, left.CallState)
+		}
+
+		var leaves, ended int
+		for _, event := range drainEvents(events) {
+			if userID, ok := event.LeaveRoom(); ok && userID == "alice" {
+				leaves++
+			}
+			if event.EventName == EventCallState && event.Data == CallStateEnded {
+				ended++
+			}
+		}
+		if leaves != 1 || ended != 1 {
+			t.Errorf("durable %v: bob got %d leaves and %d call ends, want 1 of each", durable, leaves, ended)
+		}
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		durable  bool
+		draining bool
+		kept     bool
+	}{
+		{name: "memory store"},
+		{name: "memory store while draining", draining: true},
+		{name: "durable store", durable: true},
+		{name: "durable store while draining", durable: true, draining: true, kept: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := newTestService(t)
+			service.durable = test.durable
+			ctx := context.Background()
+
+			room := startCall(t, service)
+			if test.draining {
+				service.Drain(ctx)
+			}
+			if err := service.Disconnect(ctx, room.ID, "alice"); err != nil {
+				t.Fatal(err)
+			}
+
+			disconnected, err := service.GetRoom(ctx, room.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if disconnected.HasUser("alice") != test.kept {
+				t.Errorf("participants %v, alice kept: %v", disconnected.Participants, test.kept)
+			}
+		})
+	}
+}
+
+func TestAuthorizeJoin(t *testing.T) {
+	oldHash, err := password.Hash("old passcode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newHash, err := password.Hash("new passcode")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		room         Room
+		userID       string
+		passcode     string
+		verifiedHash string
+		want         error
+	}{
+		{name: "owner", room: Room{CreatedBy: "alice", Visibility: VisibilityPrivate, PasscodeHash: newHash}, userID: "alice"},
+		{name: "not invited", room: Room{CreatedBy: "alice", Visibility: VisibilityPrivate}, userID: "bob", want: ErrNotInvited},
+		{name: "invited", room: Room{CreatedBy: "alice", Visibility: VisibilityPrivate, Invited: []string{"bob"}}, userID: "bob"},
+		{name: "passcode", room: Room{CreatedBy: "alice", PasscodeHash: newHash}, userID: "bob", passcode: "new passcode"},
+		{name: "wrong passcode", room: Room{CreatedBy: "alice", PasscodeHash: newHash}, userID: "bob", passcode: "old passcode", want: ErrInvalidPasscode},
+		{
+			// not hashed again
+			name:         "passcode already verified",
+			room:         Room{CreatedBy: "alice", PasscodeHash: newHash},
+			userID:       "bob",
+			verifiedHash: newHash,
+		},
+		{
+			name:         "passcode changed since it was verified",
+			room:         Room{CreatedBy: "alice", PasscodeHash: newHash},
+			userID:       "bob",
+			passcode:     "old passcode",
+			verifiedHash: oldHash,
+			want:         ErrInvalidPasscode,
+		},
+		{
+			name:         "uninvited since the check",
+			room:         Room{CreatedBy: "alice", Visibility: VisibilityPrivate, Invited: []string{"carol"}},
+			userID:       "bob",
+			verifiedHash: newHash,
+			want:         ErrNotInvited,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := authorizeJoin(test.room, test.userID, test.passcode, test.verifiedHash); !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestNewRoomResponse(t *testing.T) {
+	room := Room{
+		CreatedBy:    "alice",
+		PasscodeHash: "hash",
+		Invited:      []string{"bob", "carol"},
+		Moderators:   []string{"dave"},
+	}
+
+	for _, viewerID := range []string{"alice", "dave", "bob", "eve"} {
+		response := NewRoomResponse(room, viewerID)
+		if response.PasscodeHash != "" || !response.HasPasscode {
+			t.Errorf("%s: passcode hash %q, has passcode %v", viewerID, response.PasscodeHash, response.HasPasscode)
+		}
+
+		manages := viewerID == "alice" || viewerID == "dave"
+		if shown := response.Invited != nil || response.Moderators != nil; shown != manages {
+			t.Errorf("%s sees invited %v and moderators %v", viewerID, response.Invited, response.Moderators)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package rtc
+
+import (
+	"net/http"
+	"time"
+
+	"vidcall/internal/common"
+
+	"go.uber.org/fx"
+)
+
+type ICEHandler struct {
+	service *ICEService
+}
+
+type ICEHandlerParams struct {
+	fx.In
+
+	Service *ICEService
+}
+
+func NewICEHandler(params ICEHandlerParams) *ICEHandler {
+	return &ICEHandler{
+		service: params.Service,
+	}
+}
+
+// GetICEServers returns the RTCPeerConnection configuration of the caller.
+// The response must not be cached past its expiry.
+func (handler *ICEHandler) GetICEServers(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	servers, expiresAt := handler.service.ICEServers(userID, r.Host, time.Now())
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := common.WriteResponse(w, http.StatusOK, ICEServersResponse{
+		ICEServers: servers,
+		ExpiresAt:  expiresAt.Unix(),
+	}); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+		return
+	}
+}
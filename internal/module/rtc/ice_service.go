@@ -0,0 +1,95 @@
+package rtc
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"vidcall/config"
+
+	"go.uber.org/fx"
+)
+
+// ICEService hands out the STUN and TURN servers clients connect their peers
+// through.
+type ICEService struct {
+	// settings are the rtc section of the config, swapped on reload
+	settings atomic.Pointer[config.RTC]
+	// stun is the embedded STUN server, which is only read at startup
+	stun config.STUN
+}
+
+type ICEServiceParams struct {
+	fx.In
+
+	Config  config.Config
+	Watcher *config.Watcher
+}
+
+func NewICEService(params ICEServiceParams) *ICEService {
+	service := &ICEService{stun: params.Config.STUN}
+
+	settings := params.Config.RTC
+	service.settings.Store(&settings)
+	config.Subscribe(params.Watcher, func(c config.Config) config.RTC { return c.RTC }, func(settings config.RTC) {
+		service.settings.Store(&settings)
+	})
+
+	return service
+}
+
+// ICEServers returns the servers for userID, who reached this server on host.
+// The embedded STUN server comes first when it runs. Servers with a shared
+// secret get credentials that expire at the returned time, as coturn expects
+// them with use-auth-secret: the username is the expiry in unix seconds and
+// the user ID, the credential the base64 HMAC-SHA1 of the username keyed with
+// the secret.
+func (service *ICEService) ICEServers(userID, host string, now time.Time) ([]ICEServer, time.Time) {
+	settings := service.settings.Load()
+	expiresAt := now.Add(settings.CredentialTTL).Truncate(time.Second)
+
+	servers := make([]ICEServer, 0, len(settings.ICEServers)+1)
+	if service.stun.Enabled {
+		servers = append(servers, ICEServer{URLs: []string{"stun:" + service.stunAddr(host)}})
+	}
+	for _, server := range settings.ICEServers {
+		iceServer := ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: string(server.Credential),
+		}
+		if server.SharedSecret != "" {
+			iceServer.Username, iceServer.Credential = turnCredential(server.SharedSecret, userID, expiresAt)
+		}
+		servers = append(servers, iceServer)
+	}
+
+	return servers, expiresAt
+}
+
+// stunAddr is where clients reach the embedded STUN server: the advertised
+// address, or else the host they reached this server on.
+func (service *ICEService) stunAddr(host string) string {
+	if service.stun.Advertise != "" {
+		return service.stun.Advertise
+	}
+
+	// validated as a host:port at startup
+	_, port, _ := net.SplitHostPort(service.stun.Listen)
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func turnCredential(secret config.Secret, userID string, expiresAt time.Time) (username, credential string) {
+	username = strconv.FormatInt(expiresAt.Unix(), 10) + ":" + userID
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
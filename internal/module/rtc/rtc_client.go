@@ -1 +1,630 @@
 package rtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"vidcall/config"
+	"vidcall/pkg/log"
+	"vidcall/pkg/media"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// keyframeInterval is how often publishers are asked for a keyframe.
+const keyframeInterval = 3 * time.Second
+
+var errPeerClosed = errors.New("sfu: peer closed")
+
+// SFU terminates the peer connection of every participant of the sfu rooms
+// and forwards the RTP of each published track to the other participants of
+// the room, unchanged.
+type SFU struct {
+	api        *webrtc.API
+	iceServers []webrtc.ICEServer
+	logger     *zap.Logger
+
+	mu    sync.Mutex
+	rooms map[string]*sfuRoom
+}
+
+type SFUParams struct {
+	fx.In
+
+	Config config.Config
+	Logger *zap.Logger
+}
+
+func NewSFU(params SFUParams) (*SFU, error) {
+	cfg := params.Config.SFU
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, fmt.Errorf("sfu: register codecs: %w", err)
+	}
+
+	// NACK, RTCP reports and TWCC, as a browser would do
+	interceptors := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptors); err != nil {
+		return nil, fmt.Errorf("sfu: register interceptors: %w", err)
+	}
+
+	settings := webrtc.SettingEngine{}
+	if cfg.PortMin != 0 {
+		if err := settings.SetEphemeralUDPPortRange(uint16(cfg.PortMin), uint16(cfg.PortMax)); err != nil {
+			return nil, fmt.Errorf("sfu: port range: %w", err)
+		}
+	}
+	if len(cfg.PublicIPs) > 0 {
+		settings.SetNAT1To1IPs(cfg.PublicIPs, webrtc.ICECandidateTypeHost)
+	}
+
+	// The server only needs STUN to find its own public address; TURN
+	// credentials are issued to browsers
+	var iceServers []webrtc.ICEServer
+	for _, server := range params.Config.RTC.ICEServers {
+		for _, url := range server.URLs {
+			if strings.HasPrefix(url, "stun:") || strings.HasPrefix(url, "stuns:") {
+				iceServers = append(iceServers, webrtc.ICEServer{URLs: []string{url}})
+			}
+		}
+	}
+
+	return &SFU{
+		api: webrtc.NewAPI(
+			webrtc.WithMediaEngine(mediaEngine),
+			webrtc.WithInterceptorRegistry(interceptors),
+			webrtc.WithSettingEngine(settings),
+		),
+		iceServers: iceServers,
+		logger:     params.Logger,
+		rooms:      make(map[string]*sfuRoom),
+	}, nil
+}
+
+// Join connects userID to the room, sending what the server signals to it
+// through signal, and offers it the tracks already published in the room.
+func (sfu *SFU) Join(ctx context.Context, roomID, userID string, signal func(WebSocketMessage) error) (*SFUPeer, error) {
+	pc, err := sfu.api.NewPeerConnection(webrtc.Configuration{ICEServers: sfu.iceServers})
+	if err != nil {
+		return nil, fmt.Errorf("sfu: create peer connection: %w", err)
+	}
+
+	// Room for the participant to publish a camera and a microphone without
+	// offering first
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			_ = pc.Close()
+			return nil, fmt.Errorf("sfu: add %s transceiver: %w", kind, err)
+		}
+	}
+
+	peer := &SFUPeer{
+		sfu:     sfu,
+		userID:  userID,
+		pc:      pc,
+		signal:  signal,
+		senders: make(map[string]*webrtc.RTPSender),
+		logger:  log.Ctx(ctx, sfu.logger),
+	}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		// nil ends gathering, which trickle ICE does not need to announce
+		if candidate == nil {
+			return
+		}
+		init := candidate.ToJSON()
+		data := ICECandidateData{Candidate: init.Candidate}
+		if init.SDPMid != nil {
+			data.SDPMid = *init.SDPMid
+		}
+		if init.SDPMLineIndex != nil {
+			data.SDPMLineIndex = *init.SDPMLineIndex
+		}
+		if err := peer.send(EventCandidate, data); err != nil {
+			peer.logger.Debug("Send SFU candidate failed", zap.Error(err))
+		}
+	})
+	pc.OnTrack(peer.publish)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		peer.logger.Debug("SFU connection state changed", zap.Stringer("state", state))
+	})
+
+	sfu.mu.Lock()
+	room := sfu.room(roomID)
+	peer.room = room
+	room.mu.Lock()
+	room.peers[userID] = peer
+	room.mu.Unlock()
+	sfu.mu.Unlock()
+
+	// The others get nothing new until the participant publishes, but the
+	// participant is offered even an empty room to have somewhere to publish
+	_, tracks := room.snapshot()
+	peer.syncTracks(tracks)
+	peer.negotiate()
+	return peer, nil
+}
+
+// Tap hands the tracks published in the room, now and until the returned
+// function is called, to tap. The room does not need to have participants
+// yet. Writers are closed when their track ends or the tap is removed, which
+// reports the errors of closing them.
+func (sfu *SFU) Tap(roomID string, tap Tap) (func() error, error) {
+	entry := &roomTap{open: tap}
+
+	sfu.mu.Lock()
+	room := sfu.room(roomID)
+	room.mu.Lock()
+	room.taps[entry] = struct{}{}
+	room.mu.Unlock()
+	sfu.mu.Unlock()
+
+	_, tracks := room.snapshot()
+	for _, track := range tracks {
+		track.attach(entry)
+	}
+
+	var once sync.Once
+	return func() error {
+		var errs []error
+		once.Do(func() {
+			room.mu.Lock()
+			delete(room.taps, entry)
+			room.mu.Unlock()
+
+			_, tracks := room.snapshot()
+			for _, track := range tracks {
+				errs = append(errs, track.detach(entry))
+			}
+			sfu.leave(room)
+		})
+		return errors.Join(errs...)
+	}, nil
+}
+
+// room returns the room, creating it when it is not live. sfu.mu must be held.
+func (sfu *SFU) room(roomID string) *sfuRoom {
+	room, ok := sfu.rooms[roomID]
+	if !ok {
+		room = &sfuRoom{
+			id:     roomID,
+			peers:  make(map[string]*SFUPeer),
+			tracks: make(map[string]*forwardedTrack),
+			taps:   make(map[*roomTap]struct{}),
+		}
+		sfu.rooms[roomID] = room
+	}
+	return room
+}
+
+func (sfu *SFU) leave(room *sfuRoom) {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if len(room.peers) == 0 && len(room.taps) == 0 && sfu.rooms[room.id] == room {
+		delete(sfu.rooms, room.id)
+	}
+}
+
+// sfuRoom is the media of one room: who is connected and what they publish.
+type sfuRoom struct {
+	id string
+
+	mu    sync.Mutex
+	peers map[string]*SFUPeer
+	// tracks are keyed by publisher and track ID
+	tracks map[string]*forwardedTrack
+	taps   map[*roomTap]struct{}
+}
+
+type roomTap struct {
+	open Tap
+}
+
+type forwardedTrack struct {
+	publisher string
+	local     *webrtc.TrackLocalStaticRTP
+	info      TrackInfo
+
+	mu sync.Mutex
+	// sinks are the writers opened by the taps of the room, nil for the taps
+	// that left the track alone or failed
+	sinks map[*roomTap]media.Writer
+}
+
+// attach opens the writer of tap for the track, once.
+func (track *forwardedTrack) attach(tap *roomTap) {
+	track.mu.Lock()
+	defer track.mu.Unlock()
+
+	if _, ok := track.sinks[tap]; ok || track.sinks == nil {
+		return
+	}
+	track.sinks[tap] = tap.open(track.info)
+}
+
+// detach closes the writer of tap.
+func (track *forwardedTrack) detach(tap *roomTap) error {
+	track.mu.Lock()
+	defer track.mu.Unlock()
+
+	sink := track.sinks[tap]
+	delete(track.sinks, tap)
+	if sink == nil {
+		return nil
+	}
+	return sink.Close()
+}
+
+// record writes packet to every writer, giving up on those that fail.
+func (track *forwardedTrack) record(packet *rtp.Packet) error {
+	track.mu.Lock()
+	defer track.mu.Unlock()
+
+	var errs []error
+	for tap, sink := range track.sinks {
+		if sink == nil {
+			continue
+		}
+		err := sink.WriteRTP(media.Packet{
+			PayloadType:    packet.PayloadType,
+			SequenceNumber: packet.SequenceNumber,
+			Timestamp:      packet.Timestamp,
+			SSRC:           packet.SSRC,
+			Marker:         packet.Marker,
+			Payload:        packet.Payload,
+		})
+		if err != nil {
+			errs = append(errs, errors.Join(err, sink.Close()))
+			track.sinks[tap] = nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// end closes every writer; the track takes no more.
+func (track *forwardedTrack) end() error {
+	track.mu.Lock()
+	defer track.mu.Unlock()
+
+	var errs []error
+	for _, sink := range track.sinks {
+		if sink != nil {
+			errs = append(errs, sink.Close())
+		}
+	}
+	track.sinks = nil
+	return errors.Join(errs...)
+}
+
+// snapshot copies the peers and tracks of the room.
+func (room *sfuRoom) snapshot() ([]*SFUPeer, map[string]*forwardedTrack) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	peers := make([]*SFUPeer, 0, len(room.peers))
+	for _, peer := range room.peers {
+		peers = append(peers, peer)
+	}
+	tracks := make(map[string]*forwardedTrack, len(room.tracks))
+	for key, track := range room.tracks {
+		tracks[key] = track
+	}
+	return peers, tracks
+}
+
+// sync gives every peer the tracks of the others, takes back those that
+// are gone and renegotiates.
+func (room *sfuRoom) sync() {
+	peers, tracks := room.snapshot()
+	for _, peer := range peers {
+		if peer.syncTracks(tracks) {
+			peer.negotiate()
+		}
+	}
+}
+
+// SFUPeer is the connection of one participant to the SFU.
+type SFUPeer struct {
+	sfu    *SFU
+	room   *sfuRoom
+	userID string
+	pc     *webrtc.PeerConnection
+	signal func(WebSocketMessage) error
+	logger *zap.Logger
+
+	// mu serialises negotiation with the participant
+	mu sync.Mutex
+	// senders forward the tracks of the others, keyed like sfuRoom.tracks
+	senders map[string]*webrtc.RTPSender
+	// pending is set when a renegotiation waits for the current one to end
+	pending bool
+	closed  bool
+}
+
+// HandleSignal applies an answer, offer or candidate from the participant.
+func (peer *SFUPeer) HandleSignal(_ context.Context, msg WebSocketMessage) error {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if peer.closed {
+		return errPeerClosed
+	}
+
+	switch msg.Type {
+	case EventAnswer:
+		var sdp SDPData
+		if err := msg.decodePayload(&sdp); err != nil {
+			return err
+		}
+		if err := peer.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp.SDP}); err != nil {
+			return fmt.Errorf("set answer: %w", err)
+		}
+	case EventOffer:
+		var sdp SDPData
+		if err := msg.decodePayload(&sdp); err != nil {
+			return err
+		}
+		// On glare the server gives way and offers again afterwards
+		if peer.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+			if err := peer.pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+				return fmt.Errorf("roll back offer: %w", err)
+			}
+			peer.pending = true
+		}
+		if err := peer.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp.SDP}); err != nil {
+			return fmt.Errorf("set offer: %w", err)
+		}
+		answer, err := peer.pc.CreateAnswer(nil)
+		if err != nil {
+			return fmt.Errorf("create answer: %w", err)
+		}
+		if err := peer.pc.SetLocalDescription(answer); err != nil {
+			return fmt.Errorf("set answer: %w", err)
+		}
+		if err := peer.send(EventAnswer, SDPData{Type: EventAnswer, SDP: answer.SDP}); err != nil {
+			return err
+		}
+	case EventCandidate:
+		var candidate ICECandidateData
+		if err := msg.decodePayload(&candidate); err != nil {
+			return err
+		}
+		if err := peer.pc.AddICECandidate(webrtc.ICECandidateInit{
+			Candidate:     candidate.Candidate,
+			SDPMid:        &candidate.SDPMid,
+			SDPMLineIndex: &candidate.SDPMLineIndex,
+		}); err != nil {
+			return fmt.Errorf("add candidate: %w", err)
+		}
+		return nil
+	}
+
+	if peer.pending {
+		return peer.offerLocked()
+	}
+	return nil
+}
+
+// Close hangs up the participant and takes its tracks away from the others.
+func (peer *SFUPeer) Close() {
+	peer.mu.Lock()
+	if peer.closed {
+		peer.mu.Unlock()
+		return
+	}
+	peer.closed = true
+	peer.mu.Unlock()
+
+	room := peer.room
+	room.mu.Lock()
+	delete(room.peers, peer.userID)
+	for key, track := range room.tracks {
+		if track.publisher == peer.userID {
+			delete(room.tracks, key)
+		}
+	}
+	room.mu.Unlock()
+
+	if err := peer.pc.Close(); err != nil {
+		peer.logger.Warn("Close SFU peer connection failed", zap.Error(err))
+	}
+
+	peer.sfu.leave(room)
+	room.sync()
+}
+
+// publish forwards a track the participant sends to the rest of the room
+// until it ends.
+func (peer *SFUPeer) publish(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	key := peer.userID + "/" + remote.ID()
+	// the stream ID tells subscribers whose track it is
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), peer.userID)
+	if err != nil {
+		peer.logger.Error("Create forwarded track failed", zap.Error(err))
+		return
+	}
+
+	codec := remote.Codec()
+	track := &forwardedTrack{
+		publisher: peer.userID,
+		local:     local,
+		info: TrackInfo{
+			Publisher: peer.userID,
+			ID:        remote.ID(),
+			MimeType:  codec.MimeType,
+			ClockRate: codec.ClockRate,
+			Channels:  codec.Channels,
+		},
+		sinks: make(map[*roomTap]media.Writer),
+	}
+
+	room := peer.room
+	room.mu.Lock()
+	room.tracks[key] = track
+	taps := make([]*roomTap, 0, len(room.taps))
+	for tap := range room.taps {
+		taps = append(taps, tap)
+	}
+	room.mu.Unlock()
+
+	for _, tap := range taps {
+		track.attach(tap)
+	}
+
+	peer.logger.Info("Track published", zap.String("track", remote.ID()), zap.Stringer("kind", remote.Kind()), zap.String("codec", codec.MimeType))
+	room.sync()
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		room.mu.Lock()
+		delete(room.tracks, key)
+		room.mu.Unlock()
+		if err := track.end(); err != nil {
+			peer.logger.Warn("Close track tap failed", zap.String("track", remote.ID()), zap.Error(err))
+		}
+		room.sync()
+	}()
+
+	if remote.Kind() == webrtc.RTPCodecTypeVideo {
+		go peer.requestKeyframes(remote.SSRC(), done)
+	}
+
+	for {
+		packet, _, err := remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		if err := track.record(packet); err != nil {
+			peer.logger.Warn("Track tap failed", zap.String("track", remote.ID()), zap.Error(err))
+		}
+		// ErrClosedPipe only means nobody is subscribed yet
+		if err := local.WriteRTP(packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			peer.logger.Warn("Forward RTP failed", zap.String("track", remote.ID()), zap.Error(err))
+			return
+		}
+	}
+}
+
+// syncTracks adds the tracks of the others the participant does not get yet
+// and removes those that are gone. It reports whether anything changed.
+func (peer *SFUPeer) syncTracks(tracks map[string]*forwardedTrack) bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if peer.closed {
+		return false
+	}
+
+	changed := false
+	for key, sender := range peer.senders {
+		if _, ok := tracks[key]; ok {
+			continue
+		}
+		if err := peer.pc.RemoveTrack(sender); err != nil {
+			peer.logger.Warn("Remove forwarded track failed", zap.String("track", key), zap.Error(err))
+		}
+		delete(peer.senders, key)
+		changed = true
+	}
+
+	for key, track := range tracks {
+		if _, ok := peer.senders[key]; ok || track.publisher == peer.userID {
+			continue
+		}
+		sender, err := peer.pc.AddTrack(track.local)
+		if err != nil {
+			peer.logger.Warn("Add forwarded track failed", zap.String("track", key), zap.Error(err))
+			continue
+		}
+		peer.senders[key] = sender
+		changed = true
+
+		// RTCP has to be read for the interceptors to process it
+		go func() {
+			for {
+				if _, _, err := sender.ReadRTCP(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	return changed
+}
+
+func (peer *SFUPeer) negotiate() {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if peer.closed {
+		return
+	}
+	if err := peer.offerLocked(); err != nil {
+		peer.logger.Warn("Renegotiate failed", zap.Error(err))
+	}
+}
+
+// offerLocked sends a new offer, or leaves it for when the current
+// negotiation is over.
+func (peer *SFUPeer) offerLocked() error {
+	if peer.pc.SignalingState() != webrtc.SignalingStateStable {
+		peer.pending = true
+		return nil
+	}
+	peer.pending = false
+
+	offer, err := peer.pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("create offer: %w", err)
+	}
+	if err := peer.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("set offer: %w", err)
+	}
+	return peer.send(EventOffer, SDPData{Type: EventOffer, SDP: offer.SDP})
+}
+
+// requestKeyframes asks the participant for a keyframe of the video ssrc
+// every keyframeInterval until done, so that subscribers who joined in
+// between get a picture.
+func (peer *SFUPeer) requestKeyframes(ssrc webrtc.SSRC, done <-chan struct{}) {
+	ticker := time.NewTicker(keyframeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := peer.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}})
+			if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				peer.logger.Debug("Request keyframe failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (peer *SFUPeer) send(msgType string, payload any) error {
+	msg, err := NewMessage(msgType, payload)
+	if err != nil {
+		return err
+	}
+	msg.From = SFUPeerID
+	msg.To = peer.userID
+	return peer.signal(msg)
+}
@@ -1,11 +1,137 @@
 package rtc
 
+import (
+	"encoding/json"
+
+	"vidcall/internal/module/room"
+	"vidcall/pkg/media"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// ProtocolVersion is the signaling protocol spoken on /ws/{roomID}. It is
+// bumped on every incompatible change to WebSocketMessage or its payloads.
+const ProtocolVersion = 1
+
+// Subprotocol is negotiated on the WebSocket handshake when the client
+// offers it, e.g. alongside its access token.
+const Subprotocol = "vidcall.v1"
+
+// Message types sent by clients.
+const (
+	EventOffer     = "offer"     // payload: SDPData, to: target peer
+	EventAnswer    = "answer"    // payload: SDPData, to: target peer
+	EventCandidate = "candidate" // payload: ICECandidateData, to: target peer
+	EventHangup    = "hangup"    // no payload, relayed to the whole room; ends the sender's session
+	EventPing      = "ping"      // payload: PingData, optional; answered with a pong, for browsers which cannot see WebSocket pings
+
+	// Media state changes carry no payload and are relayed to the whole room
+	EventMute               = "mute"
+	EventUnmute             = "unmute"
+	EventVideoOn            = "video_on"
+	EventVideoOff           = "video_off"
+	EventScreenShareStarted = "screen_share_started"
+	EventScreenShareStopped = "screen_share_stopped"
+)
+
+// mediaChanges maps each media message type onto the participant state it sets.
+var mediaChanges = map[string]func(*room.MediaState){
+	EventMute:               func(media *room.MediaState) { media.AudioMuted = true },
+	EventUnmute:             func(media *room.MediaState) { media.AudioMuted = false },
+	EventVideoOn:            func(media *room.MediaState) { media.VideoOff = false },
+	EventVideoOff:           func(media *room.MediaState) { media.VideoOff = true },
+	EventScreenShareStarted: func(media *room.MediaState) { media.ScreenSharing = true },
+	EventScreenShareStopped: func(media *room.MediaState) { media.ScreenSharing = false },
+}
+
+// Message types sent by the server. Room events are forwarded as well:
+// room.EventNewComer and room.EventLeaveRoom carry PeerData,
+// room.EventCallState carries CallStateData, room.EventExpiring carries
+// RoomExpiringData, room.EventRoomEnded and room.EventRoomDeleted have no
+// payload and end the session.
+const (
+	EventSession            = "session"              // payload: SessionData, sent once after joining when sessions can be resumed
+	EventSessionResumed     = "session_resumed"      // payload: SessionResumedData, first message on a resumed session
+	EventPeers              = "peers"                // payload: PeersData, sent once after joining
+	EventPong               = "pong"                 // payload: PongData, reply to a ping
+	EventPeerTimeout        = "peer_timeout"         // payload: PeerData, a participant left its pings unanswered and is evicted; leave_room follows
+	EventError              = "error"                // payload: ErrorData, reply to a rejected message
+	EventServerShuttingDown = "server_shutting_down" // payload: ShuttingDownData, the session is closed at the deadline
+)
+
+// SFUPeerID is the peer the participants of an sfu room negotiate with: the
+// server. It offers each of them one connection carrying the tracks of all
+// the others, whose stream ID is the user ID of their publisher, and offers
+// again whenever a track is published or unpublished. Clients answer, send
+// their candidates and may offer themselves to publish more tracks.
+const SFUPeerID = "sfu"
+
+// TrackInfo describes a track published in an sfu room, as handed to a tap.
+type TrackInfo struct {
+	Publisher string // user ID
+	ID        string
+	MimeType  string // e.g. "audio/opus" or "video/VP8"
+	ClockRate uint32
+	Channels  uint16
+}
+
+// Tap opens where the RTP of a track goes besides the other participants,
+// e.g. a recording. It returns nil to leave the track alone.
+type Tap func(track TrackInfo) media.Writer
+
 type WebsocketUpgrader struct {
 }
 
+// WebSocketMessage is the envelope of every signaling frame, in both
+// directions:
+//
+//	{"v":1,"id":"01J...","type":"offer","to":"bob","payload":{"type":"offer","sdp":"v=0..."}}
+//
+// V must equal ProtocolVersion. ID is chosen by the sender (the server fills
+// it in when empty) and is echoed as ErrorData.Ref when the message is
+// rejected. From is always overwritten by the server with the sender's user
+// ID. To names the target peer of offer, answer and candidate messages, so a
+// room of N participants can negotiate pairwise connections.
+//
+// Seq numbers the messages the server sends to a user in a session, from 1.
+// A client whose connection drops reconnects to
+// /ws/{roomID}?session={token}&last_seq={seq} with the token of SessionData
+// and the last seq it received, within the resume grace window; it gets
+// session_resumed, then the messages it missed, and the other participants
+// never see it leave.
+//
+// Trace carries W3C trace context ("traceparent" and "tracestate"). A client
+// may set it on any message to trace it; relayed messages carry the trace of
+// their relay, which a client echoes on its answer and candidates so that the
+// whole negotiation lands in one trace.
 type WebSocketMessage struct {
-	Event string      `json:"event,omitempty"`
-	Data  interface{} `json:"data,omitempty"`
+	Version int               `json:"v"`
+	ID      string            `json:"id,omitempty"`
+	Type    string            `json:"type"`
+	From    string            `json:"from,omitempty"`
+	To      string            `json:"to,omitempty"`
+	Seq     uint64            `json:"seq,omitempty"`
+	Trace   map[string]string `json:"trace,omitempty"`
+	Payload json.RawMessage   `json:"payload,omitempty"`
+}
+
+// NewMessage builds a server-originated message with a fresh ID.
+func NewMessage(msgType string, payload any) (WebSocketMessage, error) {
+	msg := WebSocketMessage{
+		Version: ProtocolVersion,
+		ID:      ulid.Make().String(),
+		Type:    msgType,
+	}
+
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return WebSocketMessage{}, err
+		}
+		msg.Payload = raw
+	}
+
+	return msg, nil
 }
 
 type SDPData struct {
@@ -14,7 +140,67 @@ type SDPData struct {
 }
 
 type ICECandidateData struct {
-	Candidate     string `json:"candidate"`
+	Candidate     string `json:"candidate"` // empty signals end of candidates
 	SDPMid        string `json:"sdpMid"`
 	SDPMLineIndex uint16 `json:"sdpMLineIndex"`
 }
+
+type SessionData struct {
+	Token         string `json:"token"`
+	ResumeGraceMs int64  `json:"resume_grace_ms"` // how long the session waits for a reconnect
+}
+
+type SessionResumedData struct {
+	Replayed int `json:"replayed"` // messages missed, which follow
+}
+
+type PingData struct {
+	Timestamp float64 `json:"timestamp,omitempty"` // any clock of the client, echoed on the pong
+}
+
+type PongData struct {
+	Timestamp float64 `json:"timestamp,omitempty"` // of the ping
+	RTTMs     int64   `json:"rtt_ms"`              // of the connection as measured by the server's pings, 0 before the first
+}
+
+type PeersData struct {
+	UserIDs []string `json:"user_ids"`
+}
+
+type PeerData struct {
+	UserID string `json:"user_id"`
+}
+
+type CallStateData struct {
+	State room.CallState `json:"state"`
+}
+
+type RoomExpiringData struct {
+	EndsAt int64 `json:"ends_at"` // unix seconds
+}
+
+// ShuttingDownData tells a client when its session will be closed and how
+// long to wait before reconnecting, so that clients do not all come back at
+// once.
+type ShuttingDownData struct {
+	Deadline         int64 `json:"deadline"` // unix seconds
+	ReconnectAfterMs int64 `json:"reconnect_after_ms"`
+}
+
+type ErrorData struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Ref     string `json:"ref,omitempty"` // ID of the offending message, if known
+}
+
+// ICEServer is an RTCIceServer dictionary, ready for RTCPeerConnection.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+type ICEServersResponse struct {
+	ICEServers []ICEServer `json:"ice_servers"`
+	ExpiresAt  int64       `json:"expires_at"` // unix seconds, when issued TURN credentials stop working
+}
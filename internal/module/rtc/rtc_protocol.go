@@ -0,0 +1,145 @@
+package rtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxFrameSize is the hard read limit of a WebSocket frame; anything
+	// bigger tears the connection down.
+	maxFrameSize = 1 << 20
+	// MaxPayloadSize is the largest payload the server relays. Bigger
+	// messages are answered with ErrCodePayloadTooLarge.
+	MaxPayloadSize = 64 << 10
+)
+
+// CloseSessionGone closes a connection that tried to resume a session which
+// is over or missed too much; the client joins again instead.
+const CloseSessionGone = 4410
+
+// Error codes carried by ErrorData.
+const (
+	ErrCodeMalformed          = "malformed_message"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodePayloadTooLarge    = "payload_too_large"
+	ErrCodeInvalidPayload     = "invalid_payload"
+	ErrCodeUnknownPeer        = "unknown_peer"
+	ErrCodeRelayFailed        = "relay_failed"
+	ErrCodeJoinFailed         = "join_failed"
+	ErrCodeNegotiationFailed  = "negotiation_failed"
+)
+
+// ProtocolError rejects a single client message; the connection stays open
+// and the sender gets an error message built from it.
+type ProtocolError struct {
+	Code    string
+	Message string
+	Ref     string
+}
+
+func (err *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Code, err.Message)
+}
+
+func (err *ProtocolError) Data() ErrorData {
+	return ErrorData{
+		Code:    err.Code,
+		Message: err.Message,
+		Ref:     err.Ref,
+	}
+}
+
+func newProtocolError(code, ref, format string, args ...any) *ProtocolError {
+	return &ProtocolError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+		Ref:     ref,
+	}
+}
+
+// DecodeMessage parses and validates a raw client frame.
+func DecodeMessage(raw []byte) (WebSocketMessage, error) {
+	var msg WebSocketMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return WebSocketMessage{}, newProtocolError(ErrCodeMalformed, "", "invalid JSON envelope: %v", err)
+	}
+
+	if err := msg.Validate(); err != nil {
+		return WebSocketMessage{}, err
+	}
+
+	return msg, nil
+}
+
+// Validate checks the envelope and decodes the payload of every client
+// message type to make sure only well-formed signaling is relayed.
+func (msg WebSocketMessage) Validate() error {
+	if msg.Version != ProtocolVersion {
+		return newProtocolError(ErrCodeUnsupportedVersion, msg.ID, "protocol version %d is not supported, expected %d", msg.Version, ProtocolVersion)
+	}
+
+	if len(msg.Payload) > MaxPayloadSize {
+		return newProtocolError(ErrCodePayloadTooLarge, msg.ID, "payload of %d bytes exceeds %d bytes", len(msg.Payload), MaxPayloadSize)
+	}
+
+	switch msg.Type {
+	case EventOffer, EventAnswer:
+		if msg.To == "" {
+			return newProtocolError(ErrCodeInvalidPayload, msg.ID, "%s requires a target peer", msg.Type)
+		}
+
+		var sdp SDPData
+		if err := msg.decodePayload(&sdp); err != nil {
+			return err
+		}
+		if sdp.Type != msg.Type {
+			return newProtocolError(ErrCodeInvalidPayload, msg.ID, "sdp type %q does not match message type %q", sdp.Type, msg.Type)
+		}
+		if !strings.HasPrefix(sdp.SDP, "v=0") {
+			return newProtocolError(ErrCodeInvalidPayload, msg.ID, "sdp must start with the v=0 line")
+		}
+	case EventCandidate:
+		if msg.To == "" {
+			return newProtocolError(ErrCodeInvalidPayload, msg.ID, "%s requires a target peer", msg.Type)
+		}
+
+		var candidate ICECandidateData
+		if err := msg.decodePayload(&candidate); err != nil {
+			return err
+		}
+		if candidate.Candidate != "" && !strings.HasPrefix(candidate.Candidate, "candidate:") {
+			return newProtocolError(ErrCodeInvalidPayload, msg.ID, "ice candidate must start with \"candidate:\"")
+		}
+	case EventHangup:
+	case EventPing:
+		if len(msg.Payload) > 0 {
+			var ping PingData
+			if err := msg.decodePayload(&ping); err != nil {
+				return err
+			}
+		}
+	default:
+		if _, ok := mediaChanges[msg.Type]; ok {
+			return nil
+		}
+
+		return newProtocolError(ErrCodeUnknownType, msg.ID, "unknown message type %q", msg.Type)
+	}
+
+	return nil
+}
+
+func (msg WebSocketMessage) decodePayload(v any) error {
+	if len(msg.Payload) == 0 {
+		return newProtocolError(ErrCodeInvalidPayload, msg.ID, "%s requires a payload", msg.Type)
+	}
+
+	if err := json.Unmarshal(msg.Payload, v); err != nil {
+		return newProtocolError(ErrCodeInvalidPayload, msg.ID, "decode %s payload: %v", msg.Type, err)
+	}
+
+	return nil
+}
@@ -1,27 +1,60 @@
 package rtc
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand/v2"
 	"net/http"
-	"sync"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"vidcall/config"
 	"vidcall/internal/common"
+	"vidcall/internal/module/history"
+	"vidcall/internal/module/metrics"
 	"vidcall/internal/module/room"
 	"vidcall/internal/module/user"
+	"vidcall/pkg/log"
+	"vidcall/pkg/tracing"
 
 	"github.com/gorilla/websocket"
+	"github.com/oklog/ulid/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 )
 
+var tracer = otel.Tracer("vidcall/internal/module/rtc")
+
 var Module = fx.Module("rtc",
+	fx.Provide(NewWebsocketHub),
 	fx.Provide(NewHandler),
+	fx.Provide(NewSFU),
+	fx.Provide(NewICEService),
+	fx.Provide(NewICEHandler),
 )
 
 type Handler struct {
+	hub         *WebsocketHub
 	roomService *room.Service
 	userService *user.Service
+	history     *history.Service
+	sfu         *SFU
+	metrics     metrics.Recorder
+
+	// draining is set once the server shuts down; no session starts after it
+	draining atomic.Bool
+	// resumeGrace is how long a dropped session is held for a resume, and
+	// heartbeat how connections are pinged, from the rtc section of the config
+	resumeGrace atomic.Int64
+	heartbeat   atomic.Pointer[Heartbeat]
 
 	logger *zap.Logger
 }
@@ -29,19 +62,61 @@ type Handler struct {
 type HandlerParams struct {
 	fx.In
 
+	Config      config.Config
+	Watcher     *config.Watcher
+	Hub         *WebsocketHub
 	RoomService *room.Service
 	UserService *user.Service
+	History     *history.Service
+	SFU         *SFU
+	Metrics     metrics.Recorder
 	Logger      *zap.Logger
 }
 
 func NewHandler(params HandlerParams) *Handler {
-	return &Handler{
+	handler := &Handler{
+		hub:         params.Hub,
 		roomService: params.RoomService,
 		userService: params.UserService,
+		history:     params.History,
+		sfu:         params.SFU,
+		metrics:     params.Metrics,
 		logger:      params.Logger,
 	}
+
+	handler.resumeGrace.Store(int64(params.Config.RTC.ResumeGrace))
+	config.Subscribe(params.Watcher, func(c config.Config) time.Duration { return c.RTC.ResumeGrace }, func(grace time.Duration) {
+		handler.resumeGrace.Store(int64(grace))
+	})
+
+	handler.heartbeat.Store(newHeartbeat(params.Config))
+	config.Subscribe(params.Watcher, newHeartbeat, handler.heartbeat.Store)
+
+	return handler
+}
+
+// newHeartbeat is the heartbeat of new connections under c.
+func newHeartbeat(c config.Config) *Heartbeat {
+	return &Heartbeat{Interval: c.RTC.PingInterval, Misses: c.RTC.PingMisses}
 }
 
+// connectionHeartbeat is the heartbeat of a new connection, which records
+// its round trip times.
+func (handler *Handler) connectionHeartbeat() Heartbeat {
+	heartbeat := *handler.heartbeat.Load()
+	heartbeat.OnRTT = handler.metrics.ObserveRTT
+	return heartbeat
+}
+
+// errHangup ends the session of a user who hung up.
+var errHangup = errors.New("hangup")
+
+const (
+	drainPollInterval = 100 * time.Millisecond
+	// forceCloseWait bounds how long closed sessions get to leave their rooms
+	forceCloseWait = 5 * time.Second
+)
+
 func (handler *Handler) JoinRoom(w http.ResponseWriter, r *http.Request) {
 	roomID := common.GetParam(r, "roomID")
 	if roomID == "" {
@@ -49,146 +124,644 @@ func (handler *Handler) JoinRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ws := websocket.Upgrader{
-		HandshakeTimeout:  5 * time.Second,
-		ReadBufferSize:    1024,
-		WriteBufferSize:   1024,
-		EnableCompression: true,
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
 	}
 
-	conn, err := ws.Upgrade(w, r, nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if token := r.URL.Query().Get("session"); token != "" {
+		handler.resumeSession(w, r, roomID, userID, token)
+		return
+	}
+
+	// The session outlives the request context, so cleanup runs detached from it
+	ctx := log.WithFields(context.WithoutCancel(r.Context()), log.RoomID(roomID))
+
+	// The session span covers the whole call of the user, the spans of the
+	// messages it relays hang off it
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "rtc.session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.id", userID)),
+	)
+	defer span.End()
+	if spanContext := span.SpanContext(); spanContext.IsValid() {
+		ctx = log.WithFields(ctx, log.TraceID(spanContext.TraceID().String()))
+	}
+
+	logger := log.Ctx(ctx, handler.logger)
+
+	if handler.draining.Load() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
 		return
 	}
 
-	userID, _ := common.GetUserID(r)
-	usr := user.User{
-		ID:   userID,
-		Conn: conn,
+	if previous, ok := handler.hub.Client(userID); ok {
+		if previous.Connection() != nil {
+			http.Error(w, "User is already connected", http.StatusConflict)
+			return
+		}
+
+		// A session waiting to be resumed is given up for a new one; its
+		// participant leaves the room first
+		logger.Info("Giving up the previous session for a new one")
+		previous.stop()
+		select {
+		case <-previous.Ended():
+		case <-time.After(forceCloseWait):
+			http.Error(w, "User is already connected", http.StatusConflict)
+			return
+		}
+	}
+
+	ws, err := upgrade(w, r)
+	if err != nil {
+		// Upgrade has already replied to the client
+		logger.Error("WebSocket upgrade failed", zap.Error(err))
+		return
 	}
 
-	if _, err := handler.userService.CreateUser(r.Context(), usr); err != nil {
-		http.Error(w, "Create user failed: "+err.Error(), http.StatusInternalServerError)
+	client, err := handler.hub.Register(roomID, userID, ws, handler.connectionHeartbeat())
+	if err != nil {
+		logger.Error("Register client failed", zap.Error(err))
+		_ = ws.Close()
 		return
 	}
+	defer handler.hub.Unregister(client)
 
+	// conn is the connection of the session, nil while it waits for a resume
+	conn := client.Connection()
+	handler.metrics.ConnectionOpened()
 	defer func() {
-		if err := conn.Close(); err != nil {
-			handler.logger.Error("WebSocket close failed", zap.String("userID", userID), zap.Error(err))
+		if conn != nil {
+			handler.metrics.ConnectionClosed()
 		}
+	}()
+
+	commonRoom, err := handler.roomService.JoinRoom(ctx, roomID, userID, r.URL.Query().Get("passcode"))
+	if err != nil {
+		logger.Warn("Join room failed", zap.Error(err))
+		span.SetStatus(codes.Error, "join room failed")
+		handler.sendError(userID, &ProtocolError{Code: ErrCodeJoinFailed, Message: "join room failed: " + err.Error()})
+		return
+	}
 
-		usr.Conn = nil
-		if _, err := handler.userService.UpdateUser(r.Context(), usr); err != nil {
-			handler.logger.Error("Update user conn to nil failed", zap.String("userID", userID), zap.Error(err))
+	// Sessions the shutdown closes are disconnected rather than left
+	leave := handler.roomService.LeaveRoom
+	defer func() {
+		if err := leave(ctx, commonRoom.ID, userID); err != nil && !errors.Is(err, room.ErrUserNotInRoom) {
+			logger.Error("Leave room failed", zap.Error(err))
 		}
 	}()
 
-	commonRoom, err := handler.roomService.JoinRoom(r.Context(), roomID, userID)
+	record, err := handler.history.Open(ctx, commonRoom.ID, userID)
 	if err != nil {
-		http.Error(w, "Join room failed: "+err.Error(), http.StatusInternalServerError)
+		logger.Error("Open call record failed", zap.Error(err))
 		return
 	}
 
-	clientEvent := make(chan any, 1)
-	go func() {
-		for {
-			select {
-			case <-r.Context().Done():
-				return
-			default:
-				var msg WebSocketMessage
-				if err := usr.Conn.ReadJSON(&msg); err != nil {
-					clientEvent <- fmt.Errorf("read msg: %w", err)
-					return
-				}
+	// Every return of the session sets why it ended, failures of the server
+	// aside
+	endReason := history.EndReasonError
+	signalingErrors := 0
+	defer func() {
+		if _, err := handler.history.Close(ctx, record.ID, endReason, signalingErrors); err != nil {
+			logger.Error("Close call record failed", zap.Error(err))
+		}
+	}()
 
-				handler.logger.Info("Received msg", zap.String("userID", userID), zap.Any("msg", msg))
-				clientEvent <- msg
-			}
+	if _, err := handler.userService.JoinCall(ctx, userID, commonRoom.ID); err != nil {
+		logger.Error("Update user presence failed", zap.Error(err))
+		return
+	}
+
+	defer func() {
+		if _, err := handler.userService.LeaveCall(ctx, userID); err != nil {
+			logger.Error("Update user presence failed", zap.Error(err))
 		}
 	}()
 
-	var (
-		peerUserMu sync.Mutex
-		peerUser   *user.User
-	)
+	events, err := handler.roomService.Events(ctx, commonRoom.ID, userID)
+	if err != nil {
+		logger.Error("Subscribe room events failed", zap.Error(err))
+		return
+	}
+
+	reads := make(chan clientRead, 1)
+	go readConnection(client, conn, reads)
+
+	if grace := time.Duration(handler.resumeGrace.Load()); grace > 0 {
+		if err := handler.send(userID, EventSession, SessionData{Token: client.Token(), ResumeGraceMs: grace.Milliseconds()}); err != nil {
+			logger.Error("Send session failed", zap.Error(err))
+			return
+		}
+	}
+
+	// Tell the newcomer who is already in the room so it can start negotiating with each of them
+	if err := handler.send(userID, EventPeers, PeersData{UserIDs: commonRoom.Peers(userID)}); err != nil {
+		logger.Error("Send peers failed", zap.Error(err))
+		return
+	}
+
+	// In sfu rooms the server is the only peer, it offers right away
+	var sfuPeer *SFUPeer
+	if commonRoom.IsSFU() {
+		sfuPeer, err = handler.sfu.Join(ctx, commonRoom.ID, userID, func(msg WebSocketMessage) error {
+			return handler.hub.SendToUser(userID, msg)
+		})
+		if err != nil {
+			logger.Error("Join SFU failed", zap.Error(err))
+			handler.sendError(userID, &ProtocolError{Code: ErrCodeJoinFailed, Message: "join sfu failed"})
+			return
+		}
+		defer sfuPeer.Close()
+	}
 
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
+	// graceExpired fires when a dropped session was not resumed in time
+	var graceTimer *time.Timer
+	var graceExpired <-chan time.Time
+
 	for {
 		select {
 		case <-ticker.C:
-			if _, err := handler.userService.UpdateActive(r.Context(), userID); err != nil {
-				handler.logger.Error("Update user active failed", zap.String("userID", userID), zap.Error(err))
-				return
+			// A session waiting for a resume is not active
+			if conn == nil {
+				continue
 			}
-		case <-r.Context().Done():
-			if err := handler.roomService.LeaveRoom(r.Context(), commonRoom.ID, userID); err != nil {
-				handler.logger.Error("Leave room failed", zap.String("roomID", commonRoom.ID), zap.String("userID", userID), zap.Error(err))
+			if _, err := handler.userService.UpdateActive(ctx, userID); err != nil {
+				logger.Error("Update user active failed", zap.Error(err))
 				return
 			}
-
-		case roomEvent := <-commonRoom.Subscribers[userID]:
-			peerUserMu.Lock()
-			if _, ok := roomEvent.LeaveRoom(); ok {
-				peerUser = nil
+		case <-client.Done():
+			logger.Info("Client stopped")
+			endReason = handler.disconnectReason()
+			if handler.draining.Load() {
+				leave = handler.roomService.Disconnect
 			}
-
-			if newComerID, ok := roomEvent.NewComer(); ok {
-				peerUsr, err := handler.userService.GetUser(r.Context(), newComerID)
-				if err != nil {
-					handler.logger.Error("Get peer user failed", zap.String("roomID", commonRoom.ID), zap.String("userID", userID), zap.String("peerUserID", newComerID), zap.Error(err))
-					return
+			return
+		case resumed := <-client.Resumed():
+			if conn == nil {
+				handler.metrics.ConnectionOpened()
+				graceTimer.Stop()
+				graceExpired = nil
+				if _, err := handler.userService.JoinCall(ctx, userID, commonRoom.ID); err != nil {
+					logger.Error("Update user presence failed", zap.Error(err))
 				}
-				peerUser = &peerUsr
 			}
-
-			if roomEvent.EventName == room.EventRoomDeleted {
-				handler.logger.Info("Room deleted, closing connection", zap.String("roomID", commonRoom.ID), zap.String("userID", userID))
+			conn = resumed
+			go readConnection(client, conn, reads)
+			logger.Info("Session resumed")
+		case <-graceExpired:
+			logger.Info("Session was not resumed in time")
+			endReason = history.EndReasonTimeout
+			return
+
+		case roomEvent, ok := <-events:
+			if !ok || roomEvent.EventName == room.EventRoomDeleted {
+				logger.Info("Room deleted, closing connection")
+				_ = handler.send(userID, room.EventRoomDeleted, nil)
+				endReason = history.EndReasonRoomDeleted
 				return
 			}
-			peerUserMu.Unlock()
-		case msg := <-clientEvent:
-			if err, ok := msg.(error); ok {
-				handler.logger.Error("Read msg failed", zap.String("roomID", commonRoom.ID), zap.String("userID", userID), zap.Error(err))
+
+			if err := handler.sendRoomEvent(userID, roomEvent); err != nil {
+				logger.Error("Send room event failed", zap.Error(err))
 				return
 			}
 
-			clientMsg, ok := msg.(WebSocketMessage)
-			if !ok {
-				handler.logger.Error("Invalid msg type", zap.String("roomID", commonRoom.ID), zap.String("userID", userID))
+			if roomEvent.EventName == room.EventRoomEnded {
+				logger.Info("Room ended, closing connection")
+				endReason = history.EndReasonRoomEnded
 				return
 			}
+		case read := <-reads:
+			// Connections replaced by a resume are done with
+			if read.conn != conn {
+				continue
+			}
+
+			if read.err != nil {
+				client.Detach(conn)
+				conn = nil
+				handler.metrics.ConnectionClosed()
+
+				// A peer that stopped answering is evicted right away, the
+				// others learn why before it leaves the room
+				if errors.Is(read.err, ErrPeerTimeout) {
+					logger.Warn("Peer timed out, evicting it")
+					handler.metrics.PeerTimedOut()
+					if err := handler.sendPeerTimeout(commonRoom.ID, userID); err != nil {
+						logger.Warn("Send peer timeout failed", zap.Error(err))
+					}
+					endReason = history.EndReasonTimeout
+					return
+				}
+				logger.Info("Read msg failed", zap.Error(read.err))
 
-			peerUserMu.Lock()
-			if peerUser == nil {
-				peerUserMu.Unlock()
+				grace := time.Duration(handler.resumeGrace.Load())
+				if grace <= 0 || handler.draining.Load() {
+					endReason = handler.disconnectReason()
+					return
+				}
+				if _, err := handler.userService.LeaveCall(ctx, userID); err != nil {
+					logger.Error("Update user presence failed", zap.Error(err))
+				}
+				logger.Info("Connection lost, holding the session for a resume", zap.Duration("grace", grace))
+				graceTimer = time.NewTimer(grace)
+				graceExpired = graceTimer.C
 				continue
 			}
 
-			if err := handler.handleClientMsg(peerUser.Conn, clientMsg); err != nil {
-				handler.logger.Error("Handle client msg failed", zap.String("roomID", commonRoom.ID), zap.String("userID", userID), zap.Error(err))
-				return
+			if err := handler.handleClientMsg(ctx, commonRoom.ID, userID, sfuPeer, read.raw); err != nil {
+				if errors.Is(err, errHangup) {
+					logger.Info("User hung up")
+					endReason = history.EndReasonHangup
+					return
+				}
+
+				logger.Warn("Handle client msg failed", zap.Error(err))
+				signalingErrors++
+
+				var protocolErr *ProtocolError
+				if errors.As(err, &protocolErr) {
+					handler.sendError(userID, protocolErr)
+				}
 			}
-			peerUserMu.Unlock()
 		}
 
 	}
 }
 
-func (handler *Handler) handleClientMsg(peerConn *websocket.Conn, msg WebSocketMessage) error {
-	if peerConn == nil {
+// disconnectReason is why a session closed by its client or the server
+// ended.
+func (handler *Handler) disconnectReason() history.EndReason {
+	if handler.draining.Load() {
+		return history.EndReasonServerShutdown
+	}
+	return history.EndReasonHangup
+}
+
+// resumeSession attaches a new connection to the session of token, which
+// first replays what the user missed after the last_seq query parameter. The
+// session itself goes on in the request that started it.
+func (handler *Handler) resumeSession(w http.ResponseWriter, r *http.Request, roomID, userID, token string) {
+	ctx := log.WithFields(r.Context(), log.RoomID(roomID))
+	logger := log.Ctx(ctx, handler.logger)
+
+	if handler.draining.Load() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	client, ok := handler.hub.Session(token)
+	if !ok || client.UserID() != userID || client.RoomID() != roomID {
+		http.Error(w, "Session not found, join again", http.StatusGone)
+		return
+	}
+
+	var lastSeq uint64
+	if raw := r.URL.Query().Get("last_seq"); raw != "" {
+		var err error
+		if lastSeq, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			http.Error(w, "Invalid last_seq", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := client.CanResume(lastSeq); err != nil {
+		http.Error(w, "Session cannot be resumed, join again", http.StatusGone)
+		return
+	}
+
+	ws, err := upgrade(w, r)
+	if err != nil {
+		logger.Error("WebSocket upgrade failed", zap.Error(err))
+		return
+	}
+
+	replayed, err := client.Resume(ws, handler.connectionHeartbeat(), lastSeq, func(replayed int) ([]byte, error) {
+		msg, err := NewMessage(EventSessionResumed, SessionResumedData{Replayed: replayed})
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(msg)
+	}, handler.logger)
+	if err != nil {
+		// The session ended or moved on in the meantime
+		logger.Info("Resume session failed", zap.Error(err))
+		_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(CloseSessionGone, "session cannot be resumed, join again"), time.Now().Add(writeWait))
+		_ = ws.Close()
+		return
+	}
+
+	logger.Info("Resuming session", zap.Int("replayed", replayed))
+}
+
+// clientRead is a frame, or the error ending it, read from a connection of a
+// session.
+type clientRead struct {
+	conn *Connection
+	raw  []byte
+	err  error
+}
+
+// readConnection reads conn until it fails, for as long as the session
+// lasts.
+func readConnection(client *Client, conn *Connection, reads chan<- clientRead) {
+	for {
+		raw, err := conn.ReadMessage()
+		if err != nil {
+			err = fmt.Errorf("read msg: %w", err)
+		}
+
+		select {
+		case reads <- clientRead{conn: conn, raw: raw, err: err}:
+		case <-client.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	ws := websocket.Upgrader{
+		HandshakeTimeout:  5 * time.Second,
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: true,
+		Subprotocols:      []string{Subprotocol},
+	}
+	return ws.Upgrade(w, r, nil)
+}
+
+// Drain stops new sessions, tells every connected client that the server is
+// shutting down and waits for the sessions to end until ctx is done, when the
+// remaining ones are closed. Clients are told to reconnect after
+// reconnectDelay plus a random share of it, so they do not all come back at
+// once.
+func (handler *Handler) Drain(ctx context.Context, reconnectDelay time.Duration) error {
+	handler.draining.Store(true)
+
+	var deadline int64
+	if at, ok := ctx.Deadline(); ok {
+		deadline = at.Unix()
+	}
+
+	clients := handler.hub.Clients()
+	handler.logger.Info("Draining WebSocket sessions", zap.Int("sessions", len(clients)))
+	for _, client := range clients {
+		jitter := time.Duration(rand.Int64N(int64(reconnectDelay) + 1))
+		if err := handler.send(client.UserID(), EventServerShuttingDown, ShuttingDownData{
+			Deadline:         deadline,
+			ReconnectAfterMs: (reconnectDelay + jitter).Milliseconds(),
+		}); err != nil {
+			handler.logger.Warn("Send shutdown notice failed", log.RoomID(client.RoomID()), log.UserID(client.UserID()), zap.Error(err))
+		}
+
+		// Nobody resumes a session while the server drains
+		if client.Connection() == nil {
+			client.stop()
+		}
+	}
+
+	if handler.waitSessions(ctx) {
 		return nil
 	}
 
-	switch msg.Event {
-	case "offer", "answer", "candidate":
-		return peerConn.WriteJSON(msg)
-	case "hangup":
-		// Notify the other client and clean up the room
+	remaining := handler.hub.Clients()
+	handler.logger.Warn("Drain deadline reached, closing remaining sessions", zap.Int("sessions", len(remaining)))
+	for _, client := range remaining {
+		client.stop()
+	}
+
+	closeCtx, cancel := context.WithTimeout(context.Background(), forceCloseWait)
+	defer cancel()
+	handler.waitSessions(closeCtx)
+
+	return ctx.Err()
+}
+
+// waitSessions reports whether every session ended before ctx was done.
+func (handler *Handler) waitSessions(ctx context.Context) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for handler.hub.Count() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// invalidMsgType labels the metrics of messages that failed to decode, whose
+// type cannot be trusted.
+const invalidMsgType = "invalid"
+
+// handleClientMsg relays a message of userID to the room. In sfu rooms,
+// sfuPeer takes the signaling instead.
+func (handler *Handler) handleClientMsg(ctx context.Context, roomID, userID string, sfuPeer *SFUPeer, raw []byte) (err error) {
+	receivedAt := time.Now()
+	msgType := invalidMsgType
+	defer func() {
+		handler.metrics.SignalingMessage(msgType)
+		handler.metrics.ObserveMessage(msgType, time.Since(receivedAt))
+
+		var protocolErr *ProtocolError
+		if errors.As(err, &protocolErr) && protocolErr.Code == ErrCodeRelayFailed {
+			handler.metrics.RelayError(msgType)
+		}
+	}()
+
+	msg, err := DecodeMessage(raw)
+	if err != nil {
+		return err
+	}
+	msgType = msg.Type
+
+	// Pings are answered right away, they are no signaling to trace
+	if msg.Type == EventPing {
+		return handler.pong(userID, msg)
 	}
 
+	ctx, span := handler.startRelay(ctx, msg)
+	defer func() {
+		if errors.Is(err, errHangup) {
+			tracing.End(span, nil)
+			return
+		}
+		tracing.End(span, err)
+	}()
+
+	log.Ctx(ctx, handler.logger).Debug("Received msg", zap.String("type", msg.Type), zap.String("id", msg.ID), zap.String("to", msg.To))
+
+	msg.From = userID
+	if msg.ID == "" {
+		msg.ID = ulid.Make().String()
+	}
+	span.SetAttributes(attribute.String("message.id", msg.ID))
+
+	// The recipients continue the trace of the relay
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	msg.Trace = carrier
+	if len(carrier) == 0 {
+		msg.Trace = nil
+	}
+
+	switch msg.Type {
+	case EventOffer, EventAnswer, EventCandidate:
+		if sfuPeer != nil {
+			return handler.signalSFU(ctx, roomID, sfuPeer, msg)
+		}
+
+		if msg.To == userID || !handler.hub.InRoom(roomID, msg.To) {
+			return newProtocolError(ErrCodeUnknownPeer, msg.ID, "peer %q is not in the room", msg.To)
+		}
+		if err := handler.hub.SendToUser(msg.To, msg); err != nil {
+			return newProtocolError(ErrCodeRelayFailed, msg.ID, "relay %s to %q: %v", msg.Type, msg.To, err)
+		}
+
+		switch msg.Type {
+		case EventOffer:
+			_, err = handler.roomService.AdvanceCall(ctx, roomID, room.CallSignalOffer)
+		case EventAnswer:
+			_, err = handler.roomService.AdvanceCall(ctx, roomID, room.CallSignalAnswer)
+		}
+		return err
+	case EventHangup:
+		if err := handler.broadcast(roomID, msg); err != nil {
+			return err
+		}
+		return errHangup
+	default:
+		if _, err := handler.roomService.UpdateMedia(ctx, roomID, userID, mediaChanges[msg.Type]); err != nil {
+			return err
+		}
+		return handler.broadcast(roomID, msg)
+	}
+}
+
+// pong answers a ping of userID with the round trip time of its connection.
+func (handler *Handler) pong(userID string, msg WebSocketMessage) error {
+	var ping PingData
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &ping); err != nil {
+			return err
+		}
+	}
+
+	pong := PongData{Timestamp: ping.Timestamp}
+	if client, ok := handler.hub.Client(userID); ok {
+		if conn := client.Connection(); conn != nil {
+			pong.RTTMs = conn.RTT().Milliseconds()
+		}
+	}
+	return handler.send(userID, EventPong, pong)
+}
+
+// startRelay starts the span of a client message. A message carrying trace
+// context continues that trace, linked to the session of its sender;
+// otherwise it belongs to the session trace.
+func (handler *Handler) startRelay(ctx context.Context, msg WebSocketMessage) (context.Context, trace.Span) {
+	options := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("message.type", msg.Type)),
+	}
+	if msg.To != "" {
+		options = append(options, trace.WithAttributes(attribute.String("message.to", msg.To)))
+	}
+
+	if len(msg.Trace) > 0 {
+		options = append(options, trace.WithLinks(trace.LinkFromContext(ctx)))
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(msg.Trace))
+	}
+
+	return tracer.Start(ctx, "rtc.relay "+msg.Type, options...)
+}
+
+// signalSFU hands the negotiation of a participant with the SFU to its
+// client. The call rings on the first offer of a participant and connects
+// once one answers an offer, which carries the tracks of the others.
+func (handler *Handler) signalSFU(ctx context.Context, roomID string, sfuPeer *SFUPeer, msg WebSocketMessage) error {
+	if msg.To != SFUPeerID {
+		return newProtocolError(ErrCodeUnknownPeer, msg.ID, "peer %q is not the sfu, signal %q in sfu rooms", msg.To, SFUPeerID)
+	}
+
+	if err := sfuPeer.HandleSignal(ctx, msg); err != nil {
+		var protocolErr *ProtocolError
+		if errors.As(err, &protocolErr) {
+			return err
+		}
+		return newProtocolError(ErrCodeNegotiationFailed, msg.ID, "%s: %v", msg.Type, err)
+	}
+
+	var err error
+	switch msg.Type {
+	case EventOffer:
+		_, err = handler.roomService.AdvanceCall(ctx, roomID, room.CallSignalOffer)
+	case EventAnswer:
+		_, err = handler.roomService.AdvanceCall(ctx, roomID, room.CallSignalAnswer)
+	}
+	return err
+}
+
+// broadcast relays msg from its sender to the rest of the room.
+func (handler *Handler) broadcast(roomID string, msg WebSocketMessage) error {
+	msg.To = ""
+	if err := handler.hub.BroadcastToRoom(roomID, msg, msg.From); err != nil {
+		return newProtocolError(ErrCodeRelayFailed, msg.ID, "relay %s: %v", msg.Type, err)
+	}
 	return nil
 }
+
+func (handler *Handler) sendRoomEvent(userID string, event room.Event) error {
+	switch event.EventName {
+	case room.EventNewComer, room.EventLeaveRoom:
+		peerID, _ := event.Data.(string)
+		return handler.send(userID, event.EventName, PeerData{UserID: peerID})
+	case room.EventCallState:
+		state, _ := event.CallState()
+		return handler.send(userID, event.EventName, CallStateData{State: state})
+	case room.EventExpiring:
+		endsAt, _ := event.Data.(int64)
+		return handler.send(userID, event.EventName, RoomExpiringData{EndsAt: endsAt})
+	default:
+		return handler.send(userID, event.EventName, event.Data)
+	}
+}
+
+func (handler *Handler) send(userID, msgType string, payload any) error {
+	msg, err := NewMessage(msgType, payload)
+	if err != nil {
+		return err
+	}
+
+	return handler.hub.SendToUser(userID, msg)
+}
+
+// sendPeerTimeout tells the room but userID that it timed out.
+func (handler *Handler) sendPeerTimeout(roomID, userID string) error {
+	msg, err := NewMessage(EventPeerTimeout, PeerData{UserID: userID})
+	if err != nil {
+		return err
+	}
+
+	return handler.hub.BroadcastToRoom(roomID, msg, userID)
+}
+
+func (handler *Handler) sendError(userID string, protocolErr *ProtocolError) {
+	if err := handler.send(userID, EventError, protocolErr.Data()); err != nil {
+		handler.logger.Error("Send error msg failed", zap.String("userID", userID), zap.Error(err))
+	}
+}
@@ -1,7 +1,557 @@
 package rtc
 
-import "sync"
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const (
+	writeWait     = 10 * time.Second // time allowed to write a single message to the peer
+	sendQueueSize = 64               // outbound messages buffered per connection
+	// replayBufferSize is how many of the last messages sent to a user are
+	// kept for a resume, and how many may be sent while it is disconnected
+	replayBufferSize = 256
+)
+
+var (
+	ErrClientNotFound = errors.New("ws hub: client not found")
+	ErrClientExists   = errors.New("ws hub: user already connected")
+	ErrSendQueueFull  = errors.New("ws hub: send queue full")
+	ErrReplayGap      = errors.New("ws hub: messages to resume from are no longer kept")
+	ErrPeerTimeout    = errors.New("ws hub: peer left its pings unanswered")
+)
+
+// Heartbeat is how a connection is kept alive: it is pinged every Interval
+// and given up once Misses pings in a row went unanswered. OnRTT, if set,
+// is called with the round trip time of every answered ping.
+type Heartbeat struct {
+	Interval time.Duration
+	Misses   int
+	OnRTT    func(rtt time.Duration)
+}
+
+// timeout is how long a connection may stay silent: the last ping it may
+// miss is sent at the end of Misses intervals, and its pong gets as long as
+// a write to arrive.
+func (heartbeat Heartbeat) timeout() time.Duration {
+	return heartbeat.Interval*time.Duration(heartbeat.Misses) + writeWait
+}
+
+// Client is the session of a user in a room. It outlives its WebSocket
+// connection: while detached, messages to the user are numbered and kept as
+// usual, for the connection that resumes the session to replay.
+type Client struct {
+	userID string
+	roomID string
+	token  string // resumes the session
+
+	mu   sync.Mutex
+	conn *Connection // nil while detached
+	// seq numbers the messages sent to the user; history keeps the last
+	// replayBufferSize of them
+	seq     uint64
+	history []sentFrame
+	// detachedAt is seq when the connection was lost
+	detachedAt uint64
+
+	resumed   chan *Connection
+	done      chan struct{}
+	ended     chan struct{}
+	closeOnce sync.Once
+}
+
+type sentFrame struct {
+	seq uint64
+	raw []byte
+}
+
+func (client *Client) UserID() string {
+	return client.userID
+}
+
+func (client *Client) RoomID() string {
+	return client.roomID
+}
+
+// Token is the secret the user resumes the session with.
+func (client *Client) Token() string {
+	return client.token
+}
+
+// Done is closed once the session is stopped.
+func (client *Client) Done() <-chan struct{} {
+	return client.done
+}
+
+// Ended is closed once the session is removed from the hub.
+func (client *Client) Ended() <-chan struct{} {
+	return client.ended
+}
+
+// Resumed delivers the connections that resume the session.
+func (client *Client) Resumed() <-chan *Connection {
+	return client.resumed
+}
+
+// Connection returns the current connection, nil while detached.
+func (client *Client) Connection() *Connection {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return client.conn
+}
+
+// Detach closes conn if it is still the connection of the session, which
+// then keeps messages for a resume. It reports whether it was.
+func (client *Client) Detach(conn *Connection) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.conn != conn || conn == nil {
+		return false
+	}
+	client.detachLocked()
+	return true
+}
+
+func (client *Client) detachLocked() {
+	client.conn.close()
+	client.conn = nil
+	client.detachedAt = client.seq
+}
+
+// replay returns the kept messages after lastSeq, the last message the user
+// received.
+func (client *Client) replay(lastSeq uint64) ([][]byte, error) {
+	if lastSeq > client.seq {
+		return nil, ErrReplayGap
+	}
+	if lastSeq == client.seq {
+		return nil, nil
+	}
+	if len(client.history) == 0 || client.history[0].seq > lastSeq+1 {
+		return nil, ErrReplayGap
+	}
+
+	start := int(lastSeq + 1 - client.history[0].seq)
+	frames := make([][]byte, 0, len(client.history)-start)
+	for _, frame := range client.history[start:] {
+		frames = append(frames, frame.raw)
+	}
+	return frames, nil
+}
+
+// CanResume reports why the session cannot be resumed by a user who last
+// received message lastSeq, if it cannot.
+func (client *Client) CanResume(lastSeq uint64) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	select {
+	case <-client.done:
+		return ErrClientNotFound
+	default:
+	}
+
+	_, err := client.replay(lastSeq)
+	return err
+}
+
+// Resume attaches ws to the session in place of its current connection, if
+// any. The new connection first gets notice, then the messages after
+// lastSeq, then whatever is sent from now on. It returns how many messages
+// are replayed.
+func (client *Client) Resume(ws *websocket.Conn, heartbeat Heartbeat, lastSeq uint64, notice func(replayed int) ([]byte, error), logger *zap.Logger) (int, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	select {
+	case <-client.done:
+		return 0, ErrClientNotFound
+	default:
+	}
+
+	frames, err := client.replay(lastSeq)
+	if err != nil {
+		return 0, err
+	}
+	raw, err := notice(len(frames))
+	if err != nil {
+		return 0, err
+	}
+
+	if client.conn != nil {
+		client.conn.close()
+	}
+	client.conn = newConnection(ws, heartbeat)
+	go client.conn.writePump(client.userID, append([][]byte{raw}, frames...), logger)
+
+	// Only the latest connection matters to the session
+	select {
+	case <-client.resumed:
+	default:
+	}
+	client.resumed <- client.conn
+
+	return len(frames), nil
+}
+
+func (client *Client) stop() {
+	client.closeOnce.Do(func() {
+		close(client.done)
+	})
+}
+
+// enqueue numbers msg, keeps it for a resume and queues it on the
+// connection. A connection whose queue is full is dropped; a detached
+// session that missed more messages than are kept is stopped.
+func (client *Client) enqueue(msg WebSocketMessage) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	select {
+	case <-client.done:
+		return ErrClientNotFound
+	default:
+	}
+
+	if client.conn == nil && client.seq-client.detachedAt >= replayBufferSize {
+		client.stop()
+		return ErrSendQueueFull
+	}
+
+	client.seq++
+	msg.Seq = client.seq
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		client.seq--
+		return err
+	}
+
+	client.history = append(client.history, sentFrame{seq: msg.Seq, raw: raw})
+	if len(client.history) > replayBufferSize {
+		client.history = slices.Delete(client.history, 0, len(client.history)-replayBufferSize)
+	}
+
+	if client.conn == nil {
+		return nil
+	}
+
+	select {
+	case client.conn.send <- raw:
+		return nil
+	default:
+		client.detachLocked()
+		return ErrSendQueueFull
+	}
+}
+
+// Connection is one WebSocket connection of a session. Only its writePump
+// goroutine ever writes to conn; everybody else enqueues on send.
+type Connection struct {
+	conn      *websocket.Conn
+	send      chan []byte
+	done      chan struct{}
+	heartbeat Heartbeat
+	// rtt is the round trip time of the last answered ping, in nanoseconds
+	rtt atomic.Int64
+
+	closeOnce sync.Once
+}
+
+func newConnection(conn *websocket.Conn, heartbeat Heartbeat) *Connection {
+	connection := &Connection{
+		conn:      conn,
+		send:      make(chan []byte, sendQueueSize),
+		done:      make(chan struct{}),
+		heartbeat: heartbeat,
+	}
+
+	conn.SetReadLimit(maxFrameSize)
+	_ = conn.SetReadDeadline(time.Now().Add(heartbeat.timeout()))
+	// Pings carry the time they were sent at, which their pong echoes
+	conn.SetPongHandler(func(appData string) error {
+		if sentAt, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			rtt := time.Since(time.Unix(0, sentAt))
+			connection.rtt.Store(int64(rtt))
+			if heartbeat.OnRTT != nil {
+				heartbeat.OnRTT(rtt)
+			}
+		}
+		return conn.SetReadDeadline(time.Now().Add(heartbeat.timeout()))
+	})
+
+	return connection
+}
+
+// ReadMessage reads the next frame from the connection. It must only be
+// called from a single goroutine. A peer that stays silent for the misses of
+// the heartbeat fails it with ErrPeerTimeout.
+func (connection *Connection) ReadMessage() ([]byte, error) {
+	_, raw, err := connection.conn.ReadMessage()
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, ErrPeerTimeout
+		}
+		return nil, err
+	}
+
+	_ = connection.conn.SetReadDeadline(time.Now().Add(connection.heartbeat.timeout()))
+	return raw, nil
+}
+
+// RTT is the round trip time of the last ping the peer answered, 0 before
+// the first.
+func (connection *Connection) RTT() time.Duration {
+	return time.Duration(connection.rtt.Load())
+}
+
+func (connection *Connection) close() {
+	connection.closeOnce.Do(func() {
+		close(connection.done)
+	})
+}
+
+// writePump writes prelude, then the queued messages, until the connection
+// is closed.
+func (connection *Connection) writePump(userID string, prelude [][]byte, logger *zap.Logger) {
+	defer func() {
+		if err := connection.conn.Close(); err != nil {
+			logger.Debug("WebSocket close failed", zap.String("userID", userID), zap.Error(err))
+		}
+	}()
+
+	write := func(raw []byte) error {
+		_ = connection.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		return connection.conn.WriteMessage(websocket.TextMessage, raw)
+	}
+
+	for _, raw := range prelude {
+		if err := write(raw); err != nil {
+			logger.Warn("WebSocket write failed", zap.String("userID", userID), zap.Error(err))
+			return
+		}
+	}
+
+	ticker := time.NewTicker(connection.heartbeat.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sentAt := strconv.FormatInt(time.Now().UnixNano(), 10)
+			if err := connection.conn.WriteControl(websocket.PingMessage, []byte(sentAt), time.Now().Add(writeWait)); err != nil {
+				logger.Warn("WebSocket ping failed", zap.String("userID", userID), zap.Error(err))
+				return
+			}
+		case raw := <-connection.send:
+			if err := write(raw); err != nil {
+				// The reader fails too, which detaches the connection
+				logger.Warn("WebSocket write failed", zap.String("userID", userID), zap.Error(err))
+				return
+			}
+		case <-connection.done:
+			// Flush whatever is still queued, e.g. a final error, before saying goodbye
+			for len(connection.send) > 0 {
+				if err := write(<-connection.send); err != nil {
+					return
+				}
+			}
+			_ = connection.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			_ = connection.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
+
+// WebsocketHub owns every session and its live WebSocket connection, and is
+// the only way for the signaling code to reach another user.
 type WebsocketHub struct {
-	clients sync.Map
+	mu       sync.RWMutex
+	clients  map[string]*Client            // user ID -> client
+	rooms    map[string]map[string]*Client // room ID -> user ID -> client
+	sessions map[string]*Client            // token -> client
+
+	logger *zap.Logger
+}
+
+type WebsocketHubParams struct {
+	fx.In
+
+	Logger *zap.Logger
+}
+
+func NewWebsocketHub(params WebsocketHubParams) *WebsocketHub {
+	return &WebsocketHub{
+		clients:  make(map[string]*Client),
+		rooms:    make(map[string]map[string]*Client),
+		sessions: make(map[string]*Client),
+		logger:   params.Logger,
+	}
+}
+
+// Register starts the session of the user in the room on conn and starts
+// its writer goroutine.
+func (hub *WebsocketHub) Register(roomID, userID string, conn *websocket.Conn, heartbeat Heartbeat) (*Client, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if _, ok := hub.clients[userID]; ok {
+		return nil, ErrClientExists
+	}
+
+	client := &Client{
+		userID:  userID,
+		roomID:  roomID,
+		token:   token,
+		conn:    newConnection(conn, heartbeat),
+		resumed: make(chan *Connection, 1),
+		done:    make(chan struct{}),
+		ended:   make(chan struct{}),
+	}
+
+	hub.clients[userID] = client
+	if hub.rooms[roomID] == nil {
+		hub.rooms[roomID] = make(map[string]*Client)
+	}
+	hub.rooms[roomID][userID] = client
+	hub.sessions[token] = client
+
+	go client.conn.writePump(userID, nil, hub.logger)
+
+	return client, nil
+}
+
+// Unregister removes the session from the hub and closes its connection.
+func (hub *WebsocketHub) Unregister(client *Client) {
+	hub.mu.Lock()
+	if hub.clients[client.userID] == client {
+		delete(hub.clients, client.userID)
+	}
+	if members, ok := hub.rooms[client.roomID]; ok && members[client.userID] == client {
+		delete(members, client.userID)
+		if len(members) == 0 {
+			delete(hub.rooms, client.roomID)
+		}
+	}
+	delete(hub.sessions, client.token)
+	hub.mu.Unlock()
+
+	client.stop()
+	client.Detach(client.Connection())
+	close(client.ended)
+}
+
+// Clients returns a snapshot of the sessions.
+func (hub *WebsocketHub) Clients() []*Client {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(hub.clients))
+	for _, client := range hub.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+func (hub *WebsocketHub) Count() int {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+
+	return len(hub.clients)
+}
+
+// Client returns the session of the user, if it has one.
+func (hub *WebsocketHub) Client(userID string) (*Client, bool) {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+
+	client, ok := hub.clients[userID]
+	return client, ok
+}
+
+// Session returns the session resumed with token.
+func (hub *WebsocketHub) Session(token string) (*Client, bool) {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+
+	client, ok := hub.sessions[token]
+	return client, ok
+}
+
+func (hub *WebsocketHub) InRoom(roomID, userID string) bool {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+
+	_, ok := hub.rooms[roomID][userID]
+	return ok
+}
+
+// SendToUser queues msg for the user's session. A connection whose queue
+// is full is considered too slow and gets dropped.
+func (hub *WebsocketHub) SendToUser(userID string, msg WebSocketMessage) error {
+	hub.mu.RLock()
+	client, ok := hub.clients[userID]
+	hub.mu.RUnlock()
+	if !ok {
+		return ErrClientNotFound
+	}
+
+	return hub.send(client, msg)
+}
+
+// BroadcastToRoom queues msg for every session in the room except the given
+// user IDs.
+func (hub *WebsocketHub) BroadcastToRoom(roomID string, msg WebSocketMessage, except ...string) error {
+	hub.mu.RLock()
+	targets := make([]*Client, 0, len(hub.rooms[roomID]))
+	for userID, client := range hub.rooms[roomID] {
+		if !slices.Contains(except, userID) {
+			targets = append(targets, client)
+		}
+	}
+	hub.mu.RUnlock()
+
+	var errs []error
+	for _, client := range targets {
+		if err := hub.send(client, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (hub *WebsocketHub) send(client *Client, msg WebSocketMessage) error {
+	err := client.enqueue(msg)
+	if errors.Is(err, ErrSendQueueFull) {
+		hub.logger.Warn("Send queue full, disconnecting slow client", zap.String("roomID", client.roomID), zap.String("userID", client.userID))
+	}
+	return err
+}
+
+func newSessionToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
 }
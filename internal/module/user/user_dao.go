@@ -2,20 +2,27 @@ package user
 
 import (
 	"time"
+)
+
+// Status is the presence of a user: online while it holds a connection,
+// either a presence stream or a call.
+type Status string
 
-	"github.com/gorilla/websocket"
+const (
+	StatusOffline Status = "offline"
+	StatusOnline  Status = "online"
+	StatusAway    Status = "away"    // online, set away by the user
+	StatusInCall  Status = "in_call" // in a call, whether away or not
 )
 
 type User struct {
-	ID         string          `json:"id"`
-	Conn       *websocket.Conn `json:"-"`
-	LastActive time.Time       `json:"last_active,omitzero"`
+	ID         string    `json:"id"`
+	Online     bool      `json:"online"`            // has a live connection
+	Status     Status    `json:"status,omitempty"`  // filled in from the presence of the user
+	RoomID     string    `json:"room_id,omitempty"` // of the call, when in_call
+	LastActive time.Time `json:"last_active,omitzero"`
 }
 
 func (user User) Id() string {
 	return user.ID
 }
-
-func (user User) IsOnline() bool {
-	return user.Conn == nil || time.Since(user.LastActive) > 5*time.Minute
-}
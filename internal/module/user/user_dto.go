@@ -0,0 +1,34 @@
+package user
+
+// EventPresence is the event of presence changes on a presence stream.
+const EventPresence = "presence"
+
+// Notification is an event on the presence streams of a user, sent as a
+// server-sent event named Event with Data as JSON: EventPresence with
+// Presence, or whatever other modules Notify the user of.
+type Notification struct {
+	Event string
+	Data  any
+}
+
+// Presence is the presence of a user as streamed to its watchers.
+type Presence struct {
+	UserID string `json:"user_id"`
+	Status Status `json:"status"`
+	RoomID string `json:"room_id,omitempty"` // of the call, when in_call
+	Since  int64  `json:"since"`             // unix seconds, when the status last changed
+}
+
+type UpdatePresenceRequest struct {
+	Status Status `json:"status"` // online or away
+}
+
+type WatchPresenceRequest struct {
+	UserIDs string `query:"user_ids"` // comma separated, at most maxWatchedUsers
+}
+
+type ListUserRequest struct {
+	Limit  int    `query:"limit"`
+	Cursor string `query:"cursor"`
+	Sort   string `query:"sort"` // id or last_active, "-" prefix for descending
+}
@@ -1,9 +1,17 @@
 package user
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	"vidcall/internal/common"
+	"vidcall/pkg/log"
 	"vidcall/pkg/repository"
 
 	"go.uber.org/fx"
@@ -13,13 +21,15 @@ import (
 var Module = fx.Module("user",
 	fx.Provide(
 		fx.Private,
-		fx.Annotate(
-			repository.NewSyncRepository[string, User],
-			fx.As(new(repository.Repository[string, User])),
-		),
+		func(store *repository.Store) (repository.Repository[string, User], error) {
+			return repository.New[string, User](store, "users")
+		},
 	),
 	fx.Provide(NewService),
 	fx.Provide(NewHandler),
+	fx.Invoke(func(lc fx.Lifecycle, service *Service) {
+		lc.Append(fx.Hook{OnStart: service.ResetPresence})
+	}),
 )
 
 type Handler struct {
@@ -42,8 +52,19 @@ func NewHandler(params HandlerParams) *Handler {
 }
 
 func (handler *Handler) ListUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := handler.service.ListUsers(r.Context())
+	var req ListUserRequest
+	if err := common.BindRequest(r, &req); err != nil {
+		http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	users, err := handler.service.ListUsers(r.Context(), req)
 	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) || errors.Is(err, repository.ErrInvalidSort) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		http.Error(w, "Failed to list users", http.StatusInternalServerError)
 		return
 	}
@@ -73,20 +94,143 @@ func (handler *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (handler *Handler) CreateUser(w http.ResponseWriter, r *http.Request) {
-	var user User
-	if err := common.BindRequest(r, &user); err != nil {
+const (
+	// maxWatchedUsers bounds the contact list of a presence stream
+	maxWatchedUsers = 200
+	// presenceKeepAlive is how often an idle presence stream is written to,
+	// which also keeps its user active
+	presenceKeepAlive = 30 * time.Second
+)
+
+// UpdatePresence sets the caller away or back online.
+func (handler *Handler) UpdatePresence(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req UpdatePresenceRequest
+	if err := common.BindRequest(r, &req); err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
+	if req.Status != StatusOnline && req.Status != StatusAway {
+		http.Error(w, "Status must be online or away", http.StatusBadRequest)
+		return
+	}
 
-	if _, err := handler.service.CreateUser(r.Context(), user); err != nil {
-		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+	presence, err := handler.service.SetAway(r.Context(), userID, req.Status == StatusAway)
+	if err != nil {
+		if errors.Is(err, ErrOffline) {
+			http.Error(w, "User is offline, connect first", http.StatusConflict)
+			return
+		}
+
+		log.Ctx(r.Context(), handler.logger).Error("Update presence failed", zap.Error(err))
+		http.Error(w, "Failed to update presence", http.StatusInternalServerError)
 		return
 	}
 
-	if err := common.WriteResponse(w, http.StatusCreated, user); err != nil {
+	if err := common.WriteResponse(w, http.StatusOK, presence); err != nil {
 		http.Error(w, "Failed to write response", http.StatusInternalServerError)
 		return
 	}
 }
+
+// WatchPresence streams the presence of the users in user_ids as
+// server-sent "presence" events carrying Presence, starting with the current
+// one of each, along with the other notifications of the caller. The stream
+// keeps its caller online; when it ends, the client subscribes again.
+func (handler *Handler) WatchPresence(w http.ResponseWriter, r *http.Request) {
+	userID, err := common.GetUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req WatchPresenceRequest
+	if err := common.BindRequest(r, &req); err != nil {
+		http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var userIDs []string
+	for _, id := range strings.Split(req.UserIDs, ",") {
+		if id = strings.TrimSpace(id); id != "" && !slices.Contains(userIDs, id) {
+			userIDs = append(userIDs, id)
+		}
+	}
+	if len(userIDs) == 0 || len(userIDs) > maxWatchedUsers {
+		http.Error(w, fmt.Sprintf("Between 1 and %d user_ids are required", maxWatchedUsers), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Cleanup runs once the request is canceled, so it is detached from it
+	ctx := context.WithoutCancel(r.Context())
+	logger := log.Ctx(ctx, handler.logger)
+
+	notifications, stop, err := handler.service.WatchPresence(ctx, userID, userIDs)
+	if err != nil {
+		logger.Error("Watch presence failed", zap.Error(err))
+		http.Error(w, "Failed to watch presence", http.StatusInternalServerError)
+		return
+	}
+	defer stop()
+
+	if _, err := handler.service.Connect(ctx, userID); err != nil {
+		logger.Error("Connect user failed", zap.Error(err))
+		http.Error(w, "Failed to watch presence", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		if _, err := handler.service.Disconnect(ctx, userID); err != nil {
+			logger.Error("Disconnect user failed", zap.Error(err))
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(presenceKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := handler.service.UpdateActive(ctx, userID); err != nil {
+				logger.Error("Update user active failed", zap.Error(err))
+				return
+			}
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case notification, ok := <-notifications:
+			if !ok {
+				logger.Info("Presence stream closed")
+				return
+			}
+
+			raw, err := json.Marshal(notification.Data)
+			if err != nil {
+				logger.Error("Encode notification failed", zap.String("event", notification.Event), zap.Error(err))
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", notification.Event, raw); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
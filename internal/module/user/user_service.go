@@ -3,30 +3,78 @@ package user
 import (
 	"context"
 	"errors"
+	"strings"
+	"sync"
 	"time"
+
+	"vidcall/internal/module/metrics"
 	"vidcall/pkg/repository"
 
 	"go.uber.org/fx"
 )
 
+// ErrOffline rejects presence changes of a user without a connection.
+var ErrOffline = errors.New("user is offline")
+
+// presenceBuffer is how many notifications a watcher may lag behind before
+// its stream is closed.
+const presenceBuffer = 64
+
 type Service struct {
-	repo repository.Repository[string, User]
+	repo    repository.Repository[string, User]
+	metrics metrics.Recorder
+
+	// mu serialises presence changes, together with the online flag they
+	// keep stored, and guards watchers
+	mu sync.Mutex
+	// presences are the users holding a connection, keyed by user ID
+	presences map[string]*presence
+	watchers  map[*watcher]struct{}
+}
+
+// presence is what keeps a user online: presence streams and a call.
+type presence struct {
+	streams int
+	roomID  string // of the call the user is in
+	away    bool
+	status  Status // as last published
+	since   time.Time
+}
+
+// watcher is a presence stream of owner, following the presence of some
+// users.
+type watcher struct {
+	owner         string
+	userIDs       map[string]bool
+	notifications chan Notification
 }
 
 type ServiceParams struct {
 	fx.In
 
+	Metrics    metrics.Recorder
 	Repository repository.Repository[string, User]
 }
 
 func NewService(params ServiceParams) *Service {
 	return &Service{
-		repo: params.Repository,
+		repo:      params.Repository,
+		metrics:   params.Metrics,
+		presences: make(map[string]*presence),
+		watchers:  make(map[*watcher]struct{}),
 	}
 }
 
 func (service *Service) GetUser(ctx context.Context, ID string) (User, error) {
-	return service.repo.Find(ctx, ID)
+	user, err := service.repo.Find(ctx, ID)
+	if err != nil {
+		return User{}, err
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	return service.withPresence(user), nil
 }
 
 func (service *Service) CreateUser(ctx context.Context, user User) (User, error) {
@@ -35,6 +83,15 @@ func (service *Service) CreateUser(ctx context.Context, user User) (User, error)
 }
 
 func (service *Service) UpdateActive(ctx context.Context, userID string) (User, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	return service.updateActive(ctx, userID)
+}
+
+// updateActive is UpdateActive for callers holding mu, which keeps it from
+// writing back an online flag being changed.
+func (service *Service) updateActive(ctx context.Context, userID string) (User, error) {
 	user, err := service.repo.Find(ctx, userID)
 	if err != nil {
 		if !errors.Is(err, repository.ErrNotFound) {
@@ -52,12 +109,312 @@ func (service *Service) UpdateActive(ctx context.Context, userID string) (User,
 	return service.repo.Update(ctx, user)
 }
 
+// Connect keeps the user online for a presence stream, creating it on first
+// sight.
+func (service *Service) Connect(ctx context.Context, userID string) (User, error) {
+	return service.updatePresence(ctx, userID, func(current *presence) { current.streams++ })
+}
+
+// Disconnect ends a presence stream of the user.
+func (service *Service) Disconnect(ctx context.Context, userID string) (User, error) {
+	return service.updatePresence(ctx, userID, func(current *presence) {
+		current.streams = max(current.streams-1, 0)
+	})
+}
+
+// JoinCall shows the user in a call in the room until LeaveCall, creating it
+// on first sight.
+func (service *Service) JoinCall(ctx context.Context, userID, roomID string) (User, error) {
+	return service.updatePresence(ctx, userID, func(current *presence) { current.roomID = roomID })
+}
+
+func (service *Service) LeaveCall(ctx context.Context, userID string) (User, error) {
+	return service.updatePresence(ctx, userID, func(current *presence) { current.roomID = "" })
+}
+
+// SetAway sets the user away, or back online, for as long as it stays
+// connected. A user in a call shows in_call either way.
+func (service *Service) SetAway(ctx context.Context, userID string, away bool) (Presence, error) {
+	user, err := service.updatePresence(ctx, userID, func(current *presence) {
+		if current.online() {
+			current.away = away
+		}
+	})
+	if err != nil {
+		return Presence{}, err
+	}
+	if !user.Online {
+		return Presence{}, ErrOffline
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	return service.presences[userID].view(userID), nil
+}
+
+// WatchPresence streams the presence of userIDs to ownerID, starting with
+// the current one of each, and whatever ownerID is notified of, until stop
+// is called. A watcher that falls presenceBuffer notifications behind has
+// its stream closed, and subscribes again.
+func (service *Service) WatchPresence(ctx context.Context, ownerID string, userIDs []string) (<-chan Notification, func(), error) {
+	current := &watcher{
+		owner:         ownerID,
+		userIDs:       make(map[string]bool, len(userIDs)),
+		notifications: make(chan Notification, presenceBuffer+len(userIDs)),
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	for _, userID := range userIDs {
+		current.userIDs[userID] = true
+
+		if state, ok := service.presences[userID]; ok {
+			current.notifications <- Notification{Event: EventPresence, Data: state.view(userID)}
+			continue
+		}
+
+		offline := Presence{UserID: userID, Status: StatusOffline}
+		user, err := service.repo.Find(ctx, userID)
+		switch {
+		case err == nil:
+			offline.Since = user.LastActive.Unix()
+		case !errors.Is(err, repository.ErrNotFound):
+			return nil, nil, err
+		}
+		current.notifications <- Notification{Event: EventPresence, Data: offline}
+	}
+	service.watchers[current] = struct{}{}
+
+	stop := func() {
+		service.mu.Lock()
+		defer service.mu.Unlock()
+
+		service.unwatch(current)
+	}
+	return current.notifications, stop, nil
+}
+
+// Notify sends an event to the presence streams of userID and reports
+// whether it has any.
+func (service *Service) Notify(userID string, notification Notification) bool {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	return service.deliver(notification, func(current *watcher) bool { return current.owner == userID }) > 0
+}
+
+// CloseWatchers ends every presence stream, when the server shuts down.
+func (service *Service) CloseWatchers() {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	for current := range service.watchers {
+		service.unwatch(current)
+	}
+}
+
+// updatePresence applies change to the presence of userID, publishes its
+// status when it changed and keeps the stored online flag in step.
+func (service *Service) updatePresence(ctx context.Context, userID string, change func(*presence)) (User, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	user, err := service.updateActive(ctx, userID)
+	if err != nil {
+		return User{}, err
+	}
+
+	current, wasOnline := service.presences[userID]
+	if !wasOnline {
+		current = &presence{status: StatusOffline}
+	}
+	change(current)
+
+	online := current.online()
+	switch {
+	case online && !wasOnline:
+		service.presences[userID] = current
+		service.metrics.UsersOnline(1)
+	case !online && wasOnline:
+		delete(service.presences, userID)
+		service.metrics.UsersOnline(-1)
+	}
+
+	if status := current.currentStatus(); status != current.status {
+		current.status = status
+		current.since = time.Now()
+		service.publish(current.view(userID))
+	}
+
+	if user.Online != online {
+		user.Online = online
+		if user, err = service.repo.Update(ctx, user); err != nil {
+			return User{}, err
+		}
+	}
+	return service.withPresence(user), nil
+}
+
+// publish delivers change to the watchers of its user. Callers hold mu.
+func (service *Service) publish(change Presence) {
+	service.deliver(Notification{Event: EventPresence, Data: change}, func(current *watcher) bool {
+		return current.userIDs[change.UserID]
+	})
+}
+
+// deliver sends notification to the watchers matching to and returns to
+// how many. Callers hold mu.
+func (service *Service) deliver(notification Notification, to func(*watcher) bool) int {
+	delivered := 0
+	for current := range service.watchers {
+		if !to(current) {
+			continue
+		}
+
+		select {
+		case current.notifications <- notification:
+			delivered++
+		default:
+			service.unwatch(current)
+		}
+	}
+	return delivered
+}
+
+// unwatch closes the stream of a watcher. Callers hold mu.
+func (service *Service) unwatch(current *watcher) {
+	if _, ok := service.watchers[current]; ok {
+		delete(service.watchers, current)
+		close(current.notifications)
+	}
+}
+
+// withPresence fills in the presence of user. Callers hold mu.
+func (service *Service) withPresence(user User) User {
+	current, ok := service.presences[user.ID]
+	if !ok {
+		user.Online, user.Status, user.RoomID = false, StatusOffline, ""
+		return user
+	}
+
+	view := current.view(user.ID)
+	user.Online, user.Status, user.RoomID = true, view.Status, view.RoomID
+	return user
+}
+
+func (current *presence) online() bool {
+	return current.streams > 0 || current.roomID != ""
+}
+
+func (current *presence) currentStatus() Status {
+	switch {
+	case current.roomID != "":
+		return StatusInCall
+	case current.streams == 0:
+		return StatusOffline
+	case current.away:
+		return StatusAway
+	default:
+		return StatusOnline
+	}
+}
+
+func (current *presence) view(userID string) Presence {
+	view := Presence{UserID: userID, Status: current.status, Since: current.since.Unix()}
+	if current.status == StatusInCall {
+		view.RoomID = current.roomID
+	}
+	return view
+}
+
+// ResetPresence marks every stored user offline, since no connection
+// survives a restart.
+func (service *Service) ResetPresence(ctx context.Context) error {
+	users, err := service.repo.FindList(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if !user.Online {
+			continue
+		}
+
+		user.Online = false
+		if _, err := service.repo.Update(ctx, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MarkInactive takes users offline whose last activity is older than idle
+// and who hold no connection, and returns how many were changed.
+func (service *Service) MarkInactive(ctx context.Context, idle time.Duration) (int, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	deadline := time.Now().Add(-idle)
+	stale, err := service.repo.FindPage(ctx, repository.Query[User]{
+		Where: []repository.Predicate[User]{
+			func(user User) bool { return user.Online && user.LastActive.Before(deadline) },
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, user := range stale.Items {
+		if _, ok := service.presences[user.ID]; ok {
+			continue
+		}
+
+		user.Online = false
+		if _, err := service.repo.Update(ctx, user); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+
+	return changed, nil
+}
+
 func (service *Service) DeleteUser(ctx context.Context, userID string) error {
 	return service.repo.Delete(ctx, userID)
 }
 
-func (service *Service) ListUsers(ctx context.Context) ([]User, error) {
-	return service.repo.FindList(ctx)
+// userSortFields are the fields GET /users may sort on.
+var userSortFields = map[string]func(a, b User) int{
+	"id":          func(a, b User) int { return strings.Compare(a.ID, b.ID) },
+	"last_active": func(a, b User) int { return a.LastActive.Compare(b.LastActive) },
+}
+
+func (service *Service) ListUsers(ctx context.Context, req ListUserRequest) (repository.Page[User], error) {
+	sortKeys, err := repository.ParseSort(req.Sort, userSortFields)
+	if err != nil {
+		return repository.Page[User]{}, err
+	}
+
+	page, err := service.repo.FindPage(ctx, repository.Query[User]{
+		Sort:   sortKeys,
+		Cursor: req.Cursor,
+		Limit:  repository.PageSize(req.Limit),
+	})
+	if err != nil {
+		return repository.Page[User]{}, err
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	for i, user := range page.Items {
+		page.Items[i] = service.withPresence(user)
+	}
+	return page, nil
 }
 
 func (service *Service) UpdateUser(ctx context.Context, user User) (User, error) {
@@ -1,28 +1,54 @@
 package main
 
 import (
+	"time"
+
 	"vidcall/app"
 	"vidcall/config"
+	"vidcall/internal/module/auth"
+	"vidcall/internal/module/call"
+	"vidcall/internal/module/cron"
+	"vidcall/internal/module/history"
+	"vidcall/internal/module/metrics"
+	"vidcall/internal/module/recording"
 	"vidcall/internal/module/room"
 	"vidcall/internal/module/rtc"
 	"vidcall/internal/module/user"
 	"vidcall/internal/module/view"
 	"vidcall/pkg/log"
+	"vidcall/pkg/repository"
+	"vidcall/pkg/stun"
+	"vidcall/pkg/tracing"
 
 	"go.uber.org/fx"
 	"go.uber.org/fx/fxevent"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 func main() {
 	fx.New(
+		// leave room for the server to drain calls on shutdown
+		fx.StopTimeout(config.MaxDrainTimeout+time.Minute),
 		fx.WithLogger(func(log *zap.Logger) fxevent.Logger {
-			return &fxevent.ZapLogger{Logger: log}
+			logger := &fxevent.ZapLogger{Logger: log}
+			// dependency wiring is only worth seeing when debugging
+			logger.UseLogLevel(zapcore.DebugLevel)
+			return logger
 		}),
 
 		config.Module,
 		log.Module,
+		tracing.Module,
+		repository.Module,
+		stun.Module,
 		app.Module,
+		auth.Module,
+		call.Module,
+		cron.Module,
+		history.Module,
+		metrics.Module,
+		recording.Module,
 		room.Module,
 		rtc.Module,
 		user.Module,
@@ -0,0 +1,33 @@
+package log
+
+import (
+	"context"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+type fieldsKey struct{}
+
+// WithFields returns a copy of ctx carrying fields, in addition to the ones it
+// already carries, for Ctx to add to log lines.
+func WithFields(ctx context.Context, fields ...zap.Field) context.Context {
+	carried, _ := ctx.Value(fieldsKey{}).([]zap.Field)
+	return context.WithValue(ctx, fieldsKey{}, append(slices.Clip(carried), fields...))
+}
+
+// Ctx returns logger with the fields carried by ctx, such as the request,
+// room and user IDs.
+func Ctx(ctx context.Context, logger *zap.Logger) *zap.Logger {
+	carried, _ := ctx.Value(fieldsKey{}).([]zap.Field)
+	if len(carried) == 0 {
+		return logger
+	}
+	return logger.With(carried...)
+}
+
+// RequestID, RoomID, UserID and TraceID are the fields correlating log lines.
+func RequestID(id string) zap.Field { return zap.String("requestID", id) }
+func RoomID(id string) zap.Field    { return zap.String("roomID", id) }
+func UserID(id string) zap.Field    { return zap.String("userID", id) }
+func TraceID(id string) zap.Field   { return zap.String("traceID", id) }
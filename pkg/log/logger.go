@@ -1,14 +1,90 @@
 package log
 
 import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"vidcall/config"
+
 	"go.uber.org/fx"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var Module = fx.Module("log",
 	fx.Provide(NewLogger),
 )
 
-func NewLogger() *zap.Logger {
-	return zap.NewExample()
+type LoggerParams struct {
+	fx.In
+
+	Lifecycle fx.Lifecycle
+	Config    config.Config
+	Watcher   *config.Watcher
+}
+
+// NewLogger builds the production logger described by the log section of the
+// config. Its level follows log.level across config reloads.
+func NewLogger(params LoggerParams) (*zap.Logger, error) {
+	cfg := params.Config.Log
+
+	level, err := zap.ParseAtomicLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	encoderConfig.EncodeDuration = zapcore.StringDurationEncoder
+
+	var encoder zapcore.Encoder
+	if cfg.Encoding == "console" {
+		encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	} else {
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	}
+
+	var output io.Writer = os.Stdout
+	if cfg.File.Path != "" {
+		file := &lumberjack.Logger{
+			Filename:   cfg.File.Path,
+			MaxSize:    cfg.File.MaxSizeMB,
+			MaxBackups: cfg.File.MaxBackups,
+			MaxAge:     cfg.File.MaxAgeDays,
+			Compress:   cfg.File.Compress,
+		}
+		output = file
+		params.Lifecycle.Append(fx.Hook{
+			OnStop: func(context.Context) error {
+				return file.Close()
+			},
+		})
+	}
+
+	core := zapcore.NewCore(encoder, zapcore.Lock(zapcore.AddSync(output)), level)
+	if cfg.Sampling.Initial > 0 {
+		core = zapcore.NewSamplerWithOptions(core, time.Second, cfg.Sampling.Initial, cfg.Sampling.Thereafter)
+	}
+
+	logger := zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
+
+	params.Lifecycle.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			// Syncing stdout fails on some platforms, which is harmless
+			_ = logger.Sync()
+			return nil
+		},
+	})
+
+	config.Subscribe(params.Watcher, func(c config.Config) string { return c.Log.Level }, func(name string) {
+		// the reloaded config has been validated, so the level parses
+		_ = level.UnmarshalText([]byte(name))
+		logger.Info("Changed log level", zap.String("level", name))
+	})
+
+	return logger, nil
 }
@@ -0,0 +1,200 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The IVF container and the parts of RFC 7741 needed to store a VP8 stream.
+const (
+	ivfFileHeaderSize  = 32
+	ivfFrameHeaderSize = 12
+
+	// vp8ClockRate is the RTP clock of VP8, used as the IVF time base
+	vp8ClockRate = 90000
+)
+
+var errBadVP8 = errors.New("media: malformed VP8 payload")
+
+// IVFWriter stores a VP8 track in an IVF file. Frames are reassembled from
+// their packets and dropped when one of them is lost; the file starts at the
+// first keyframe.
+type IVFWriter struct {
+	w io.Writer
+
+	// frame is being reassembled from the packets of timestamp frameTimestamp
+	frame          []byte
+	frameTimestamp uint32
+	assembling     bool
+	nextSequence   uint16
+	sequenced      bool
+
+	// keyframed is set once the first keyframe is written, at firstTimestamp
+	keyframed      bool
+	firstTimestamp uint32
+	width, height  uint16
+	frames         uint32
+}
+
+// NewIVFWriter writes the IVF header to w and returns the writer for the
+// packets. When w is an io.Seeker, Close fills in the frame size and count
+// of the header; Close closes w when it is an io.Closer.
+func NewIVFWriter(w io.Writer) (*IVFWriter, error) {
+	header := make([]byte, ivfFileHeaderSize)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:8], ivfFileHeaderSize)
+	copy(header[8:12], "VP80")
+	binary.LittleEndian.PutUint32(header[16:20], vp8ClockRate)
+	binary.LittleEndian.PutUint32(header[20:24], 1)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &IVFWriter{w: w}, nil
+}
+
+// WriteRTP adds the VP8 payload of packet to the current frame, and writes
+// the frame on its last packet. Malformed payloads drop the frame.
+func (writer *IVFWriter) WriteRTP(packet Packet) error {
+	if writer.sequenced && packet.SequenceNumber != writer.nextSequence {
+		writer.assembling = false
+	}
+	writer.nextSequence = packet.SequenceNumber + 1
+	writer.sequenced = true
+
+	payload, start, err := vp8Payload(packet.Payload)
+	if err != nil {
+		writer.assembling = false
+		return nil
+	}
+
+	if start {
+		writer.frame = writer.frame[:0]
+		writer.frameTimestamp = packet.Timestamp
+		writer.assembling = true
+	}
+	if !writer.assembling || packet.Timestamp != writer.frameTimestamp {
+		writer.assembling = false
+		return nil
+	}
+
+	writer.frame = append(writer.frame, payload...)
+	if !packet.Marker {
+		return nil
+	}
+	writer.assembling = false
+	return writer.writeFrame()
+}
+
+// Close completes the header and closes the underlying writer.
+func (writer *IVFWriter) Close() error {
+	var err error
+	if seeker, ok := writer.w.(io.WriteSeeker); ok {
+		err = writer.completeHeader(seeker)
+	}
+	if closer, ok := writer.w.(io.Closer); ok {
+		err = errors.Join(err, closer.Close())
+	}
+	return err
+}
+
+func (writer *IVFWriter) writeFrame() error {
+	frame := writer.frame
+	if len(frame) == 0 {
+		return nil
+	}
+
+	// The first bit of the frame tag is 0 on keyframes, whose header
+	// carries the picture size after a start code
+	if frame[0]&0x01 == 0 {
+		if len(frame) >= 10 && frame[3] == 0x9D && frame[4] == 0x01 && frame[5] == 0x2A {
+			writer.width = binary.LittleEndian.Uint16(frame[6:8]) & 0x3FFF
+			writer.height = binary.LittleEndian.Uint16(frame[8:10]) & 0x3FFF
+		}
+		if !writer.keyframed {
+			writer.keyframed = true
+			writer.firstTimestamp = writer.frameTimestamp
+		}
+	}
+	if !writer.keyframed {
+		return nil
+	}
+
+	header := make([]byte, ivfFrameHeaderSize, ivfFrameHeaderSize+len(frame))
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(frame)))
+	binary.LittleEndian.PutUint64(header[4:12], uint64(writer.frameTimestamp-writer.firstTimestamp))
+	if _, err := writer.w.Write(append(header, frame...)); err != nil {
+		return err
+	}
+	writer.frames++
+	return nil
+}
+
+func (writer *IVFWriter) completeHeader(seeker io.WriteSeeker) error {
+	end, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint16(size[0:2], writer.width)
+	binary.LittleEndian.PutUint16(size[2:4], writer.height)
+	if _, err := seeker.Seek(12, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := seeker.Write(size); err != nil {
+		return err
+	}
+
+	if _, err := seeker.Seek(24, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := seeker.Write(binary.LittleEndian.AppendUint32(nil, writer.frames)); err != nil {
+		return err
+	}
+
+	_, err = seeker.Seek(end, io.SeekStart)
+	return err
+}
+
+// vp8Payload strips the VP8 payload descriptor and reports whether the
+// payload starts a frame.
+func vp8Payload(payload []byte) ([]byte, bool, error) {
+	if len(payload) < 1 {
+		return nil, false, errBadVP8
+	}
+
+	descriptor := payload[0]
+	offset := 1
+	if descriptor&0x80 != 0 { // X: extension byte
+		if len(payload) < 2 {
+			return nil, false, errBadVP8
+		}
+		extension := payload[1]
+		offset++
+		if extension&0x80 != 0 { // I: picture ID, 7 or 15 bits
+			if len(payload) <= offset {
+				return nil, false, errBadVP8
+			}
+			if payload[offset]&0x80 != 0 {
+				offset += 2
+			} else {
+				offset++
+			}
+		}
+		if extension&0x40 != 0 { // L: TL0PICIDX
+			offset++
+		}
+		if extension&0x30 != 0 { // T or K: TID/KEYIDX
+			offset++
+		}
+	}
+	if len(payload) <= offset {
+		return nil, false, errBadVP8
+	}
+
+	// S set on partition 0
+	start := descriptor&0x10 != 0 && descriptor&0x07 == 0
+	return payload[offset:], start, nil
+}
@@ -0,0 +1,263 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// seekBuffer is an in memory io.WriteSeeker, for Close to complete the
+// header.
+type seekBuffer struct {
+	data   []byte
+	offset int
+}
+
+func (buffer *seekBuffer) Write(p []byte) (int, error) {
+	if end := buffer.offset + len(p); end > len(buffer.data) {
+		buffer.data = append(buffer.data, make([]byte, end-len(buffer.data))...)
+	}
+	buffer.offset += copy(buffer.data[buffer.offset:], p)
+	return len(p), nil
+}
+
+func (buffer *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(buffer.offset)
+	case io.SeekEnd:
+		offset += int64(len(buffer.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	buffer.offset = int(offset)
+	return offset, nil
+}
+
+// keyframe is the start of a VP8 keyframe of width x height: a frame tag
+// with the keyframe bit cleared, the start code and the picture size.
+func keyframe(width, height uint16, data ...byte) []byte {
+	frame := []byte{0x50, 0x00, 0x00, 0x9D, 0x01, 0x2A}
+	frame = binary.LittleEndian.AppendUint16(frame, width)
+	frame = binary.LittleEndian.AppendUint16(frame, height)
+	return append(frame, data...)
+}
+
+// interframe is a VP8 frame with the keyframe bit set, i.e. not a keyframe.
+func interframe(data ...byte) []byte {
+	return append([]byte{0x01}, data...)
+}
+
+// vp8 is an RTP payload: a payload descriptor then part of a frame.
+func vp8(descriptor []byte, frame []byte) []byte {
+	return append(append([]byte{}, descriptor...), frame...)
+}
+
+// Payload descriptors.
+var (
+	vp8Start    = []byte{0x10} // S, partition 0
+	vp8Continue = []byte{0x00}
+	// X, I with a 15 bit picture ID, L and T/K
+	vp8Extended = []byte{0x90, 0xF0, 0x81, 0x23, 0x05, 0x20}
+)
+
+type ivfFrame struct {
+	timestamp uint64
+	data      []byte
+}
+
+// readIVF checks the file header of data and returns its frames.
+func readIVF(t *testing.T, data []byte) (width, height uint16, count uint32, frames []ivfFrame) {
+	t.Helper()
+
+	if len(data) < ivfFileHeaderSize {
+		t.Fatalf("file of %d bytes", len(data))
+	}
+	header := data[:ivfFileHeaderSize]
+	if string(header[:4]) != "DKIF" || string(header[8:12]) != "VP80" {
+		t.Fatalf("bad file header % x", header)
+	}
+	if size := binary.LittleEndian.Uint16(header[6:8]); size != ivfFileHeaderSize {
+		t.Errorf("header size %d", size)
+	}
+	if rate, scale := binary.LittleEndian.Uint32(header[16:20]), binary.LittleEndian.Uint32(header[20:24]); rate != vp8ClockRate || scale != 1 {
+		t.Errorf("time base %d/%d", scale, rate)
+	}
+
+	for data = data[ivfFileHeaderSize:]; len(data) > 0; {
+		if len(data) < ivfFrameHeaderSize {
+			t.Fatalf("frame %d: header of %d bytes", len(frames), len(data))
+		}
+		size := int(binary.LittleEndian.Uint32(data[0:4]))
+		if len(data) < ivfFrameHeaderSize+size {
+			t.Fatalf("frame %d: %d bytes, want %d", len(frames), len(data)-ivfFrameHeaderSize, size)
+		}
+		frames = append(frames, ivfFrame{
+			timestamp: binary.LittleEndian.Uint64(data[4:12]),
+			data:      data[ivfFrameHeaderSize : ivfFrameHeaderSize+size],
+		})
+		data = data[ivfFrameHeaderSize+size:]
+	}
+
+	return binary.LittleEndian.Uint16(header[12:14]), binary.LittleEndian.Uint16(header[14:16]),
+		binary.LittleEndian.Uint32(header[24:28]), frames
+}
+
+func TestIVFWriter(t *testing.T) {
+	tests := []struct {
+		name          string
+		packets       []Packet
+		frames        []ivfFrame
+		width, height uint16
+	}{
+		{
+			name: "one packet per frame",
+			packets: []Packet{
+				{SequenceNumber: 1, Timestamp: 9000, Marker: true, Payload: vp8(vp8Start, keyframe(640, 480, 0xAA))},
+				{SequenceNumber: 2, Timestamp: 12000, Marker: true, Payload: vp8(vp8Start, interframe(0xBB))},
+			},
+			frames: []ivfFrame{
+				{timestamp: 0, data: keyframe(640, 480, 0xAA)},
+				{timestamp: 3000, data: interframe(0xBB)},
+			},
+			width: 640, height: 480,
+		},
+		{
+			name: "frames reassembled across packets and partitions",
+			packets: []Packet{
+				{SequenceNumber: 10, Timestamp: 0, Payload: vp8(vp8Start, keyframe(320, 240, 1))},
+				{SequenceNumber: 11, Timestamp: 0, Payload: vp8(vp8Continue, []byte{2})},
+				// S on partition 1 does not start a frame
+				{SequenceNumber: 12, Timestamp: 0, Marker: true, Payload: vp8([]byte{0x11}, []byte{3})},
+			},
+			frames: []ivfFrame{{timestamp: 0, data: keyframe(320, 240, 1, 2, 3)}},
+			width:  320, height: 240,
+		},
+		{
+			name: "extended payload descriptor",
+			packets: []Packet{
+				{SequenceNumber: 1, Timestamp: 0, Marker: true, Payload: vp8(vp8Extended, keyframe(16, 16))},
+			},
+			frames: []ivfFrame{{timestamp: 0, data: keyframe(16, 16)}},
+			width:  16, height: 16,
+		},
+		{
+			name: "file starts at the first keyframe",
+			packets: []Packet{
+				{SequenceNumber: 1, Timestamp: 0, Marker: true, Payload: vp8(vp8Start, interframe(1))},
+				{SequenceNumber: 2, Timestamp: 3000, Marker: true, Payload: vp8(vp8Start, keyframe(64, 48))},
+				{SequenceNumber: 3, Timestamp: 6000, Marker: true, Payload: vp8(vp8Start, interframe(2))},
+			},
+			frames: []ivfFrame{
+				{timestamp: 0, data: keyframe(64, 48)},
+				{timestamp: 3000, data: interframe(2)},
+			},
+			width: 64, height: 48,
+		},
+		{
+			name: "frame with a lost packet dropped",
+			packets: []Packet{
+				{SequenceNumber: 1, Timestamp: 0, Marker: true, Payload: vp8(vp8Start, keyframe(64, 48))},
+				{SequenceNumber: 2, Timestamp: 3000, Payload: vp8(vp8Start, interframe(1))},
+				{SequenceNumber: 4, Timestamp: 3000, Marker: true, Payload: vp8(vp8Continue, []byte{2})},
+				{SequenceNumber: 5, Timestamp: 6000, Marker: true, Payload: vp8(vp8Start, interframe(3))},
+			},
+			frames: []ivfFrame{
+				{timestamp: 0, data: keyframe(64, 48)},
+				{timestamp: 6000, data: interframe(3)},
+			},
+			width: 64, height: 48,
+		},
+		{
+			name: "frame without its first packet dropped",
+			packets: []Packet{
+				{SequenceNumber: 1, Timestamp: 0, Marker: true, Payload: vp8(vp8Start, keyframe(64, 48))},
+				{SequenceNumber: 2, Timestamp: 3000, Marker: true, Payload: vp8(vp8Continue, []byte{1})},
+			},
+			frames: []ivfFrame{{timestamp: 0, data: keyframe(64, 48)}},
+			width:  64, height: 48,
+		},
+		{
+			name: "malformed payloads dropped",
+			packets: []Packet{
+				{SequenceNumber: 1, Timestamp: 0, Marker: true, Payload: nil},
+				{SequenceNumber: 2, Timestamp: 0, Marker: true, Payload: []byte{0x90}},
+				{SequenceNumber: 3, Timestamp: 0, Marker: true, Payload: []byte{0x90, 0x80}},
+				{SequenceNumber: 4, Timestamp: 0, Marker: true, Payload: vp8Start},
+				{SequenceNumber: 5, Timestamp: 3000, Marker: true, Payload: vp8(vp8Start, keyframe(8, 8))},
+			},
+			frames: []ivfFrame{{timestamp: 0, data: keyframe(8, 8)}},
+			width:  8, height: 8,
+		},
+		{
+			name:    "no keyframe",
+			packets: []Packet{{SequenceNumber: 1, Timestamp: 0, Marker: true, Payload: vp8(vp8Start, interframe())}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := &seekBuffer{}
+			writer, err := NewIVFWriter(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, packet := range test.packets {
+				if err := writer.WriteRTP(packet); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			width, height, count, frames := readIVF(t, out.data)
+			if width != test.width || height != test.height {
+				t.Errorf("size %dx%d, want %dx%d", width, height, test.width, test.height)
+			}
+			if count != uint32(len(test.frames)) {
+				t.Errorf("header counts %d frames, want %d", count, len(test.frames))
+			}
+			if len(frames) != len(test.frames) {
+				t.Fatalf("got %d frames, want %d", len(frames), len(test.frames))
+			}
+			for i, frame := range frames {
+				if frame.timestamp != test.frames[i].timestamp {
+					t.Errorf("frame %d: timestamp %d, want %d", i, frame.timestamp, test.frames[i].timestamp)
+				}
+				if !bytes.Equal(frame.data, test.frames[i].data) {
+					t.Errorf("frame %d: % x, want % x", i, frame.data, test.frames[i].data)
+				}
+			}
+		})
+	}
+}
+
+// TestIVFWriterStream checks that frames are written as they complete, even
+// when the header cannot be completed on Close.
+func TestIVFWriterStream(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewIVFWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.WriteRTP(Packet{SequenceNumber: 1, Timestamp: 0, Marker: true, Payload: vp8(vp8Start, keyframe(64, 48))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	width, height, count, frames := readIVF(t, out.Bytes())
+	if width != 0 || height != 0 || count != 0 {
+		t.Errorf("header filled in without seeking: %dx%d, %d frames", width, height, count)
+	}
+	if len(frames) != 1 {
+		t.Errorf("got %d frames, want 1", len(frames))
+	}
+}
@@ -0,0 +1,155 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+)
+
+// The parts of RFC 3533 and RFC 7845 needed to store an Opus stream.
+const (
+	oggPageHeaderSize = 27
+	oggMaxSegments    = 255
+
+	oggHeaderBOS = 0x02 // first page of the stream
+	oggHeaderEOS = 0x04 // last page of the stream
+
+	// opusClockRate is both the RTP clock and the granule rate of Opus
+	opusClockRate = 48000
+	// opusFrameDuration is assumed for the last packet, whose duration is
+	// not known from the next one
+	opusFrameDuration = opusClockRate / 50
+)
+
+// vendor is written in the OpusTags header.
+const vendor = "vidcall"
+
+var errPacketTooLarge = errors.New("media: packet too large for an ogg page")
+
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// OggWriter stores an Opus track in an Ogg file, one packet per page.
+type OggWriter struct {
+	w        io.Writer
+	serial   uint32
+	sequence uint32 // of the next page
+
+	// granule counts the samples written so far
+	granule uint64
+	// pending is the last packet, written once the next one tells how long
+	// it lasts
+	pending       []byte
+	lastTimestamp uint32
+	lastDuration  uint32
+}
+
+// NewOggWriter writes the Opus headers to w and returns the writer for the
+// packets. Close closes w when it is an io.Closer.
+func NewOggWriter(w io.Writer, channels uint16) (*OggWriter, error) {
+	writer := &OggWriter{
+		w:            w,
+		serial:       rand.Uint32(),
+		lastDuration: opusFrameDuration,
+	}
+
+	// Pre-skip is left at 0: the stream starts wherever the call was joined
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint32(head[12:16], opusClockRate)
+	if err := writer.writePage(head, oggHeaderBOS, 0); err != nil {
+		return nil, err
+	}
+
+	tags := []byte("OpusTags")
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(vendor)))
+	tags = append(tags, vendor...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0) // no user comments
+	if err := writer.writePage(tags, 0, 0); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// WriteRTP stores the Opus packet carried by packet. Packets older than the
+// previous one are dropped.
+func (writer *OggWriter) WriteRTP(packet Packet) error {
+	if writer.pending != nil {
+		elapsed := packet.Timestamp - writer.lastTimestamp
+		if int32(elapsed) <= 0 {
+			return nil
+		}
+		if err := writer.flush(elapsed, 0); err != nil {
+			return err
+		}
+		writer.lastDuration = elapsed
+	}
+
+	writer.pending = append(writer.pending[:0], packet.Payload...)
+	writer.lastTimestamp = packet.Timestamp
+	return nil
+}
+
+// Close writes the last packet on the end of stream page.
+func (writer *OggWriter) Close() error {
+	var err error
+	if writer.pending != nil {
+		err = writer.flush(writer.lastDuration, oggHeaderEOS)
+	}
+	if closer, ok := writer.w.(io.Closer); ok {
+		err = errors.Join(err, closer.Close())
+	}
+	return err
+}
+
+func (writer *OggWriter) flush(duration uint32, headerType byte) error {
+	writer.granule += uint64(duration)
+	return writer.writePage(writer.pending, headerType, writer.granule)
+}
+
+func (writer *OggWriter) writePage(packet []byte, headerType byte, granule uint64) error {
+	segments := len(packet)/255 + 1
+	if segments > oggMaxSegments {
+		return errPacketTooLarge
+	}
+
+	page := make([]byte, oggPageHeaderSize+segments, oggPageHeaderSize+segments+len(packet))
+	copy(page, "OggS")
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:14], granule)
+	binary.LittleEndian.PutUint32(page[14:18], writer.serial)
+	binary.LittleEndian.PutUint32(page[18:22], writer.sequence)
+	page[26] = byte(segments)
+	// lacing values: 255 for every full segment, then what is left, even 0
+	for i := range segments - 1 {
+		page[oggPageHeaderSize+i] = 255
+	}
+	page[oggPageHeaderSize+segments-1] = byte(len(packet) % 255)
+	page = append(page, packet...)
+
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(page[22:26], crc)
+
+	writer.sequence++
+	_, err := writer.w.Write(page)
+	return err
+}
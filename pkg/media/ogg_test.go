@@ -0,0 +1,229 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// oggPage is a page read back from the output of an OggWriter.
+type oggPage struct {
+	headerType byte
+	granule    uint64
+	serial     uint32
+	sequence   uint32
+	lacing     []byte
+	packet     []byte
+}
+
+// readOggPages splits data into pages, checking their capture pattern and
+// checksum.
+func readOggPages(t *testing.T, data []byte) []oggPage {
+	t.Helper()
+
+	var pages []oggPage
+	for len(data) > 0 {
+		if len(data) < oggPageHeaderSize || string(data[:4]) != "OggS" || data[4] != 0 {
+			t.Fatalf("page %d: bad header % x", len(pages), data[:min(len(data), oggPageHeaderSize)])
+		}
+		segments := int(data[26])
+		lacing := data[oggPageHeaderSize : oggPageHeaderSize+segments]
+		size := 0
+		for _, value := range lacing {
+			size += int(value)
+		}
+		end := oggPageHeaderSize + segments + size
+		if len(data) < end {
+			t.Fatalf("page %d: %d bytes, want %d", len(pages), len(data), end)
+		}
+
+		raw := slices.Clone(data[:end])
+		want := binary.LittleEndian.Uint32(raw[22:26])
+		clear(raw[22:26])
+		var crc uint32
+		for _, b := range raw {
+			crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+		}
+		if crc != want {
+			t.Fatalf("page %d: crc %08x, want %08x", len(pages), want, crc)
+		}
+
+		pages = append(pages, oggPage{
+			headerType: data[5],
+			granule:    binary.LittleEndian.Uint64(data[6:14]),
+			serial:     binary.LittleEndian.Uint32(data[14:18]),
+			sequence:   binary.LittleEndian.Uint32(data[18:22]),
+			lacing:     lacing,
+			packet:     data[oggPageHeaderSize+segments : end],
+		})
+		data = data[end:]
+	}
+	return pages
+}
+
+func TestOggWriterHeaders(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewOggWriter(&out, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := readOggPages(t, out.Bytes())
+	if len(pages) != 2 {
+		t.Fatalf("got %d pages, want the 2 headers", len(pages))
+	}
+
+	head := pages[0]
+	if head.headerType != oggHeaderBOS || head.granule != 0 || head.sequence != 0 {
+		t.Errorf("OpusHead page: type %#x granule %d sequence %d", head.headerType, head.granule, head.sequence)
+	}
+	if len(head.packet) != 19 || string(head.packet[:8]) != "OpusHead" {
+		t.Fatalf("OpusHead packet: % x", head.packet)
+	}
+	if version, channels := head.packet[8], head.packet[9]; version != 1 || channels != 2 {
+		t.Errorf("OpusHead: version %d channels %d", version, channels)
+	}
+	if rate := binary.LittleEndian.Uint32(head.packet[12:16]); rate != opusClockRate {
+		t.Errorf("OpusHead: sample rate %d", rate)
+	}
+
+	tags := pages[1]
+	if tags.headerType != 0 || tags.sequence != 1 || tags.serial != head.serial {
+		t.Errorf("OpusTags page: type %#x sequence %d serial %d", tags.headerType, tags.sequence, tags.serial)
+	}
+	if !bytes.HasPrefix(tags.packet, []byte("OpusTags")) || !bytes.Contains(tags.packet, []byte(vendor)) {
+		t.Errorf("OpusTags packet: %q", tags.packet)
+	}
+}
+
+func TestOggWriterPackets(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets []Packet
+		// payload sizes and granules of the data pages, in order
+		sizes    []int
+		granules []uint64
+	}{
+		{
+			name: "20ms frames",
+			packets: []Packet{
+				{Timestamp: 1000, Payload: make([]byte, 10)},
+				{Timestamp: 1960, Payload: make([]byte, 20)},
+				{Timestamp: 2920, Payload: make([]byte, 30)},
+			},
+			sizes:    []int{10, 20, 30},
+			granules: []uint64{960, 1920, 2880},
+		},
+		{
+			name: "duration taken from the next timestamp",
+			packets: []Packet{
+				{Timestamp: 0, Payload: []byte{1}},
+				{Timestamp: 480, Payload: []byte{2}},
+				{Timestamp: 2400, Payload: []byte{3}},
+			},
+			sizes: []int{1, 1, 1},
+			// the last packet lasts as long as the one before it
+			granules: []uint64{480, 2400, 4320},
+		},
+		{
+			name: "late packets dropped",
+			packets: []Packet{
+				{Timestamp: 960, Payload: []byte{1}},
+				{Timestamp: 1920, Payload: []byte{2}},
+				{Timestamp: 960, Payload: []byte{3}},
+				{Timestamp: 1920, Payload: []byte{4}},
+				{Timestamp: 2880, Payload: []byte{5}},
+			},
+			sizes:    []int{1, 1, 1},
+			granules: []uint64{960, 1920, 2880},
+		},
+		{
+			name: "timestamp wrapping around",
+			packets: []Packet{
+				{Timestamp: 0xFFFFFFFF - 479, Payload: []byte{1}},
+				{Timestamp: 480, Payload: []byte{2}},
+			},
+			sizes:    []int{1, 1},
+			granules: []uint64{960, 1920},
+		},
+		{
+			name:     "packet spanning several segments",
+			packets:  []Packet{{Timestamp: 0, Payload: make([]byte, 600)}},
+			sizes:    []int{600},
+			granules: []uint64{opusFrameDuration},
+		},
+		{
+			name:     "packet of exactly one segment",
+			packets:  []Packet{{Timestamp: 0, Payload: make([]byte, 255)}},
+			sizes:    []int{255},
+			granules: []uint64{opusFrameDuration},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			writer, err := NewOggWriter(&out, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, packet := range test.packets {
+				if err := writer.WriteRTP(packet); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			pages := readOggPages(t, out.Bytes())[2:]
+			if len(pages) != len(test.sizes) {
+				t.Fatalf("got %d data pages, want %d", len(pages), len(test.sizes))
+			}
+			for i, page := range pages {
+				if len(page.packet) != test.sizes[i] {
+					t.Errorf("page %d: %d bytes, want %d", i, len(page.packet), test.sizes[i])
+				}
+				if page.granule != test.granules[i] {
+					t.Errorf("page %d: granule %d, want %d", i, page.granule, test.granules[i])
+				}
+				if page.sequence != uint32(i+2) {
+					t.Errorf("page %d: sequence %d", i, page.sequence)
+				}
+
+				// 255 for every full segment, then the rest, even 0
+				lacing := slices.Repeat([]byte{255}, test.sizes[i]/255)
+				lacing = append(lacing, byte(test.sizes[i]%255))
+				if !bytes.Equal(page.lacing, lacing) {
+					t.Errorf("page %d: lacing %v, want %v", i, page.lacing, lacing)
+				}
+
+				var headerType byte
+				if i == len(pages)-1 {
+					headerType = oggHeaderEOS
+				}
+				if page.headerType != headerType {
+					t.Errorf("page %d: header type %#x, want %#x", i, page.headerType, headerType)
+				}
+			}
+		})
+	}
+}
+
+func TestOggWriterPacketTooLarge(t *testing.T) {
+	writer, err := NewOggWriter(&bytes.Buffer{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteRTP(Packet{Payload: make([]byte, 255*oggMaxSegments)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); !errors.Is(err, errPacketTooLarge) {
+		t.Fatalf("got %v, want %v", err, errPacketTooLarge)
+	}
+}
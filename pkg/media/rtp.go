@@ -0,0 +1,117 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// rtpHeaderSize is the fixed part of an RTP header, before CSRCs and
+// extensions.
+const rtpHeaderSize = 12
+
+var errNotRTP = errors.New("media: not an RTP packet")
+
+// Packet is the part of an RTP packet the writers need.
+type Packet struct {
+	PayloadType    uint8
+	SequenceNumber uint16
+	Timestamp      uint32
+	SSRC           uint32
+	Marker         bool
+	Payload        []byte
+}
+
+// Writer stores the packets of one track in a file.
+type Writer interface {
+	WriteRTP(packet Packet) error
+	Close() error
+}
+
+// ParseRTP decodes an RTP packet (RFC 3550), skipping its CSRCs, header
+// extension and padding. The payload aliases raw.
+func ParseRTP(raw []byte) (Packet, error) {
+	if len(raw) < rtpHeaderSize || raw[0]>>6 != 2 {
+		return Packet{}, errNotRTP
+	}
+
+	padding := raw[0]&0x20 != 0
+	extension := raw[0]&0x10 != 0
+	offset := rtpHeaderSize + 4*int(raw[0]&0x0F)
+
+	if extension {
+		if len(raw) < offset+4 {
+			return Packet{}, errNotRTP
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(raw[offset+2:offset+4]))
+	}
+	if len(raw) < offset {
+		return Packet{}, errNotRTP
+	}
+
+	end := len(raw)
+	if padding {
+		if end == offset {
+			return Packet{}, errNotRTP
+		}
+		end -= int(raw[end-1])
+		if end < offset {
+			return Packet{}, errNotRTP
+		}
+	}
+
+	return Packet{
+		PayloadType:    raw[1] & 0x7F,
+		SequenceNumber: binary.BigEndian.Uint16(raw[2:4]),
+		Timestamp:      binary.BigEndian.Uint32(raw[4:8]),
+		SSRC:           binary.BigEndian.Uint32(raw[8:12]),
+		Marker:         raw[1]&0x80 != 0,
+		Payload:        raw[offset:end],
+	}, nil
+}
+
+// Marshal encodes the packet with a bare RTP header, e.g. to feed synthetic
+// packets to a writer through ParseRTP.
+func (packet Packet) Marshal() []byte {
+	raw := make([]byte, rtpHeaderSize, rtpHeaderSize+len(packet.Payload))
+	raw[0] = 2 << 6
+	raw[1] = packet.PayloadType & 0x7F
+	if packet.Marker {
+		raw[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(raw[2:4], packet.SequenceNumber)
+	binary.BigEndian.PutUint32(raw[4:8], packet.Timestamp)
+	binary.BigEndian.PutUint32(raw[8:12], packet.SSRC)
+	return append(raw, packet.Payload...)
+}
+
+// Codecs the writers store.
+const (
+	MimeTypeOpus = "audio/opus"
+	MimeTypeVP8  = "video/VP8"
+)
+
+// Extension returns the file extension of tracks of mimeType, or "" when no
+// writer stores them.
+func Extension(mimeType string) string {
+	switch {
+	case strings.EqualFold(mimeType, MimeTypeOpus):
+		return "ogg"
+	case strings.EqualFold(mimeType, MimeTypeVP8):
+		return "ivf"
+	}
+	return ""
+}
+
+// NewWriter returns the writer storing tracks of mimeType in w.
+func NewWriter(w io.Writer, mimeType string, channels uint16) (Writer, error) {
+	switch {
+	case strings.EqualFold(mimeType, MimeTypeOpus):
+		return NewOggWriter(w, channels)
+	case strings.EqualFold(mimeType, MimeTypeVP8):
+		return NewIVFWriter(w)
+	}
+	return nil, fmt.Errorf("media: no writer for %s", mimeType)
+}
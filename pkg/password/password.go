@@ -0,0 +1,65 @@
+package password
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strconv"
+	"strings"
+)
+
+// PBKDF2-HMAC-SHA256 parameters, following the OWASP recommendation
+const (
+	iterations = 600_000
+	keyLength  = 32
+	saltLength = 16
+)
+
+// Hash returns a salted PBKDF2 hash of secret encoded as iterations$salt$key.
+func Hash(secret string) (string, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, secret, salt, iterations, keyLength)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(iterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+// Verify reports whether secret matches a hash produced by Hash.
+func Verify(encoded, secret string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 3 {
+		return false
+	}
+
+	rounds, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	got, err := pbkdf2.Key(sha256.New, secret, salt, rounds, len(want))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+// BoltRepository keeps entities JSON-encoded in a bbolt bucket, so they
+// survive restarts. Fields tagged `json:"-"` are not persisted and come back
+// as their zero value.
+type BoltRepository[V comparable, T Entity[V]] struct {
+	db     *bbolt.DB
+	bucket []byte
+}
+
+func NewBoltRepository[V comparable, T Entity[V]](db *bbolt.DB, bucket string) (Repository[V, T], error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("repository: create bucket %q: %w", bucket, err)
+	}
+
+	return &BoltRepository[V, T]{
+		db:     db,
+		bucket: []byte(bucket),
+	}, nil
+}
+
+func (r *BoltRepository[V, T]) Insert(ctx context.Context, t T) (T, error) {
+	return t, r.put(t)
+}
+
+func (r *BoltRepository[V, T]) Find(ctx context.Context, v V) (T, error) {
+	var t T
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		raw := tx.Bucket(r.bucket).Get(boltKey(v))
+		if raw == nil {
+			return ErrNotFound
+		}
+		return decode(raw, &t)
+	})
+	return t, err
+}
+
+func (r *BoltRepository[V, T]) Update(ctx context.Context, t T) (T, error) {
+	return t, r.put(t)
+}
+
+func (r *BoltRepository[V, T]) Delete(ctx context.Context, v V) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(r.bucket).Delete(boltKey(v))
+	})
+}
+
+func (r *BoltRepository[V, T]) FindList(ctx context.Context) ([]T, error) {
+	var list []T
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(r.bucket).ForEach(func(_, raw []byte) error {
+			var t T
+			if err := decode(raw, &t); err != nil {
+				return err
+			}
+			list = append(list, t)
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (r *BoltRepository[V, T]) FindPage(ctx context.Context, q Query[T]) (Page[T], error) {
+	var matched []T
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(r.bucket).ForEach(func(_, raw []byte) error {
+			var t T
+			if err := decode(raw, &t); err != nil {
+				return err
+			}
+			if q.Match(t) {
+				matched = append(matched, t)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return Page[T]{}, err
+	}
+	return Paginate(matched, q)
+}
+
+func (r *BoltRepository[V, T]) put(t T) error {
+	raw, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("repository: encode: %w", err)
+	}
+
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(r.bucket).Put(boltKey(t.Id()), raw)
+	})
+}
+
+func decode[T any](raw []byte, t *T) error {
+	if err := json.Unmarshal(raw, t); err != nil {
+		return errors.Join(ErrTypeMismatch, err)
+	}
+	return nil
+}
+
+func boltKey[V comparable](v V) []byte {
+	return fmt.Append(nil, v)
+}
@@ -58,3 +58,14 @@ func (r *SyncRepository[V, T]) FindList(ctx context.Context) ([]T, error) {
 	})
 	return list, nil
 }
+
+func (r *SyncRepository[V, T]) FindPage(ctx context.Context, q Query[T]) (Page[T], error) {
+	var matched []T
+	r.m.Range(func(_, val interface{}) bool {
+		if t, ok := val.(T); ok && q.Match(t) {
+			matched = append(matched, t)
+		}
+		return true
+	})
+	return Paginate(matched, q)
+}
@@ -0,0 +1,160 @@
+package repository
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+var (
+	ErrInvalidCursor = errors.New("repository: invalid cursor")
+	ErrInvalidSort   = errors.New("repository: invalid sort")
+)
+
+// Predicate selects the entities a query returns.
+type Predicate[T any] func(T) bool
+
+// SortKey orders entities by one of their fields.
+type SortKey[T any] struct {
+	Name    string
+	Compare func(a, b T) int
+	Desc    bool
+}
+
+// Query filters, sorts and paginates a FindPage call. Entities must match
+// every predicate. Sort keys are applied in order and ties are broken by ID,
+// so pages are stable. A zero Limit returns everything after Cursor.
+type Query[T any] struct {
+	Where  []Predicate[T]
+	Sort   []SortKey[T]
+	Cursor string
+	Limit  int
+}
+
+// Page is one slice of a query result. NextCursor is empty on the last page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// cursor remembers the last entity of a page and its position, which is used
+// when that entity has since disappeared.
+type cursor struct {
+	ID     string `json:"id"`
+	Offset int    `json:"offset"`
+}
+
+// PageSize turns a client supplied limit into one within (0, MaxPageSize].
+func PageSize(limit int) int {
+	if limit <= 0 {
+		return DefaultPageSize
+	}
+	return min(limit, MaxPageSize)
+}
+
+// ParseSort turns a comma separated list of field names, each optionally
+// prefixed with "-" for descending order, into sort keys. fields maps the
+// names a caller may sort on to their comparison.
+func ParseSort[T any](spec string, fields map[string]func(a, b T) int) ([]SortKey[T], error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	var keys []SortKey[T]
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		desc := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+
+		compare, ok := fields[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidSort, name)
+		}
+		keys = append(keys, SortKey[T]{Name: name, Compare: compare, Desc: desc})
+	}
+
+	return keys, nil
+}
+
+// Match reports whether t satisfies every predicate of the query.
+func (q Query[T]) Match(t T) bool {
+	for _, predicate := range q.Where {
+		if !predicate(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// Paginate sorts the already matched entities and cuts the page selected by
+// the query. Repositories without native query support call it after
+// filtering with Match.
+func Paginate[V comparable, T Entity[V]](matched []T, q Query[T]) (Page[T], error) {
+	slices.SortStableFunc(matched, func(a, b T) int {
+		for _, key := range q.Sort {
+			if c := key.Compare(a, b); c != 0 {
+				if key.Desc {
+					return -c
+				}
+				return c
+			}
+		}
+		return cmp.Compare(fmt.Sprint(a.Id()), fmt.Sprint(b.Id()))
+	})
+
+	start := 0
+	if q.Cursor != "" {
+		after, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return Page[T]{}, err
+		}
+
+		start = min(after.Offset, len(matched))
+		if index := slices.IndexFunc(matched, func(t T) bool { return fmt.Sprint(t.Id()) == after.ID }); index >= 0 {
+			start = index + 1
+		}
+	}
+
+	end := len(matched)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+
+	page := Page[T]{Items: matched[start:end]}
+	if end < len(matched) {
+		page.NextCursor = encodeCursor(cursor{
+			ID:     fmt.Sprint(matched[end-1].Id()),
+			Offset: end,
+		})
+	}
+
+	return page, nil
+}
+
+func encodeCursor(c cursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(raw, &c); err != nil || c.Offset < 0 {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
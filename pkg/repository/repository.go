@@ -14,4 +14,5 @@ type Repository[V comparable, T Entity[V]] interface {
 	Find(ctx context.Context, v V) (T, error)
 	Delete(ctx context.Context, v V) error
 	FindList(ctx context.Context) ([]T, error)
+	FindPage(ctx context.Context, q Query[T]) (Page[T], error)
 }
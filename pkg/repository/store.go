@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"vidcall/config"
+
+	"go.etcd.io/bbolt"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const (
+	DriverMemory = "memory"
+	DriverBolt   = "bolt"
+)
+
+var Module = fx.Module("repository",
+	fx.Provide(NewStore),
+)
+
+// Store is the storage backend selected in config.Storage. Modules open their
+// repositories on it with New.
+type Store struct {
+	driver string
+	db     *bbolt.DB
+}
+
+type StoreParams struct {
+	fx.In
+
+	Lifecycle fx.Lifecycle
+	Config    config.Config
+	Logger    *zap.Logger
+}
+
+func NewStore(params StoreParams) (*Store, error) {
+	storage := params.Config.Storage
+	store := &Store{driver: storage.Driver}
+
+	switch storage.Driver {
+	case DriverMemory, "":
+		store.driver = DriverMemory
+	case DriverBolt:
+		if err := os.MkdirAll(filepath.Dir(storage.Path), 0o755); err != nil {
+			return nil, fmt.Errorf("repository: create data dir: %w", err)
+		}
+
+		db, err := bbolt.Open(storage.Path, 0o600, &bbolt.Options{Timeout: 5 * time.Second})
+		if err != nil {
+			return nil, fmt.Errorf("repository: open %s: %w", storage.Path, err)
+		}
+		store.db = db
+	default:
+		return nil, fmt.Errorf("repository: unknown storage driver %q", storage.Driver)
+	}
+
+	params.Logger.Info("Opened storage", zap.String("driver", store.driver), zap.String("path", storage.Path))
+
+	params.Lifecycle.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			return store.Close()
+		},
+	})
+
+	return store, nil
+}
+
+// IsDurable reports whether entities outlive the process.
+func (store *Store) IsDurable() bool {
+	return store.db != nil
+}
+
+func (store *Store) Close() error {
+	if store.db == nil {
+		return nil
+	}
+	return store.db.Close()
+}
+
+// New opens the repository named name on the store. Its calls are traced.
+func New[V comparable, T Entity[V]](store *Store, name string) (Repository[V, T], error) {
+	if store.db == nil {
+		return NewTracedRepository(NewSyncRepository[V, T](), name, store.driver), nil
+	}
+
+	repo, err := NewBoltRepository[V, T](store.db, name)
+	if err != nil {
+		return nil, err
+	}
+	return NewTracedRepository(repo, name, store.driver), nil
+}
@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"vidcall/pkg/tracing"
+
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("vidcall/pkg/repository")
+
+// TracedRepository records a span for every call to the repository it wraps.
+type TracedRepository[V comparable, T Entity[V]] struct {
+	repo   Repository[V, T]
+	name   string
+	driver string
+}
+
+func NewTracedRepository[V comparable, T Entity[V]](repo Repository[V, T], name, driver string) Repository[V, T] {
+	return &TracedRepository[V, T]{repo: repo, name: name, driver: driver}
+}
+
+func (r *TracedRepository[V, T]) Insert(ctx context.Context, t T) (T, error) {
+	ctx, span := r.start(ctx, "Insert")
+	t, err := r.repo.Insert(ctx, t)
+	r.end(span, err)
+	return t, err
+}
+
+func (r *TracedRepository[V, T]) Update(ctx context.Context, t T) (T, error) {
+	ctx, span := r.start(ctx, "Update")
+	t, err := r.repo.Update(ctx, t)
+	r.end(span, err)
+	return t, err
+}
+
+func (r *TracedRepository[V, T]) Find(ctx context.Context, v V) (T, error) {
+	ctx, span := r.start(ctx, "Find")
+	t, err := r.repo.Find(ctx, v)
+	r.end(span, err)
+	return t, err
+}
+
+func (r *TracedRepository[V, T]) Delete(ctx context.Context, v V) error {
+	ctx, span := r.start(ctx, "Delete")
+	err := r.repo.Delete(ctx, v)
+	r.end(span, err)
+	return err
+}
+
+func (r *TracedRepository[V, T]) FindList(ctx context.Context) ([]T, error) {
+	ctx, span := r.start(ctx, "FindList")
+	list, err := r.repo.FindList(ctx)
+	r.end(span, err)
+	return list, err
+}
+
+func (r *TracedRepository[V, T]) FindPage(ctx context.Context, q Query[T]) (Page[T], error) {
+	ctx, span := r.start(ctx, "FindPage")
+	page, err := r.repo.FindPage(ctx, q)
+	r.end(span, err)
+	return page, err
+}
+
+func (r *TracedRepository[V, T]) start(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, operation+" "+r.name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemNameKey.String(r.driver),
+			semconv.DBCollectionName(r.name),
+			semconv.DBOperationName(operation),
+		),
+	)
+}
+
+// end does not count a missing entity as a failure, callers ask for those.
+func (r *TracedRepository[V, T]) end(span trace.Span, err error) {
+	if errors.Is(err, ErrNotFound) {
+		err = nil
+	}
+	tracing.End(span, err)
+}
@@ -0,0 +1,186 @@
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+// The parts of RFC 5389 a binding server needs.
+const (
+	headerSize  = 20
+	magicCookie = 0x2112A442
+
+	typeBindingRequest       = 0x0001
+	typeBindingSuccess       = 0x0101
+	typeBindingErrorResponse = 0x0111
+
+	attrUsername          = 0x0006
+	attrMessageIntegrity  = 0x0008
+	attrErrorCode         = 0x0009
+	attrUnknownAttributes = 0x000A
+	attrXORMappedAddress  = 0x0020
+	attrSoftware          = 0x8022
+	attrFingerprint       = 0x8028
+
+	// comprehensionOptional is the lowest attribute type a server may ignore
+	comprehensionOptional = 0x8000
+
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+
+	fingerprintXOR       = 0x5354554e
+	codeUnknownAttribute = 420
+)
+
+var (
+	errNotSTUN        = errors.New("stun: not a STUN message")
+	errBadFingerprint = errors.New("stun: fingerprint mismatch")
+)
+
+// message is a decoded STUN message; attribute values alias the raw packet.
+type message struct {
+	typ           uint16
+	transactionID [12]byte
+	attributes    []attribute
+}
+
+type attribute struct {
+	typ   uint16
+	value []byte
+}
+
+// parseMessage decodes packet, checking the FINGERPRINT when there is one.
+func parseMessage(packet []byte) (message, error) {
+	if len(packet) < headerSize || packet[0]&0xC0 != 0 || binary.BigEndian.Uint32(packet[4:8]) != magicCookie {
+		return message{}, errNotSTUN
+	}
+	length := int(binary.BigEndian.Uint16(packet[2:4]))
+	if length%4 != 0 || headerSize+length != len(packet) {
+		return message{}, errNotSTUN
+	}
+
+	msg := message{typ: binary.BigEndian.Uint16(packet[0:2])}
+	copy(msg.transactionID[:], packet[8:20])
+
+	for offset := headerSize; offset < len(packet); {
+		if offset+4 > len(packet) {
+			return message{}, errNotSTUN
+		}
+		typ := binary.BigEndian.Uint16(packet[offset : offset+2])
+		size := int(binary.BigEndian.Uint16(packet[offset+2 : offset+4]))
+		end := offset + 4 + size
+		if end > len(packet) {
+			return message{}, errNotSTUN
+		}
+
+		if typ == attrFingerprint {
+			if size != 4 || end != len(packet) || binary.BigEndian.Uint32(packet[offset+4:end]) != fingerprint(packet[:offset]) {
+				return message{}, errBadFingerprint
+			}
+		}
+
+		msg.attributes = append(msg.attributes, attribute{typ: typ, value: packet[offset+4 : end]})
+		// values are padded to a multiple of four bytes
+		offset = end + (4-size%4)%4
+	}
+
+	return msg, nil
+}
+
+// ignoredRequired are comprehension-required attributes the server
+// understands and ignores: it does not authenticate, so the credentials of a
+// client that sends some anyway make no difference to its answer.
+var ignoredRequired = map[uint16]bool{
+	attrUsername:         true,
+	attrMessageIntegrity: true,
+}
+
+// unknownRequired returns the attributes of msg that a server must
+// understand but this one does not.
+func (msg message) unknownRequired() []uint16 {
+	var unknown []uint16
+	for _, attr := range msg.attributes {
+		if attr.typ < comprehensionOptional && !ignoredRequired[attr.typ] {
+			unknown = append(unknown, attr.typ)
+		}
+	}
+	return unknown
+}
+
+// encoder builds a message attribute by attribute.
+type encoder struct {
+	buf []byte
+}
+
+func newEncoder(typ uint16, transactionID [12]byte) *encoder {
+	buf := make([]byte, headerSize, 128)
+	binary.BigEndian.PutUint16(buf[0:2], typ)
+	binary.BigEndian.PutUint32(buf[4:8], magicCookie)
+	copy(buf[8:20], transactionID[:])
+	return &encoder{buf: buf}
+}
+
+func (enc *encoder) add(typ uint16, value []byte) {
+	enc.buf = binary.BigEndian.AppendUint16(enc.buf, typ)
+	enc.buf = binary.BigEndian.AppendUint16(enc.buf, uint16(len(value)))
+	enc.buf = append(enc.buf, value...)
+	enc.buf = append(enc.buf, make([]byte, (4-len(value)%4)%4)...)
+	enc.setLength()
+}
+
+func (enc *encoder) addXORMappedAddress(addr *net.UDPAddr, transactionID [12]byte) {
+	ip := addr.IP.To4()
+	family := byte(familyIPv4)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = familyIPv6
+	}
+
+	// the address is XORed with the magic cookie followed by the transaction
+	// ID, so that NATs rewriting addresses in payloads leave it alone
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:4], magicCookie)
+	copy(key[4:], transactionID[:])
+
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port)^uint16(magicCookie>>16))
+	for i := range ip {
+		value[4+i] = ip[i] ^ key[i]
+	}
+	enc.add(attrXORMappedAddress, value)
+}
+
+func (enc *encoder) addErrorCode(code int, reason string) {
+	value := []byte{0, 0, byte(code / 100), byte(code % 100)}
+	enc.add(attrErrorCode, append(value, reason...))
+}
+
+func (enc *encoder) addUnknownAttributes(types []uint16) {
+	value := make([]byte, 0, 2*len(types))
+	for _, typ := range types {
+		value = binary.BigEndian.AppendUint16(value, typ)
+	}
+	enc.add(attrUnknownAttributes, value)
+}
+
+// finish adds the FINGERPRINT and returns the encoded message.
+func (enc *encoder) finish() []byte {
+	// the length covers the fingerprint it is computed over
+	binary.BigEndian.PutUint16(enc.buf[2:4], uint16(len(enc.buf)-headerSize+8))
+	crc := fingerprint(enc.buf)
+	enc.buf = binary.BigEndian.AppendUint16(enc.buf, attrFingerprint)
+	enc.buf = binary.BigEndian.AppendUint16(enc.buf, 4)
+	enc.buf = binary.BigEndian.AppendUint32(enc.buf, crc)
+	return enc.buf
+}
+
+func (enc *encoder) setLength() {
+	binary.BigEndian.PutUint16(enc.buf[2:4], uint16(len(enc.buf)-headerSize))
+}
+
+func fingerprint(b []byte) uint32 {
+	return crc32.ChecksumIEEE(b) ^ fingerprintXOR
+}
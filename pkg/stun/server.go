@@ -0,0 +1,152 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"vidcall/config"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// software is sent in the SOFTWARE attribute of every response.
+const software = "vidcall"
+
+// maxPacketSize fits any STUN request over UDP.
+const maxPacketSize = 1500
+
+var Module = fx.Module("stun",
+	fx.Invoke(Register),
+)
+
+type Params struct {
+	fx.In
+
+	Lifecycle fx.Lifecycle
+	Config    config.Config
+	Logger    *zap.Logger
+}
+
+// Register runs a Server on the configured address for the lifetime of the
+// app, when the stun section enables it.
+func Register(params Params) {
+	cfg := params.Config.STUN
+	if !cfg.Enabled {
+		return
+	}
+
+	server := NewServer(params.Logger)
+	params.Lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			return server.Start(cfg.Listen)
+		},
+		OnStop: func(context.Context) error {
+			return server.Stop()
+		},
+	})
+}
+
+// Server answers STUN binding requests (RFC 5389) over UDP with the address
+// they came from, which is all browsers need to find their server reflexive
+// candidates. It does not authenticate and does not relay; that is TURN.
+type Server struct {
+	conn   net.PacketConn
+	logger *zap.Logger
+	wg     sync.WaitGroup
+}
+
+func NewServer(logger *zap.Logger) *Server {
+	return &Server{logger: logger}
+}
+
+// Start listens on addr and answers requests until Stop.
+func (server *Server) Start(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	server.conn = conn
+
+	server.wg.Add(1)
+	go func() {
+		defer server.wg.Done()
+		server.serve()
+	}()
+
+	server.logger.Info("STUN server started", zap.String("addr", conn.LocalAddr().String()))
+	return nil
+}
+
+// Addr is the address the server listens on, once started.
+func (server *Server) Addr() net.Addr {
+	return server.conn.LocalAddr()
+}
+
+func (server *Server) Stop() error {
+	if server.conn == nil {
+		return nil
+	}
+	err := server.conn.Close()
+	server.wg.Wait()
+	return err
+}
+
+func (server *Server) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := server.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				server.logger.Error("Read STUN packet failed", zap.Error(err))
+			}
+			return
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		response, err := handle(buf[:n], udpAddr)
+		if err != nil {
+			server.logger.Debug("Dropped STUN packet", zap.Stringer("from", addr), zap.Error(err))
+			continue
+		}
+		if response == nil {
+			continue
+		}
+
+		if _, err := server.conn.WriteTo(response, addr); err != nil {
+			server.logger.Debug("Write STUN response failed", zap.Stringer("to", addr), zap.Error(err))
+		}
+	}
+}
+
+// handle returns the response to packet, or nil when there is none to send.
+func handle(packet []byte, from *net.UDPAddr) ([]byte, error) {
+	msg, err := parseMessage(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	// indications and responses are not answered
+	if msg.typ != typeBindingRequest {
+		return nil, nil
+	}
+
+	if unknown := msg.unknownRequired(); len(unknown) > 0 {
+		enc := newEncoder(typeBindingErrorResponse, msg.transactionID)
+		enc.addErrorCode(codeUnknownAttribute, "Unknown Attribute")
+		enc.addUnknownAttributes(unknown)
+		enc.add(attrSoftware, []byte(software))
+		return enc.finish(), nil
+	}
+
+	enc := newEncoder(typeBindingSuccess, msg.transactionID)
+	enc.addXORMappedAddress(from, msg.transactionID)
+	enc.add(attrSoftware, []byte(software))
+	return enc.finish(), nil
+}
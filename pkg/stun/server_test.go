@@ -0,0 +1,364 @@
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var testTransactionID = [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+// request is a STUN message as a client encodes it, independently of the
+// encoder of the server.
+type request struct {
+	typ         uint16
+	attributes  []attribute
+	fingerprint bool
+}
+
+func (req request) encode() []byte {
+	packet := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(packet[0:2], req.typ)
+	binary.BigEndian.PutUint32(packet[4:8], magicCookie)
+	copy(packet[8:20], testTransactionID[:])
+	for _, attr := range req.attributes {
+		packet = binary.BigEndian.AppendUint16(packet, attr.typ)
+		packet = binary.BigEndian.AppendUint16(packet, uint16(len(attr.value)))
+		packet = append(packet, attr.value...)
+		packet = append(packet, make([]byte, (4-len(attr.value)%4)%4)...)
+	}
+
+	length := len(packet) - headerSize
+	if req.fingerprint {
+		length += 8
+	}
+	binary.BigEndian.PutUint16(packet[2:4], uint16(length))
+	if req.fingerprint {
+		crc := crc32.ChecksumIEEE(packet) ^ 0x5354554e
+		packet = binary.BigEndian.AppendUint16(packet, 0x8028)
+		packet = binary.BigEndian.AppendUint16(packet, 4)
+		packet = binary.BigEndian.AppendUint32(packet, crc)
+	}
+	return packet
+}
+
+// checkResponse checks the header and FINGERPRINT of a response to the test
+// transaction and returns its attributes.
+func checkResponse(t *testing.T, response []byte, wantType uint16) map[uint16][]byte {
+	t.Helper()
+
+	if len(response) < headerSize+8 {
+		t.Fatalf("response of %d bytes", len(response))
+	}
+	if typ := binary.BigEndian.Uint16(response[0:2]); typ != wantType {
+		t.Fatalf("response type %#04x, want %#04x", typ, wantType)
+	}
+	if length := int(binary.BigEndian.Uint16(response[2:4])); headerSize+length != len(response) {
+		t.Fatalf("length %d for %d bytes", length, len(response))
+	}
+	if cookie := binary.BigEndian.Uint32(response[4:8]); cookie != magicCookie {
+		t.Fatalf("magic cookie %#x", cookie)
+	}
+	if !bytes.Equal(response[8:20], testTransactionID[:]) {
+		t.Fatalf("transaction ID % x, want % x", response[8:20], testTransactionID)
+	}
+
+	// FINGERPRINT is last, over everything before it
+	tail := response[len(response)-8:]
+	if binary.BigEndian.Uint16(tail[0:2]) != 0x8028 || binary.BigEndian.Uint16(tail[2:4]) != 4 {
+		t.Fatalf("no FINGERPRINT at the end: % x", tail)
+	}
+	if crc := crc32.ChecksumIEEE(response[:len(response)-8]) ^ 0x5354554e; binary.BigEndian.Uint32(tail[4:8]) != crc {
+		t.Fatalf("FINGERPRINT %#08x, want %#08x", binary.BigEndian.Uint32(tail[4:8]), crc)
+	}
+
+	msg, err := parseMessage(response)
+	if err != nil {
+		t.Fatalf("parse response: %v", err)
+	}
+	attributes := make(map[uint16][]byte)
+	for _, attr := range msg.attributes {
+		attributes[attr.typ] = attr.value
+	}
+	return attributes
+}
+
+// xorMappedAddress decodes an XOR-MAPPED-ADDRESS of the test transaction.
+func xorMappedAddress(t *testing.T, value []byte) *net.UDPAddr {
+	t.Helper()
+
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:4], magicCookie)
+	copy(key[4:], testTransactionID[:])
+
+	size := map[byte]int{familyIPv4: net.IPv4len, familyIPv6: net.IPv6len}[value[1]]
+	if size == 0 || len(value) != 4+size {
+		t.Fatalf("bad XOR-MAPPED-ADDRESS % x", value)
+	}
+	ip := make(net.IP, size)
+	for i := range ip {
+		ip[i] = value[4+i] ^ key[i]
+	}
+	port := binary.BigEndian.Uint16(value[2:4]) ^ uint16(magicCookie>>16)
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+func startServer(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	server := NewServer(zap.NewNop())
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := server.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	client, err := net.DialUDP("udp", nil, server.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+// exchange sends packet and returns the response, nil when none comes.
+func exchange(t *testing.T, client *net.UDPConn, packet []byte, wait time.Duration) []byte {
+	t.Helper()
+
+	if _, err := client.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetReadDeadline(time.Now().Add(wait)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxPacketSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil
+		}
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestServerBinding(t *testing.T) {
+	client := startServer(t)
+
+	response := exchange(t, client, request{typ: typeBindingRequest, fingerprint: true}.encode(), time.Second)
+	attributes := checkResponse(t, response, typeBindingSuccess)
+
+	value, ok := attributes[attrXORMappedAddress]
+	if !ok {
+		t.Fatal("no XOR-MAPPED-ADDRESS")
+	}
+	local := client.LocalAddr().(*net.UDPAddr)
+	if mapped := xorMappedAddress(t, value); !mapped.IP.Equal(local.IP) || mapped.Port != local.Port {
+		t.Errorf("mapped address %s, want %s", mapped, local)
+	}
+	if string(attributes[attrSoftware]) != software {
+		t.Errorf("SOFTWARE %q", attributes[attrSoftware])
+	}
+}
+
+// TestServerSurvivesMalformed checks that junk gets no answer and leaves the
+// server answering.
+func TestServerSurvivesMalformed(t *testing.T) {
+	client := startServer(t)
+
+	for _, packet := range [][]byte{{0x00}, bytes.Repeat([]byte{0xFF}, 64)} {
+		if response := exchange(t, client, packet, 100*time.Millisecond); response != nil {
+			t.Errorf("answered % x with % x", packet, response)
+		}
+	}
+
+	response := exchange(t, client, request{typ: typeBindingRequest}.encode(), time.Second)
+	checkResponse(t, response, typeBindingSuccess)
+}
+
+func TestHandle(t *testing.T) {
+	ipv4 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 54321}
+	ipv6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 3478}
+
+	tests := []struct {
+		name    string
+		request request
+		from    *net.UDPAddr
+		// wantType is 0 when no response is expected
+		wantType    uint16
+		wantUnknown []uint16
+	}{
+		{
+			name:     "ipv4",
+			request:  request{typ: typeBindingRequest},
+			from:     ipv4,
+			wantType: typeBindingSuccess,
+		},
+		{
+			name:     "ipv6",
+			request:  request{typ: typeBindingRequest, fingerprint: true},
+			from:     ipv6,
+			wantType: typeBindingSuccess,
+		},
+		{
+			name: "credentials ignored",
+			request: request{typ: typeBindingRequest, fingerprint: true, attributes: []attribute{
+				{typ: attrUsername, value: []byte("remote:local")},
+				{typ: attrMessageIntegrity, value: make([]byte, 20)},
+			}},
+			from:     ipv4,
+			wantType: typeBindingSuccess,
+		},
+		{
+			name: "unknown optional attribute ignored",
+			request: request{typ: typeBindingRequest, attributes: []attribute{
+				{typ: 0x8029, value: make([]byte, 8)}, // ICE-CONTROLLED
+			}},
+			from:     ipv4,
+			wantType: typeBindingSuccess,
+		},
+		{
+			name: "unknown required attributes rejected",
+			request: request{typ: typeBindingRequest, attributes: []attribute{
+				{typ: attrUsername, value: []byte("user")},
+				{typ: 0x0024, value: make([]byte, 4)}, // PRIORITY
+				{typ: 0x0025},                         // USE-CANDIDATE
+			}},
+			from:        ipv4,
+			wantType:    typeBindingErrorResponse,
+			wantUnknown: []uint16{0x0024, 0x0025},
+		},
+		{
+			name:    "indication not answered",
+			request: request{typ: 0x0011},
+			from:    ipv4,
+		},
+		{
+			name:    "response not answered",
+			request: request{typ: typeBindingSuccess},
+			from:    ipv4,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := handle(test.request.encode(), test.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.wantType == 0 {
+				if response != nil {
+					t.Fatalf("answered with % x", response)
+				}
+				return
+			}
+
+			attributes := checkResponse(t, response, test.wantType)
+			if test.wantType == typeBindingErrorResponse {
+				code := attributes[attrErrorCode]
+				if len(code) < 4 || int(code[2])*100+int(code[3]) != codeUnknownAttribute {
+					t.Errorf("ERROR-CODE % x", code)
+				}
+				var unknown []uint16
+				for value := attributes[attrUnknownAttributes]; len(value) >= 2; value = value[2:] {
+					unknown = append(unknown, binary.BigEndian.Uint16(value))
+				}
+				if !slices.Equal(unknown, test.wantUnknown) {
+					t.Errorf("UNKNOWN-ATTRIBUTES %#04x, want %#04x", unknown, test.wantUnknown)
+				}
+				return
+			}
+
+			mapped := xorMappedAddress(t, attributes[attrXORMappedAddress])
+			if !mapped.IP.Equal(test.from.IP) || mapped.Port != test.from.Port {
+				t.Errorf("mapped address %s, want %s", mapped, test.from)
+			}
+		})
+	}
+}
+
+func TestHandleMalformed(t *testing.T) {
+	valid := request{typ: typeBindingRequest, fingerprint: true}.encode()
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 54321}
+
+	// with returns a copy of valid changed by change
+	with := func(change func(packet []byte) []byte) []byte {
+		return change(slices.Clone(valid))
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{name: "empty", packet: nil},
+		{name: "short header", packet: valid[:headerSize-1]},
+		{name: "bad magic cookie", packet: with(func(p []byte) []byte { p[4] ^= 0xFF; return p })},
+		{name: "not a stun message", packet: with(func(p []byte) []byte { p[0] |= 0x80; return p })},
+		{name: "length past the end", packet: with(func(p []byte) []byte { binary.BigEndian.PutUint16(p[2:4], 64); return p })},
+		{
+			// half an attribute header, which is not a multiple of four
+			name: "truncated attribute header",
+			packet: with(func(p []byte) []byte {
+				binary.BigEndian.PutUint16(p[2:4], 2)
+				return p[:headerSize+2]
+			}),
+		},
+		{
+			name: "truncated attribute",
+			packet: func() []byte {
+				p := request{typ: typeBindingRequest, attributes: []attribute{{typ: attrSoftware, value: []byte("client")}}}.encode()
+				// the attribute claims more than the message holds
+				binary.BigEndian.PutUint16(p[headerSize+2:headerSize+4], 64)
+				return p
+			}(),
+		},
+		{name: "bad fingerprint", packet: with(func(p []byte) []byte { p[len(p)-1] ^= 0xFF; return p })},
+		{
+			name: "fingerprint not last",
+			packet: func() []byte {
+				p := slices.Clone(valid)
+				p = append(p, 0x80, 0x22, 0, 0)
+				binary.BigEndian.PutUint16(p[2:4], uint16(len(p)-headerSize))
+				return p
+			}(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := handle(test.packet, from)
+			if err == nil || response != nil {
+				t.Errorf("got % x, %v; want an error and no response", response, err)
+			}
+		})
+	}
+}
+
+// FuzzHandle checks that no packet makes the server panic, and that whatever
+// it answers is a well formed response.
+func FuzzHandle(f *testing.F) {
+	f.Add(request{typ: typeBindingRequest}.encode())
+	f.Add(request{typ: typeBindingRequest, fingerprint: true}.encode())
+	f.Add(request{typ: typeBindingRequest, attributes: []attribute{{typ: 0x0024, value: make([]byte, 4)}}}.encode())
+	f.Add([]byte{0x00, 0x01, 0x00, 0x04, 0x21, 0x12, 0xA4, 0x42})
+
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 54321}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		response, err := handle(packet, from)
+		if err != nil || response == nil {
+			return
+		}
+		if _, err := parseMessage(response); err != nil {
+			t.Fatalf("malformed response % x: %v", response, err)
+		}
+	})
+}
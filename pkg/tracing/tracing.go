@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"vidcall/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const serviceName = "vidcall"
+
+var Module = fx.Module("tracing",
+	fx.Invoke(Register),
+)
+
+type Params struct {
+	fx.In
+
+	Lifecycle fx.Lifecycle
+	Config    config.Config
+	Logger    *zap.Logger
+}
+
+// Register installs the global tracer provider described by the tracing
+// section of the config, which every package gets its tracer from, and the
+// W3C trace context propagator. With the none exporter spans are not
+// recorded, but trace context still flows through.
+func Register(params Params) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	cfg := params.Config.Tracing
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	exporter, err := newExporter(cfg)
+	if err != nil {
+		return fmt.Errorf("tracing: create %s exporter: %w", cfg.Exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+		// a sampled client keeps its trace whole
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		params.Logger.Warn("Export spans failed", zap.Error(err))
+	}))
+
+	params.Lifecycle.Append(fx.Hook{
+		// flushes the spans still buffered
+		OnStop: provider.Shutdown,
+	})
+
+	return nil
+}
+
+// newExporter only configures the exporter, the collector is dialled lazily.
+func newExporter(cfg config.Tracing) (sdktrace.SpanExporter, error) {
+	ctx := context.Background()
+
+	switch cfg.Exporter {
+	case "stdout":
+		return stdouttrace.New()
+	case "otlp":
+		if cfg.Protocol == "http" {
+			options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+			if cfg.Insecure {
+				options = append(options, otlptracehttp.WithInsecure())
+			}
+			return otlptracehttp.New(ctx, options...)
+		}
+
+		options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", cfg.Exporter)
+	}
+}
+
+// End ends span, marking it failed when err is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}